@@ -15,6 +15,7 @@ import (
 func main() {
 	// get a new wrapper
 	wg := wgwrapper.New()
+	defer wg.Close()
 
 	// set up a new wireguard interface struct w/ some defaults
 	wgi := wgwrapper.NewWireguardInterface("wg-wrap-0", net.IPNet{
@@ -4,4 +4,9 @@ go 1.15
 
 replace github.com/aschmidt75/go-wg-wgrapper/wgwrapper => ./pkg/wgwrapper
 
-require golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200609130330-bd2cb7843e1b
+require (
+	github.com/mdlayher/netlink v1.1.0
+	golang.org/x/crypto v0.0.0-20200204104054-c9f3fb736b72
+	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5
+	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200609130330-bd2cb7843e1b
+)
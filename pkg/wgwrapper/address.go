@@ -0,0 +1,206 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Addresses returns all addresses assigned to an interface
+func (wg wgwrapper) Addresses(intf WireguardInterface) ([]net.IPNet, error) {
+	a, err := wg.backend.AddrList(wg.context(), intf.InterfaceName)
+	if err != nil {
+		return nil, wrapError("list addresses", intf.InterfaceName, err)
+	}
+	return a, nil
+}
+
+// AddAddress assigns an address to an interface, keeping others.
+// Returns false if the interface has it already.
+func (wg wgwrapper) AddAddress(intf WireguardInterface, addr net.IPNet) (bool, error) {
+	undo, err := wg.addSingleAddress(intf, addr)
+	return undo != nil, err
+}
+
+func (wg wgwrapper) addSingleAddress(intf WireguardInterface, addr net.IPNet) (undoFunc, error) {
+	if err := validAddress(addr); err != nil {
+		return nil, wrapError("add address", intf.InterfaceName, err)
+	}
+	a, err := wg.Addresses(intf)
+	if err != nil {
+		return nil, err
+	}
+	if indexOfIPNet(a, addr) != -1 {
+		return nil, nil
+	}
+	err = wg.backend.AddrAdd(wg.context(), intf.InterfaceName, addr)
+	if err != nil {
+		return nil, wrapError("add address", intf.InterfaceName, err)
+	}
+	return func(wg wgwrapper) error {
+		return removeAddresses(wg, intf.InterfaceName, []net.IPNet{addr})
+	}, nil
+}
+
+// RemoveAddress removes an address from an interface. Returns
+// false if the interface does not have it.
+func (wg wgwrapper) RemoveAddress(intf WireguardInterface, addr net.IPNet) (bool, error) {
+	undo, err := wg.removeSingleAddress(intf, addr)
+	return undo != nil, err
+}
+
+func (wg wgwrapper) removeSingleAddress(intf WireguardInterface, addr net.IPNet) (undoFunc, error) {
+	a, err := wg.Addresses(intf)
+	if err != nil {
+		return nil, err
+	}
+	if indexOfIPNet(a, addr) == -1 {
+		return nil, nil
+	}
+	err = wg.backend.AddrDel(wg.context(), intf.InterfaceName, addr)
+	if err != nil {
+		return nil, wrapError("remove address", intf.InterfaceName, err)
+	}
+	return func(wg wgwrapper) error {
+		return addAddresses(wg, intf.InterfaceName, []net.IPNet{addr})
+	}, nil
+}
+
+// ReplaceAddress replaces address old of an interface by new. The new
+// address is assigned before the old one is removed, so the interface
+// is never without address. Either of them may be absent already.
+func (wg wgwrapper) ReplaceAddress(intf WireguardInterface, old, new net.IPNet) error {
+	_, err := wg.replaceAddress(intf, old, new)
+	return err
+}
+
+func (wg wgwrapper) replaceAddress(intf WireguardInterface, old, new net.IPNet) (undoFunc, error) {
+	undoAdd, err := wg.addSingleAddress(intf, new)
+	if err != nil || old.String() == new.String() {
+		return undoAdd, err
+	}
+	undoRemove, err := wg.removeSingleAddress(intf, old)
+	if err != nil {
+		if undoAdd != nil {
+			if uerr := undoAdd(wg); uerr != nil {
+				return nil, &RollbackError{Err: err, Errors: []error{uerr}}
+			}
+		}
+		return nil, err
+	}
+	if undoAdd == nil && undoRemove == nil {
+		return nil, nil
+	}
+	return func(wg wgwrapper) error {
+		if undoRemove != nil {
+			if err := undoRemove(wg); err != nil {
+				return err
+			}
+		}
+		if undoAdd != nil {
+			return undoAdd(wg)
+		}
+		return nil
+	}, nil
+}
+
+// SyncAddresses makes the addresses of an interface match addrs: missing
+// ones are added first, then others are removed, so the interface keeps
+// an address throughout. Returns the changes made.
+func (wg wgwrapper) SyncAddresses(intf WireguardInterface, addrs []net.IPNet) ([]Change, error) {
+	changes, _, err := wg.syncAddresses(intf, addrs)
+	return changes, err
+}
+
+func (wg wgwrapper) syncAddresses(intf WireguardInterface, addrs []net.IPNet) ([]Change, undoFunc, error) {
+	for _, addr := range addrs {
+		if err := validAddress(addr); err != nil {
+			return []Change{}, nil, wrapError("sync addresses", intf.InterfaceName, err)
+		}
+	}
+	current, err := wg.Addresses(intf)
+	if err != nil {
+		return []Change{}, nil, err
+	}
+	add, remove := diffAddresses(current, addrs)
+
+	changes := []Change{}
+	added := []net.IPNet{}
+	removed := []net.IPNet{}
+	undo := func(wg wgwrapper) error {
+		if err := addAddresses(wg, intf.InterfaceName, removed); err != nil {
+			return err
+		}
+		return removeAddresses(wg, intf.InterfaceName, added)
+	}
+
+	for _, a := range add {
+		if err := wg.backend.AddrAdd(wg.context(), intf.InterfaceName, a); err != nil {
+			return changes, undo, wrapError("add address", intf.InterfaceName, err)
+		}
+		added = append(added, a)
+		changes = append(changes, Change{Op: "add address", Target: a.String()})
+	}
+	for _, a := range remove {
+		if err := wg.backend.AddrDel(wg.context(), intf.InterfaceName, a); err != nil {
+			return changes, undo, wrapError("remove address", intf.InterfaceName, err)
+		}
+		removed = append(removed, a)
+		changes = append(changes, Change{Op: "remove address", Target: a.String()})
+	}
+	if len(changes) == 0 {
+		return changes, nil, nil
+	}
+	return changes, undo, nil
+}
+
+// diffAddresses compares the addresses of an interface with the
+// desired ones. Returns those to be added and those to be removed.
+func diffAddresses(current, desired []net.IPNet) ([]net.IPNet, []net.IPNet) {
+	add := []net.IPNet{}
+	for _, a := range desired {
+		if indexOfIPNet(current, a) == -1 && indexOfIPNet(add, a) == -1 {
+			add = append(add, a)
+		}
+	}
+	remove := []net.IPNet{}
+	for _, a := range current {
+		if indexOfIPNet(desired, a) == -1 {
+			remove = append(remove, a)
+		}
+	}
+	return add, remove
+}
+
+// validAddress checks that addr is an address with prefix length
+func validAddress(addr net.IPNet) error {
+	if addr.IP == nil || addr.Mask == nil {
+		return errors.New("address and prefix length required")
+	}
+	if ones, bits := addr.Mask.Size(); bits == 0 || (addr.IP.To4() != nil) != (bits == 32) || ones > bits {
+		return fmt.Errorf("invalid address %s", addr.String())
+	}
+	return nil
+}
+
+// addAddresses assigns addresses to an interface, for undoFuncs
+func addAddresses(wg wgwrapper, name string, addrs []net.IPNet) error {
+	for _, a := range addrs {
+		if err := wg.backend.AddrAdd(wg.context(), name, a); err != nil {
+			return wrapError("add address", name, err)
+		}
+	}
+	return nil
+}
+
+// removeAddresses removes addresses from an interface, for undoFuncs
+func removeAddresses(wg wgwrapper, name string, addrs []net.IPNet) error {
+	for _, a := range addrs {
+		if err := wg.backend.AddrDel(wg.context(), name, a); err != nil {
+			return wrapError("remove address", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDiffAddresses(t *testing.T) {
+	parse := func(s ...string) []net.IPNet {
+		res := []net.IPNet{}
+		for _, c := range s {
+			ip, n, _ := net.ParseCIDR(c)
+			res = append(res, net.IPNet{IP: ip, Mask: n.Mask})
+		}
+		return res
+	}
+	add, remove := diffAddresses(parse("10.0.0.1/24", "fd00::1/64"), parse("fd00::1/64", "10.0.0.2/24", "10.0.0.2/24"))
+	if !reflect.DeepEqual(add, parse("10.0.0.2/24")) || !reflect.DeepEqual(remove, parse("10.0.0.1/24")) {
+		t.Errorf("Unexpected diff: %v, %v", add, remove)
+	}
+}
+
+func TestAddressValidation(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+
+	for _, a := range []net.IPNet{
+		{},
+		{IP: net.ParseIP("10.0.0.1")},
+		{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(64, 128)},
+		{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(24, 32)},
+	} {
+		if _, err := wg.AddAddress(wgi, a); err == nil {
+			t.Errorf("AddAddress of %#v should fail but did not", a)
+		}
+		if _, err := wg.SyncAddresses(wgi, []net.IPNet{a}); err == nil {
+			t.Errorf("SyncAddresses with %#v should fail but did not", a)
+		}
+	}
+	if a := addressStrings(t, wg, wgi); !reflect.DeepEqual(a, []string{wgi.IP.String()}) {
+		t.Errorf("Invalid addresses should not change the interface, got: %v", a)
+	}
+}
+
+func TestTransactionSyncAddresses(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+
+	a4 := net.IPNet{IP: net.ParseIP("10.99.98.1"), Mask: net.CIDRMask(24, 32)}
+	a6 := net.IPNet{IP: net.ParseIP("fd00:99::1"), Mask: net.CIDRMask(64, 128)}
+	tx := wg.Begin()
+	changes, err := tx.SyncAddresses(wgi, []net.IPNet{a4, a6})
+	if err != nil || len(changes) != 3 {
+		t.Fatalf("Unexpected result of SyncAddresses: %v, %v", changes, err)
+	}
+	if err := tx.ReplaceAddress(wgi, a4, wgi.IP); err != nil {
+		t.Fatalf("Unable to execute ReplaceAddress: %s", err)
+	}
+	if a := addressStrings(t, wg, wgi); !reflect.DeepEqual(a, []string{wgi.IP.String(), a6.String()}) {
+		t.Errorf("Unexpected addresses in transaction: %v", a)
+	}
+
+	// a failing step reverts the changes, in reverse order
+	_, err = tx.AddAddress(wgi, net.IPNet{})
+	if err == nil {
+		t.Fatal("AddAddress without address should fail but did not")
+	}
+	if a := addressStrings(t, wg, wgi); !reflect.DeepEqual(a, []string{wgi.IP.String()}) {
+		t.Errorf("Failed transaction should restore addresses, got: %v", a)
+	}
+	if _, err := tx.RemoveAddress(wgi, wgi.IP); !errors.Is(err, ErrTransactionDone) {
+		t.Errorf("Rolled back transaction should fail with ErrTransactionDone, got: %v", err)
+	}
+}
+
+func TestAddInterfaceAddresses(t *testing.T) {
+	wg := NewInMemory()
+
+	// addresses given twice are assigned once
+	a4 := net.IPNet{IP: net.ParseIP("10.99.98.1"), Mask: net.CIDRMask(24, 32)}
+	a6 := net.IPNet{IP: net.ParseIP("fd00:99::1"), Mask: net.CIDRMask(64, 128)}
+	wgi := NewWireguardInterfaceAddrs(newWGIntf().InterfaceName, []net.IPNet{a4, a6, a4})
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if a := addressStrings(t, wg, wgi); !reflect.DeepEqual(a, []string{a4.String(), a6.String()}) {
+		t.Errorf("Unexpected addresses: %v", a)
+	}
+	if wgi.IP.String() != a4.String() {
+		t.Errorf("IP should be the first address, got: %s", wgi.IP.String())
+	}
+
+	// an invalid address removes the interface again
+	wgi = NewWireguardInterfaceAddrs(newWGIntf().InterfaceName, []net.IPNet{a4, {IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(24, 32)}})
+	if err := wg.AddInterface(wgi); err == nil {
+		t.Error("AddInterface with invalid address should fail but did not")
+	}
+	if ex, err := wg.HasInterface(wgi); err != nil || ex {
+		t.Errorf("AddInterface should remove a half-built interface: %t, %v", ex, err)
+	}
+}
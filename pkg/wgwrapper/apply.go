@@ -0,0 +1,98 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"net"
+)
+
+// InterfaceSpec describes the desired state of a wireguard interface,
+// as given to Apply
+type InterfaceSpec struct {
+	InterfaceName string
+
+	// Addresses are all addresses of the interface, others are removed
+	Addresses []net.IPNet
+
+	// PrivateKey of the interface. If empty, an existing key is kept
+	// or a new one is generated.
+	PrivateKey string
+
+	// ListenPort of the interface. If 0, the current port is kept
+	ListenPort int
+
+	// FirewallMark of the interface. If 0, the current mark is kept
+	FirewallMark int
+
+	// MTU, TxQueueLen and Alias of the link. Zero values leave the
+	// current ones in place. AutoMTU derives the MTU from the underlay,
+	// including the routes to the endpoints of Peers.
+	MTU        int
+	TxQueueLen int
+	Alias      string
+
+	// Peers are all peers of the interface, others are removed
+	Peers []WireguardPeer
+
+	// Routes are networks in CIDR notation routed via the interface.
+	// Routes not given here are left in place. As the kernel drops
+	// routes of links that are down, they are only applied if Up is set.
+	Routes []string
+
+	// RoutesFromPeers routes the allowed IPs of Peers via the interface,
+	// like wg-quick does, and removes the routes added for allowed IPs
+	// no peer has any more, see SyncRoutes
+	RoutesFromPeers bool
+
+	// Up is the desired link state
+	Up bool
+}
+
+// InterfaceSpec returns the desired state described by the
+// configuration, for an interface with given name that is up.
+// Peers' allowed IPs are routed via the main table unless Table
+// says otherwise.
+func (c *WireguardQuickConfig) InterfaceSpec(interfaceName string) InterfaceSpec {
+	return InterfaceSpec{
+		InterfaceName: interfaceName,
+		Addresses:     c.Interface.Addresses,
+		PrivateKey:    c.Interface.PrivateKey,
+		ListenPort:    c.Interface.ListenPort,
+		FirewallMark:  c.Interface.FwMark,
+		MTU:           c.Interface.MTU,
+		Peers:         c.Peers,
+		Up:            true,
+
+		// routes in other tables need policy routing, wg-quick style
+		RoutesFromPeers: c.Interface.Table == "" || c.Interface.Table == "auto" || c.Interface.Table == "main",
+	}
+}
+
+// Apply converges the interface to spec: it creates the interface if
+// necessary, then reconciles link attributes, addresses, keys, listen
+// port, firewall mark, peers, link state and routes. Returns the changes made, which are none
+// if the interface already matches spec. On error, the changes made
+// until then are reverted, see ApplyPlan.
+func (wg wgwrapper) Apply(spec InterfaceSpec) ([]Change, error) {
+	plan, err := wg.Plan(spec)
+	if err != nil {
+		return []Change{}, err
+	}
+	return wg.ApplyPlan(plan)
+}
+
+// ApplyPlan executes the changes of a plan computed by Plan within a
+// transaction. If a step fails, the steps before are reverted in reverse
+// order and no changes are returned, along with the error. It is a
+// *RollbackError if reverting failed as well.
+func (wg wgwrapper) ApplyPlan(plan *Plan) ([]Change, error) {
+	tx := wg.Begin()
+	changes := []Change{}
+	for _, step := range plan.steps {
+		if err := tx.do(step.run); err != nil {
+			return []Change{}, err
+		}
+		changes = append(changes, step.changes...)
+	}
+	return changes, tx.Commit()
+}
@@ -0,0 +1,99 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"net"
+
+	wgctrl "golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// wgClient is the part of wgctrl.Client that is used to
+// query and configure wireguard devices
+type wgClient interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
+
+// newWgctrlClient opens a new wgctrl client
+func newWgctrlClient() (wgClient, error) {
+	return wgctrl.New()
+}
+
+// linkBackend abstracts the link, address and route operations
+// that are not covered by wgctrl. Implementations either call
+// /sbin/ip or talk rtnetlink directly.
+type linkBackend interface {
+
+	// LinkExists checks if a link by given name is present
+	LinkExists(ctx context.Context, name string) (bool, error)
+
+	// LinkAdd creates a new link of type wireguard
+	LinkAdd(ctx context.Context, name string) error
+
+	// LinkDelete removes a wireguard link
+	LinkDelete(ctx context.Context, name string) error
+
+	// LinkIsUp checks if the link is in UP state
+	LinkIsUp(ctx context.Context, name string) (bool, error)
+
+	// LinkSetUp brings the link in UP state
+	LinkSetUp(ctx context.Context, name string) error
+
+	// LinkSetDown brings the link in DOWN state
+	LinkSetDown(ctx context.Context, name string) error
+
+	// LinkAttrs returns the MTU, transmit queue length and alias of the link
+	LinkAttrs(ctx context.Context, name string) (linkAttrs, error)
+
+	// LinkSetMTU changes the MTU of the link
+	LinkSetMTU(ctx context.Context, name string, mtu int) error
+
+	// LinkSetTxQueueLen changes the transmit queue length of the link
+	LinkSetTxQueueLen(ctx context.Context, name string, qlen int) error
+
+	// LinkSetAlias changes the alias of the link, an empty one removes it
+	LinkSetAlias(ctx context.Context, name string, alias string) error
+
+	// AddrList returns all addresses assigned to the link
+	AddrList(ctx context.Context, name string) ([]net.IPNet, error)
+
+	// AddrAdd assigns an address to the link
+	AddrAdd(ctx context.Context, name string, addr net.IPNet) error
+
+	// AddrDel removes an address from the link
+	AddrDel(ctx context.Context, name string, addr net.IPNet) error
+
+	// RouteList returns the unicast routes of family (unix.AF_INET or
+	// unix.AF_INET6) via the link in a table, 0 for the main table, or
+	// in all tables but the local one for routeTableAll
+	RouteList(ctx context.Context, name string, family uint8, table int) ([]Route, error)
+
+	// RouteAdd adds a route via the link
+	RouteAdd(ctx context.Context, name string, r Route) error
+
+	// RouteReplace adds a route via the link, or replaces the one
+	// with the same destination, table and metric
+	RouteReplace(ctx context.Context, name string, r Route) error
+
+	// RouteDel removes the route with the destination, table and
+	// metric of r via the link
+	RouteDel(ctx context.Context, name string, r Route) error
+
+	// DefaultRouteInterface returns the interface name behind the default route.
+	DefaultRouteInterface(ctx context.Context) (string, error)
+
+	// RouteGet returns the name of the link that packets to ip are sent through
+	RouteGet(ctx context.Context, ip net.IP) (string, error)
+}
+
+// linkAttrs are the attributes of a link that are not covered by
+// wgctrl, as returned by linkBackend.LinkAttrs
+type linkAttrs struct {
+	MTU        int
+	TxQueueLen int
+	Alias      string
+}
@@ -0,0 +1,179 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// defaultBatchSize is the number of peers per device configuration
+// of AddPeers and RemovePeers, unless set by WithBatchSize
+const defaultBatchSize = 1000
+
+// chunkSize returns the number of peers per device configuration
+func (wg wgwrapper) chunkSize() int {
+	if wg.batchSize <= 0 {
+		return defaultBatchSize
+	}
+	return wg.batchSize
+}
+
+// AddPeers adds peers to an existing interface. All peers are validated
+// before the device is touched, so an invalid or duplicate peer fails the
+// whole batch. The device is read once, peers that are present already are
+// left untouched. The others are sent in chunks of the batch size, see
+// WithBatchSize. Returns the number of peers added. If a chunk fails, the
+// peers added by earlier chunks are kept and counted.
+func (wg wgwrapper) AddPeers(intf WireguardInterface, peers []WireguardPeer) (int, error) {
+	n, _, err := wg.addPeers(intf, peers)
+	return n, err
+}
+
+// addPeers implements AddPeers. The undoFunc removes the peers
+// added, it is also returned if a chunk fails.
+func (wg wgwrapper) addPeers(intf WireguardInterface, peers []WireguardPeer) (int, undoFunc, error) {
+	configs := make([]wgtypes.PeerConfig, 0, len(peers))
+	seen := make(map[wgtypes.Key]bool, len(peers))
+	for idx, peer := range peers {
+		pc, err := peerConfig(wg.context(), peer)
+		if err != nil {
+			return 0, nil, wrapError("add peers", intf.InterfaceName, fmt.Errorf("peer %d: %w", idx, err))
+		}
+		if seen[pc.PublicKey] {
+			return 0, nil, wrapError("add peers", intf.InterfaceName, fmt.Errorf("duplicate peer %s", peer.Pubkey))
+		}
+		seen[pc.PublicKey] = true
+		configs = append(configs, pc)
+	}
+
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return 0, nil, wrapError("add peers", intf.InterfaceName, err)
+	}
+	defer wgClient.Close()
+
+	wgDevice, err := wgClient.Device(intf.InterfaceName)
+	if err != nil {
+		return 0, nil, wrapError("add peers", intf.InterfaceName, err)
+	}
+	for _, p := range wgDevice.Peers {
+		delete(seen, p.PublicKey)
+	}
+	missing := configs[:0]
+	for _, pc := range configs {
+		if seen[pc.PublicKey] {
+			missing = append(missing, pc)
+		}
+	}
+
+	n, err := wg.configureChunked(wgClient, intf, missing)
+	if n == 0 {
+		return 0, nil, wrapError("add peers", intf.InterfaceName, err)
+	}
+
+	remove := make([]wgtypes.PeerConfig, n)
+	for idx, pc := range missing[:n] {
+		remove[idx] = wgtypes.PeerConfig{PublicKey: pc.PublicKey, Remove: true}
+	}
+	undo := func(wg wgwrapper) error {
+		return wg.restoreChunked(intf, remove)
+	}
+	if err != nil {
+		return n, undo, wrapError("add peers", intf.InterfaceName, err)
+	}
+	undo, err = wg.syncPeerRoutes(intf, undo)
+	return n, undo, err
+}
+
+// RemovePeers removes peers from an interface by their public keys. All
+// keys are validated before the device is touched. Unknown peers are
+// skipped, the others are removed in chunks of the batch size, see
+// WithBatchSize. Returns the number of peers removed. If a chunk fails,
+// the peers removed by earlier chunks stay removed and are counted.
+func (wg wgwrapper) RemovePeers(intf WireguardInterface, pubkeys []string) (int, error) {
+	n, _, err := wg.removePeers(intf, pubkeys)
+	return n, err
+}
+
+// removePeers implements RemovePeers. The undoFunc restores the
+// peers removed, it is also returned if a chunk fails.
+func (wg wgwrapper) removePeers(intf WireguardInterface, pubkeys []string) (int, undoFunc, error) {
+	keys := make(map[wgtypes.Key]bool, len(pubkeys))
+	for _, pubkey := range pubkeys {
+		pk, err := wgtypes.ParseKey(pubkey)
+		if err != nil {
+			return 0, nil, wrapError("remove peers", intf.InterfaceName, invalidKey(err))
+		}
+		keys[pk] = true
+	}
+
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return 0, nil, wrapError("remove peers", intf.InterfaceName, err)
+	}
+	defer wgClient.Close()
+
+	wgDevice, err := wgClient.Device(intf.InterfaceName)
+	if err != nil {
+		return 0, nil, wrapError("remove peers", intf.InterfaceName, err)
+	}
+	present := []wgtypes.Peer{}
+	configs := []wgtypes.PeerConfig{}
+	for _, p := range wgDevice.Peers {
+		if keys[p.PublicKey] {
+			present = append(present, p)
+			configs = append(configs, wgtypes.PeerConfig{PublicKey: p.PublicKey, Remove: true})
+		}
+	}
+
+	n, err := wg.configureChunked(wgClient, intf, configs)
+	if n == 0 {
+		return 0, nil, wrapError("remove peers", intf.InterfaceName, err)
+	}
+
+	restore := make([]wgtypes.PeerConfig, n)
+	for idx, p := range present[:n] {
+		restore[idx] = restoreConfig(p)
+	}
+	undo := func(wg wgwrapper) error {
+		return wg.restoreChunked(intf, restore)
+	}
+	if err != nil {
+		return n, undo, wrapError("remove peers", intf.InterfaceName, err)
+	}
+	undo, err = wg.syncPeerRoutes(intf, undo)
+	return n, undo, err
+}
+
+// configureChunked applies peer configurations to a device, at most
+// chunkSize at a time. Returns the number of peers of the chunks
+// that have been applied.
+func (wg wgwrapper) configureChunked(wgClient wgClient, intf WireguardInterface, configs []wgtypes.PeerConfig) (int, error) {
+	size := wg.chunkSize()
+	for start := 0; start < len(configs); start += size {
+		end := start + size
+		if end > len(configs) {
+			end = len(configs)
+		}
+		cfg := wgtypes.Config{Peers: configs[start:end]}
+		if err := wgClient.ConfigureDevice(intf.InterfaceName, cfg); err != nil {
+			return start, err
+		}
+	}
+	return len(configs), nil
+}
+
+// restoreChunked reverts a batch operation by applying
+// configs, in chunks
+func (wg wgwrapper) restoreChunked(intf WireguardInterface, configs []wgtypes.PeerConfig) error {
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return wrapError("restore peers", intf.InterfaceName, err)
+	}
+	defer wgClient.Close()
+
+	_, err = wg.configureChunked(wgClient, intf, configs)
+	return wrapError("restore peers", intf.InterfaceName, err)
+}
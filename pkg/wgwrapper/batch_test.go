@@ -0,0 +1,282 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// batchPeers returns n peers with distinct keys and allowed IPs
+func batchPeers(t testing.TB, n int) []WireguardPeer {
+	peers := make([]WireguardPeer, n)
+	for idx := range peers {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatalf("Unable to generate key: %s", err)
+		}
+		peers[idx] = WireguardPeer{
+			RemoteEndpointIP: "192.168.1.1",
+			ListenPort:       51820,
+			Pubkey:           key.String(),
+			AllowedIPs: []net.IPNet{{
+				IP:   net.IPv4(10, byte(idx>>16), byte(idx>>8), byte(idx)),
+				Mask: net.CIDRMask(32, 32),
+			}},
+		}
+	}
+	return peers
+}
+
+// newBatchInMemory returns an in-memory wrapper with given batch
+// size, whose device configurations are recorded
+func newBatchInMemory(batchSize int) (WireguardWrapper, *recordingClient) {
+	return newRecordingInMemory(WithBatchSize(batchSize))
+}
+
+func countPeers(t testing.TB, wg WireguardWrapper, wgi WireguardInterface) int {
+	n := 0
+	if err := wg.IteratePeers(wgi, func(p WireguardPeer) { n++ }); err != nil {
+		t.Fatalf("Unable to execute IteratePeers: %s", err)
+	}
+	return n
+}
+
+func TestAddPeers(t *testing.T) {
+	wg, c := newBatchInMemory(4)
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	peers := batchPeers(t, 10)
+
+	// invalid and duplicate peers fail the whole batch
+	invalid := append(append([]WireguardPeer{}, peers...), WireguardPeer{Pubkey: "invalid"})
+	n, err := wg.AddPeers(wgi, invalid)
+	if !errors.Is(err, ErrInvalidKey) || n != 0 || len(c.configs) != 0 {
+		t.Errorf("AddPeers with invalid peer should fail without changes: %d, %v", n, err)
+	}
+	n, err = wg.AddPeers(wgi, append(append([]WireguardPeer{}, peers...), peers[3]))
+	if err == nil || n != 0 || len(c.configs) != 0 {
+		t.Errorf("AddPeers with duplicate peer should fail without changes: %d, %v", n, err)
+	}
+
+	// existing peers are skipped
+	if _, err := wg.AddPeer(wgi, peers[0]); err != nil {
+		t.Fatalf("Unable to execute AddPeer: %s", err)
+	}
+	c.configs = nil
+	n, err = wg.AddPeers(wgi, peers)
+	if err != nil || n != 9 {
+		t.Fatalf("Unexpected result of AddPeers: %d, %v", n, err)
+	}
+	if len(c.configs) != 3 || len(c.configs[0].Peers) != 4 || len(c.configs[2].Peers) != 1 {
+		t.Errorf("Expected configurations of 4, 4 and 1 peers, got %d", len(c.configs))
+	}
+	if countPeers(t, wg, wgi) != 10 {
+		t.Errorf("Expected 10 peers")
+	}
+
+	c.configs = nil
+	n, err = wg.AddPeers(wgi, peers)
+	if err != nil || n != 0 || len(c.configs) != 0 {
+		t.Errorf("AddPeers of existing peers should not change anything: %d, %v", n, err)
+	}
+
+	// unknown peers are skipped on removal
+	pubkeys := []string{peers[1].Pubkey, peers[2].Pubkey, peers[3].Pubkey, batchPeers(t, 1)[0].Pubkey}
+	n, err = wg.RemovePeers(wgi, pubkeys)
+	if err != nil || n != 3 {
+		t.Fatalf("Unexpected result of RemovePeers: %d, %v", n, err)
+	}
+	if countPeers(t, wg, wgi) != 7 {
+		t.Errorf("Expected 7 peers")
+	}
+	n, err = wg.RemovePeers(wgi, []string{"invalid"})
+	if !errors.Is(err, ErrInvalidKey) || n != 0 {
+		t.Errorf("RemovePeers with invalid key should fail: %d, %v", n, err)
+	}
+}
+
+// failingClient fails a single device configuration, the one
+// after skip others
+type failingClient struct {
+	wgClient
+	skip int
+}
+
+func (c *failingClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	c.skip--
+	if c.skip == -1 {
+		return errors.New("configuration failed")
+	}
+	return c.wgClient.ConfigureDevice(name, cfg)
+}
+
+func TestAddPeersPartialRollback(t *testing.T) {
+	k := newMemoryKernel()
+	c := &failingClient{wgClient: k, skip: -1}
+	wg := newInMemory(k, c, WithBatchSize(3))
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+
+	// the second chunk fails, the first one is reported
+	c.skip = 1
+	n, err := wg.AddPeers(wgi, batchPeers(t, 7))
+	if err == nil || n != 3 {
+		t.Fatalf("Expected AddPeers to fail after the first chunk: %d, %v", n, err)
+	}
+	if countPeers(t, wg, wgi) != 3 {
+		t.Errorf("Expected peers of the first chunk to be kept")
+	}
+
+	// a transaction reverts the chunks applied
+	c.skip = 1
+	tx := wg.Begin()
+	n, err = tx.AddPeers(wgi, batchPeers(t, 7))
+	if err == nil || n != 3 {
+		t.Fatalf("Expected AddPeers to fail after the first chunk: %d, %v", n, err)
+	}
+	if countPeers(t, wg, wgi) != 3 {
+		t.Errorf("Expected peers of the failed transaction to be removed")
+	}
+}
+
+func TestTransactionRemovePeers(t *testing.T) {
+	wg, _ := newBatchInMemory(2)
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	peers := batchPeers(t, 5)
+	if _, err := wg.AddPeers(wgi, peers); err != nil {
+		t.Fatalf("Unable to execute AddPeers: %s", err)
+	}
+
+	tx := wg.Begin()
+	n, err := tx.RemovePeers(wgi, []string{peers[0].Pubkey, peers[2].Pubkey, peers[4].Pubkey})
+	if err != nil || n != 3 || countPeers(t, wg, wgi) != 2 {
+		t.Fatalf("Unexpected result of RemovePeers: %d, %v", n, err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Unable to roll back: %s", err)
+	}
+	if countPeers(t, wg, wgi) != 5 {
+		t.Errorf("Expected removed peers to be restored")
+	}
+	found, err := wg.HasPeer(wgi, peers[2])
+	if err != nil || !found {
+		t.Errorf("Expected peer to be restored: %v", err)
+	}
+}
+
+// benchmarkAddPeers measures adding n peers to a fresh interface of
+// the wrappers returned by newWrapper, in one batch or one by one
+func benchmarkAddPeers(b *testing.B, newWrapper func() WireguardWrapper, n int, batch bool) {
+	peers := batchPeers(b, n)
+	wgi := newWGIntf()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		wg := newWrapper()
+		if err := wg.AddInterface(wgi); err != nil {
+			b.Fatalf("Unable to execute AddInterface: %s", err)
+		}
+		b.StartTimer()
+
+		if batch {
+			if _, err := wg.AddPeers(wgi, peers); err != nil {
+				b.Fatalf("Unable to execute AddPeers: %s", err)
+			}
+		} else {
+			for _, p := range peers {
+				if _, err := wg.AddPeer(wgi, p); err != nil {
+					b.Fatalf("Unable to execute AddPeer: %s", err)
+				}
+			}
+		}
+
+		b.StopTimer()
+		wg.DeleteInterface(wgi)
+		b.StartTimer()
+	}
+}
+
+// benchmarkRemovePeers measures removing n peers at once from an
+// interface of the wrappers returned by newWrapper
+func benchmarkRemovePeers(b *testing.B, newWrapper func() WireguardWrapper, n int) {
+	peers := batchPeers(b, n)
+	pubkeys := make([]string, len(peers))
+	for idx, p := range peers {
+		pubkeys[idx] = p.Pubkey
+	}
+	wgi := newWGIntf()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		wg := newWrapper()
+		if err := wg.AddInterface(wgi); err != nil {
+			b.Fatalf("Unable to execute AddInterface: %s", err)
+		}
+		if _, err := wg.AddPeers(wgi, peers); err != nil {
+			b.Fatalf("Unable to execute AddPeers: %s", err)
+		}
+		b.StartTimer()
+
+		if _, err := wg.RemovePeers(wgi, pubkeys); err != nil {
+			b.Fatalf("Unable to execute RemovePeers: %s", err)
+		}
+
+		b.StopTimer()
+		wg.DeleteInterface(wgi)
+		b.StartTimer()
+	}
+}
+
+// benchmarkPeers runs the peer benchmarks against the wrappers
+// returned by newWrapper
+func benchmarkPeers(b *testing.B, newWrapper func() WireguardWrapper) {
+	for _, n := range []int{1000, 10000} {
+		n := n
+		b.Run(fmt.Sprintf("AddPeers/batch-%d", n), func(b *testing.B) {
+			benchmarkAddPeers(b, newWrapper, n, true)
+		})
+	}
+	// one configuration per peer, for comparison
+	b.Run("AddPeers/single-1000", func(b *testing.B) {
+		benchmarkAddPeers(b, newWrapper, 1000, false)
+	})
+	b.Run("RemovePeers/batch-10000", func(b *testing.B) {
+		benchmarkRemovePeers(b, newWrapper, 10000)
+	})
+}
+
+// BenchmarkPeersInMemory measures the overhead of the wrapper itself,
+// e.g. validation and chunking, not device throughput
+func BenchmarkPeersInMemory(b *testing.B) {
+	benchmarkPeers(b, func() WireguardWrapper {
+		return NewInMemory()
+	})
+}
+
+// BenchmarkPeersNetlink measures device configurations of the
+// wireguard module via netlink
+func BenchmarkPeersNetlink(b *testing.B) {
+	requireWireguard(b)
+	benchmarkPeers(b, NewNetlink)
+}
+
+// BenchmarkPeersIPCommand measures device configurations of the
+// wireguard module, with links managed by /sbin/ip
+func BenchmarkPeersIPCommand(b *testing.B) {
+	requireWireguard(b)
+	benchmarkPeers(b, func() WireguardWrapper {
+		return New(WithIPCommand())
+	})
+}
@@ -0,0 +1,1192 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// conformance runs the same set of tests against a WireguardWrapper
+// implementation, so that the in-memory one does not drift from
+// the ones working on the kernel.
+func conformance(t *testing.T, newWrapper func(opts ...Option) WireguardWrapper) {
+	t.Run("Interface", func(t *testing.T) {
+		conformanceInterface(t, newWrapper())
+	})
+	t.Run("Configure", func(t *testing.T) {
+		conformanceConfigure(t, newWrapper())
+	})
+	t.Run("Peers", func(t *testing.T) {
+		conformancePeers(t, newWrapper())
+	})
+	t.Run("Routes", func(t *testing.T) {
+		conformanceRoutes(t, newWrapper())
+	})
+	t.Run("RouteAttributes", func(t *testing.T) {
+		conformanceRouteAttributes(t, newWrapper())
+	})
+	t.Run("SyncRoutes", func(t *testing.T) {
+		conformanceSyncRoutes(t, newWrapper())
+	})
+	t.Run("Apply", func(t *testing.T) {
+		conformanceApply(t, newWrapper())
+	})
+	t.Run("ApplyKeyStore", func(t *testing.T) {
+		conformanceApplyKeyStore(t, newWrapper)
+	})
+	t.Run("UpsertPeer", func(t *testing.T) {
+		conformanceUpsertPeer(t, newWrapper())
+	})
+	t.Run("SyncPeers", func(t *testing.T) {
+		conformanceSyncPeers(t, newWrapper())
+	})
+	t.Run("BatchPeers", func(t *testing.T) {
+		conformanceBatchPeers(t, newWrapper())
+	})
+	t.Run("PeerStatus", func(t *testing.T) {
+		conformancePeerStatus(t, newWrapper())
+	})
+	t.Run("PeerWithoutEndpoint", func(t *testing.T) {
+		conformancePeerWithoutEndpoint(t, newWrapper())
+	})
+	t.Run("Addresses", func(t *testing.T) {
+		conformanceAddresses(t, newWrapper())
+	})
+	t.Run("LinkAttributes", func(t *testing.T) {
+		conformanceLinkAttributes(t, newWrapper())
+	})
+	t.Run("RejectedConfig", func(t *testing.T) {
+		conformanceRejectedConfig(t, newWrapper())
+	})
+}
+
+// requireWireguard skips a test if wireguard interfaces cannot be created
+func requireWireguard(t testing.TB) {
+	t.Helper()
+
+	wg := NewNetlink()
+	wgi := newWGIntf()
+	if err := wg.AddInterfaceNoAddr(wgi); err != nil {
+		t.Skipf("wireguard not available: %s", err)
+	}
+	wg.DeleteInterface(wgi)
+}
+
+func TestConformanceInMemory(t *testing.T) {
+	conformance(t, NewInMemory)
+}
+
+func TestConformanceIPCommand(t *testing.T) {
+	requireWireguard(t)
+	conformance(t, func(opts ...Option) WireguardWrapper {
+		return New(append(opts, WithIPCommand())...)
+	})
+}
+
+func TestConformanceNetlink(t *testing.T) {
+	requireWireguard(t)
+	conformance(t, New)
+}
+
+func conformanceInterface(t *testing.T, wg WireguardWrapper) {
+	wgi := newWGIntf()
+
+	ex, err := wg.HasInterface(wgi)
+	if err != nil || ex {
+		t.Errorf("HasInterface on nonexisting interface: %t, %v", ex, err)
+	}
+
+	err = wg.SetInterfaceUp(wgi)
+	if !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("SetInterfaceUp on nonexisting interface should fail with ErrInterfaceNotFound, got: %v", err)
+	}
+
+	err = wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+
+	err = wg.AddInterface(wgi)
+	if err != nil {
+		t.Errorf("AddInterface on existing interface should succeed: %s", err)
+	}
+
+	ex, err = wg.HasInterface(wgi)
+	if err != nil || !ex {
+		t.Errorf("HasInterface on existing interface: %t, %v", ex, err)
+	}
+
+	err = wg.SetInterfaceUp(wgi)
+	if err != nil {
+		t.Errorf("Unable to execute SetInterfaceUp:  %s", err)
+	}
+	err = wg.SetInterfaceUp(wgi)
+	if err != nil {
+		t.Errorf("SetInterfaceUp on interface in UP state should succeed:  %s", err)
+	}
+
+	err = wg.DeleteInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute DeleteInterface:  %s", err)
+	}
+
+	ex, err = wg.HasInterface(wgi)
+	if err != nil || ex {
+		t.Errorf("HasInterface on deleted interface: %t, %v", ex, err)
+	}
+
+	err = wg.DeleteInterface(wgi)
+	if !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("DeleteInterface on nonexisting interface should fail with ErrInterfaceNotFound, got: %v", err)
+	}
+}
+
+func conformanceConfigure(t *testing.T, wg WireguardWrapper) {
+	wgi := newWGIntf()
+	wgiNonEx := newWGIntf()
+	wgiNonEx.ListenPort = 46535
+
+	err := wg.Configure(&wgiNonEx)
+	if !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("Configure on a nonexisting interface should fail with ErrInterfaceNotFound, got: %v", err)
+	}
+
+	err = wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+
+	err = wg.Configure(&wgi)
+	if !errors.Is(err, ErrListenPortMissing) {
+		t.Errorf("Configure without a listening port should fail with ErrListenPortMissing, got: %v", err)
+	}
+
+	wgi.ListenPort = 46534
+	err = wg.Configure(&wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute Configure:  %s", err)
+	}
+	if wgi.PublicKey == "" {
+		t.Error("Configure should set a public key but did not")
+	}
+
+	// a second call keeps the key
+	pk := wgi.PublicKey
+	err = wg.Configure(&wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute Configure:  %s", err)
+	}
+	if wgi.PublicKey != pk {
+		t.Errorf("Configure should keep the public key, but changed it from %s to %s", pk, wgi.PublicKey)
+	}
+
+	// a different key is not applied
+	other, _ := wgtypes.GeneratePrivateKey()
+	wgi.PrivateKey = other.String()
+	err = wg.Configure(&wgi)
+	if !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("Configure with a different key should fail with ErrKeyMismatch, got: %v", err)
+	}
+	wgi.PrivateKey = "invalid"
+	err = wg.Configure(&wgi)
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Configure with an invalid key should fail with ErrInvalidKey, got: %v", err)
+	}
+
+	// a given key is imported
+	wgi2 := newWGIntf()
+	wgi2.ListenPort = 46536
+	wgi2.PrivateKey = other.String()
+	err = wg.AddInterface(wgi2)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi2)
+	err = wg.Configure(&wgi2)
+	if err != nil || wgi2.PublicKey != other.PublicKey().String() {
+		t.Errorf("Configure should import the given key: %s, %v", wgi2.PublicKey, err)
+	}
+	err = wg.Configure(&wgi2)
+	if err != nil {
+		t.Errorf("Configure with the key of the interface should succeed, got: %v", err)
+	}
+}
+
+func conformancePeers(t *testing.T, wg WireguardWrapper) {
+	wgi := newWGIntf()
+	wgiNonEx := newWGIntf()
+
+	err := wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+
+	wgi.ListenPort = 46534
+	err = wg.Configure(&wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute Configure:  %s", err)
+	}
+
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	_, n2, _ := net.ParseCIDR("10.2.0.0/16")
+	wgp1 := WireguardPeer{
+		RemoteEndpointIP: "10.1.2.3",
+		ListenPort:       43210,
+		Pubkey:           "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs:       []net.IPNet{*n1},
+	}
+	wgp2 := WireguardPeer{
+		RemoteEndpointIP: "10.4.5.6",
+		ListenPort:       32345,
+		Pubkey:           "xqr+unDSDc5Fq0W9Zp2SJlzr+wOaFAquNdIMwPLHarw=",
+		AllowedIPs:       []net.IPNet{*n2},
+	}
+
+	_, err = wg.HasPeer(wgiNonEx, wgp1)
+	if !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("HasPeer on nonexisting interface should fail with ErrInterfaceNotFound, got: %v", err)
+	}
+	_, err = wg.AddPeer(wgiNonEx, wgp1)
+	if !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("AddPeer on nonexisting interface should fail with ErrInterfaceNotFound, got: %v", err)
+	}
+	_, err = wg.AddPeer(wgi, WireguardPeer{Pubkey: "invalid"})
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("AddPeer with invalid public key should fail with ErrInvalidKey, got: %v", err)
+	}
+
+	for _, p := range []WireguardPeer{wgp1, wgp2} {
+		ok, err := wg.AddPeer(wgi, p)
+		if err != nil || !ok {
+			t.Errorf("AddPeer of new peer: %t, %v", ok, err)
+		}
+	}
+	ok, err := wg.AddPeer(wgi, wgp1)
+	if err != nil || ok {
+		t.Errorf("AddPeer of existing peer: %t, %v", ok, err)
+	}
+
+	peers := map[string]WireguardPeer{}
+	err = wg.IteratePeers(wgi, func(p WireguardPeer) {
+		peers[p.Pubkey] = p
+	})
+	if err != nil {
+		t.Fatalf("Unable to execute IteratePeers: %s", err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("Expected to find two peers while iterating, got %d", len(peers))
+	}
+	p, ok := peers[wgp2.Pubkey]
+	if !ok || p.RemoteEndpointIP != "10.4.5.6" || p.ListenPort != 32345 {
+		t.Errorf("Unexpected endpoint of peer: %#v", p)
+	}
+	if len(p.AllowedIPs) != 1 || p.AllowedIPs[0].String() != "10.2.0.0/16" {
+		t.Errorf("Unexpected allowed ips of peer: %v", p.AllowedIPs)
+	}
+
+	err = wg.RemovePeerByPubkey(wgi, wgp2.Pubkey)
+	if err != nil {
+		t.Errorf("Unable to execute RemovePeerByPubkey: %s", err)
+	}
+	ok, err = wg.HasPeer(wgi, wgp2)
+	if err != nil || ok {
+		t.Errorf("HasPeer of removed peer: %t, %v", ok, err)
+	}
+	ok, err = wg.HasPeer(wgi, wgp1)
+	if err != nil || !ok {
+		t.Errorf("HasPeer of remaining peer: %t, %v", ok, err)
+	}
+
+	err = wg.RemoveAllPeers(wgi)
+	if err != nil {
+		t.Errorf("Unable to execute RemoveAllPeers: %s", err)
+	}
+	ok, err = wg.HasPeer(wgi, wgp1)
+	if err != nil || ok {
+		t.Errorf("HasPeer after RemoveAllPeers: %t, %v", ok, err)
+	}
+}
+
+func conformanceRoutes(t *testing.T, wg WireguardWrapper) {
+	wgi := newWGIntf()
+
+	err := wg.SetRoute(wgi, "10.99.98.0/24")
+	if !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("SetRoute on nonexisting interface should fail with ErrInterfaceNotFound, got: %v", err)
+	}
+
+	err = wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+
+	err = wg.SetInterfaceUp(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp:  %s", err)
+	}
+
+	err = wg.SetRoute(wgi, "10.99.98.0/24")
+	if err != nil {
+		t.Errorf("Unable to execute SetRoute:  %s", err)
+	}
+	err = wg.SetRoute(wgi, "10.99.98.0/24")
+	if err != nil {
+		t.Errorf("SetRoute on existing route should succeed:  %s", err)
+	}
+
+	_, err = wg.DefaultRouteInterface()
+	if err != nil {
+		t.Errorf("Unable to execute DefaultRouteInterface:  %s", err)
+	}
+}
+
+func conformanceRouteAttributes(t *testing.T, wg WireguardWrapper) {
+	a4 := net.IPNet{IP: net.ParseIP("10.99.98.1"), Mask: net.CIDRMask(24, 32)}
+	a6 := net.IPNet{IP: net.ParseIP("fd00:99::1"), Mask: net.CIDRMask(64, 128)}
+	wgi := NewWireguardInterfaceAddrs(newWGIntf().InterfaceName, []net.IPNet{a4, a6})
+	err := wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+	err = wg.SetInterfaceUp(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp:  %s", err)
+	}
+
+	kernel := []string{
+		"10.99.98.0/24 proto kernel scope link src 10.99.98.1",
+		"fd00:99::/64 proto kernel scope global metric 256",
+	}
+	if r := routeStrings(t, wg, wgi); !reflect.DeepEqual(r, kernel) {
+		t.Errorf("Expected routes to the networks of the addresses %v, got: %v", kernel, r)
+	}
+
+	r4 := mustRoute("10.1.0.0/16")
+	r4.Metric = 10
+	r6 := mustRoute("fd01::/48")
+	r6.Table = 100
+	for _, r := range []Route{r4, r6} {
+		ok, err := wg.AddRoute(wgi, r)
+		if err != nil || !ok {
+			t.Errorf("Unexpected result of AddRoute %s: %t, %v", r, ok, err)
+		}
+		ok, err = wg.AddRoute(wgi, r)
+		if err != nil || ok {
+			t.Errorf("AddRoute of existing route %s should return false: %t, %v", r, ok, err)
+		}
+	}
+
+	// same destination, table and metric, but another scope
+	global := r4
+	global.Scope = ScopeGlobal
+	global.Src = a4.IP
+	_, err = wg.AddRoute(wgi, global)
+	if !errors.Is(err, ErrRouteExists) {
+		t.Errorf("AddRoute of a different route should fail with ErrRouteExists, got: %v", err)
+	}
+	err = wg.ReplaceRoute(wgi, global)
+	if err != nil {
+		t.Errorf("Unable to execute ReplaceRoute:  %s", err)
+	}
+
+	// a source address must be local
+	foreign := mustRoute("10.2.0.0/16")
+	foreign.Src = net.ParseIP("192.0.2.1")
+	_, err = wg.AddRoute(wgi, foreign)
+	if err == nil {
+		t.Error("AddRoute with foreign source address should fail but did not")
+	}
+
+	expected := append([]string{
+		"10.1.0.0/16 scope global src 10.99.98.1 metric 10",
+		"fd01::/48 table 100 scope global metric 1024",
+	}, kernel...)
+	sort.Strings(expected)
+	if r := routeStrings(t, wg, wgi); !reflect.DeepEqual(r, expected) {
+		t.Errorf("Expected routes %v, got: %v", expected, r)
+	}
+
+	for _, r := range []Route{r4, r6} {
+		ok, err := wg.DeleteRoute(wgi, r)
+		if err != nil || !ok {
+			t.Errorf("Unexpected result of DeleteRoute %s: %t, %v", r, ok, err)
+		}
+		ok, err = wg.DeleteRoute(wgi, r)
+		if err != nil || ok {
+			t.Errorf("DeleteRoute of missing route %s should return false: %t, %v", r, ok, err)
+		}
+	}
+	if r := routeStrings(t, wg, wgi); !reflect.DeepEqual(r, kernel) {
+		t.Errorf("Expected routes %v after DeleteRoute, got: %v", kernel, r)
+	}
+}
+
+func conformanceSyncRoutes(t *testing.T, wg WireguardWrapper) {
+	a4 := net.IPNet{IP: net.ParseIP("10.99.98.1"), Mask: net.CIDRMask(24, 32)}
+	a6 := net.IPNet{IP: net.ParseIP("fd00:99::1"), Mask: net.CIDRMask(64, 128)}
+	wgi := NewWireguardInterfaceAddrs(newWGIntf().InterfaceName, []net.IPNet{a4, a6})
+	err := wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+	err = wg.SetInterfaceUp(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp:  %s", err)
+	}
+	kernel := routeStrings(t, wg, wgi)
+
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	_, n2, _ := net.ParseCIDR("fd01::/64")
+	_, covered, _ := net.ParseCIDR("10.99.98.5/32")
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	wgp1 := WireguardPeer{
+		RemoteEndpointIP: "10.1.2.3",
+		ListenPort:       43210,
+		Pubkey:           "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs:       []net.IPNet{*n1, *covered},
+	}
+	wgp2 := WireguardPeer{
+		RemoteEndpointIP: "10.4.5.6",
+		ListenPort:       32345,
+		Pubkey:           "xqr+unDSDc5Fq0W9Zp2SJlzr+wOaFAquNdIMwPLHarw=",
+		AllowedIPs:       []net.IPNet{*n2, *all},
+	}
+	for _, p := range []WireguardPeer{wgp1, wgp2} {
+		if _, err := wg.AddPeer(wgi, p); err != nil {
+			t.Fatalf("Unable to execute AddPeer:  %s", err)
+		}
+	}
+
+	// a stale peer route, and routes added otherwise that stay
+	stale := mustRoute("10.5.0.0/16")
+	stale.Protocol = PeerRouteProtocol
+	_, err = wg.AddRoute(wgi, stale)
+	if err != nil {
+		t.Fatalf("Unable to execute AddRoute:  %s", err)
+	}
+	err = wg.SetRoute(wgi, "10.7.0.0/16")
+	if err != nil {
+		t.Fatalf("Unable to execute SetRoute:  %s", err)
+	}
+	other := mustRoute("10.6.0.0/16")
+	other.Table = 100
+	_, err = wg.AddRoute(wgi, other)
+	if err != nil {
+		t.Fatalf("Unable to execute AddRoute:  %s", err)
+	}
+
+	changes, err := wg.SyncRoutes(wgi)
+	expected := []string{"add route 10.1.0.0/16", "add route fd01::/64", "remove route 10.5.0.0/16"}
+	if err != nil || !reflect.DeepEqual(changeStrings(changes), expected) {
+		t.Errorf("Unexpected result of SyncRoutes, expected %v, got: %v, %v", expected, changes, err)
+	}
+	changes, err = wg.SyncRoutes(wgi)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("SyncRoutes should be idempotent, got: %v, %v", changes, err)
+	}
+
+	// routes of removed peers go as well, others stay
+	err = wg.RemovePeerByPubkey(wgi, wgp1.Pubkey)
+	if err != nil {
+		t.Fatalf("Unable to execute RemovePeerByPubkey:  %s", err)
+	}
+	changes, err = wg.SyncRoutes(wgi)
+	if err != nil || !reflect.DeepEqual(changeStrings(changes), []string{"remove route 10.1.0.0/16"}) {
+		t.Errorf("Unexpected result of SyncRoutes: %v, %v", changes, err)
+	}
+	expected = append([]string{
+		"10.6.0.0/16 table 100 scope link",
+		"10.7.0.0/16 scope link",
+		"fd01::/64 proto 77 scope global metric 1024",
+	}, kernel...)
+	sort.Strings(expected)
+	if r := routeStrings(t, wg, wgi); !reflect.DeepEqual(r, expected) {
+		t.Errorf("Expected routes %v, got: %v", expected, r)
+	}
+}
+
+func conformanceRejectedConfig(t *testing.T, wg WireguardWrapper) {
+	wgi1, wgi2 := newWGIntf(), newWGIntf()
+	wgi1.ListenPort, wgi2.ListenPort = 46536, 46537
+	for _, wgi := range []*WireguardInterface{&wgi1, &wgi2} {
+		if err := wg.AddInterfaceNoAddr(*wgi); err != nil {
+			t.Fatalf("Unable to execute AddInterfaceNoAddr:  %s", err)
+		}
+		defer wg.DeleteInterface(*wgi)
+		if err := wg.Configure(wgi); err != nil {
+			t.Fatalf("Unable to execute Configure:  %s", err)
+		}
+	}
+	before, err := wg.GetInterface(wgi2.InterfaceName)
+	if err != nil {
+		t.Fatalf("Unable to execute GetInterface:  %s", err)
+	}
+
+	// key, port and peer go in one device configuration, which
+	// is rejected as the port is in use by the other interface
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	wgp := WireguardPeer{
+		Pubkey:     "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs: []net.IPNet{*n1},
+	}
+	spec := InterfaceSpec{
+		InterfaceName: wgi2.InterfaceName,
+		PrivateKey:    "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		ListenPort:    wgi1.ListenPort,
+		Peers:         []WireguardPeer{wgp},
+	}
+	if _, err := wg.Apply(spec); err == nil {
+		t.Fatal("Apply with a listen port in use should fail but did not")
+	}
+
+	after, err := wg.GetInterface(wgi2.InterfaceName)
+	if err != nil {
+		t.Fatalf("Unable to execute GetInterface:  %s", err)
+	}
+	if after.PublicKey != before.PublicKey || after.ListenPort != before.ListenPort {
+		t.Errorf("Rejected configuration should leave the device unchanged, got key %s and port %d", after.PublicKey, after.ListenPort)
+	}
+	if ok, err := wg.HasPeer(wgi2, wgp); err != nil || ok {
+		t.Errorf("Rejected configuration should not add peers: %t, %v", ok, err)
+	}
+}
+
+func conformanceApplyKeyStore(t *testing.T, newWrapper func(opts ...Option) WireguardWrapper) {
+	ks := mapKeyStore{}
+	wg := newWrapper(WithKeyStore(ks))
+
+	spec := InterfaceSpec{
+		InterfaceName: newWGIntf().InterfaceName,
+		ListenPort:    46534,
+	}
+	wgi := WireguardInterface{InterfaceName: spec.InterfaceName}
+	defer wg.DeleteInterface(wgi)
+
+	// a generated key is stored
+	changes, err := wg.Apply(spec)
+	if err != nil {
+		t.Fatalf("Unable to execute Apply:  %s", err)
+	}
+	stored, err := wgtypes.ParseKey(ks[spec.InterfaceName])
+	if err != nil {
+		t.Fatalf("Apply should store the generated key: %v", err)
+	}
+	if c := changeStrings(changes); len(c) != 3 || c[1] != "generate private key "+stored.PublicKey().String() {
+		t.Errorf("Unexpected changes: %v", c)
+	}
+	changes, err = wg.Apply(spec)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Apply of an unchanged spec should change nothing: %v, %v", changes, err)
+	}
+
+	// a recreated interface gets the stored key back
+	err = wg.DeleteInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute DeleteInterface:  %s", err)
+	}
+	_, err = wg.Apply(spec)
+	if err != nil {
+		t.Fatalf("Unable to execute Apply:  %s", err)
+	}
+	current, err := wg.GetInterface(spec.InterfaceName)
+	if err != nil || current.PublicKey != stored.PublicKey().String() {
+		t.Errorf("Expected stored key %s, got %s, %v", stored.PublicKey(), current.PublicKey, err)
+	}
+
+	// a given key must match the stored one
+	other, _ := wgtypes.GeneratePrivateKey()
+	spec.PrivateKey = other.String()
+	_, err = wg.Apply(spec)
+	if !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("Apply with another key should fail with ErrKeyMismatch, got: %v", err)
+	}
+
+	// the key of an existing device is stored
+	delete(ks, spec.InterfaceName)
+	spec.PrivateKey = ""
+	changes, err = wg.Apply(spec)
+	if err != nil || !reflect.DeepEqual(changeStrings(changes), []string{"store private key " + stored.PublicKey().String()}) {
+		t.Errorf("Unexpected result of Apply: %v, %v", changes, err)
+	}
+	if ks[spec.InterfaceName] != stored.String() {
+		t.Errorf("Apply should store the key of the device")
+	}
+}
+
+// changeStrings formats changes for comparison
+func changeStrings(changes []Change) []string {
+	res := []string{}
+	for _, c := range changes {
+		res = append(res, c.String())
+	}
+	return res
+}
+
+func conformanceApply(t *testing.T, wg WireguardWrapper) {
+	wgi := newWGIntf()
+	defer wg.DeleteInterface(wgi)
+
+	_, a1, _ := net.ParseCIDR("10.99.97.0/24")
+	a1.IP = net.IPv4(10, 99, 97, 1)
+	_, a2, _ := net.ParseCIDR("10.99.96.0/24")
+	a2.IP = net.IPv4(10, 99, 96, 1)
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	_, n2, _ := net.ParseCIDR("10.2.0.0/16")
+	wgp1 := WireguardPeer{
+		RemoteEndpointIP: "10.1.2.3",
+		ListenPort:       43210,
+		Pubkey:           "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs:       []net.IPNet{*n1},
+	}
+	wgp2 := WireguardPeer{
+		RemoteEndpointIP: "10.4.5.6",
+		ListenPort:       32345,
+		Pubkey:           "xqr+unDSDc5Fq0W9Zp2SJlzr+wOaFAquNdIMwPLHarw=",
+		AllowedIPs:       []net.IPNet{*n2},
+	}
+	spec := InterfaceSpec{
+		InterfaceName: wgi.InterfaceName,
+		Addresses:     []net.IPNet{*a1},
+		PrivateKey:    "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		ListenPort:    46533,
+		Peers:         []WireguardPeer{wgp1, wgp2},
+		Routes:        []string{"10.1.0.0/16"},
+		Up:            true,
+	}
+
+	changes, err := wg.Apply(spec)
+	if err != nil {
+		t.Fatalf("Unable to execute Apply: %s (%v)", err, changes)
+	}
+	expected := []string{
+		"add interface " + wgi.InterfaceName,
+		"add address 10.99.97.1/24",
+		"set private key HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=",
+		"set listen port 46533",
+		"add peer " + wgp1.Pubkey,
+		"add peer " + wgp2.Pubkey,
+		"set interface up " + wgi.InterfaceName,
+		"add route 10.1.0.0/16",
+	}
+	if !reflect.DeepEqual(changeStrings(changes), expected) {
+		t.Errorf("Unexpected changes of first Apply:\n%v\nexpected:\n%v", changeStrings(changes), expected)
+	}
+
+	changes, err = wg.Apply(spec)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Apply of unchanged spec should not change anything: %v, %v", changes, err)
+	}
+
+	// change address, drop one peer and modify the other
+	wgp1.AllowedIPs = []net.IPNet{*n1, *n2}
+	spec.Addresses = []net.IPNet{*a2}
+	spec.Peers = []WireguardPeer{wgp1}
+	changes, err = wg.Apply(spec)
+	if err != nil {
+		t.Fatalf("Unable to execute Apply: %s", err)
+	}
+	expected = []string{
+		"remove address 10.99.97.1/24",
+		"add address 10.99.96.1/24",
+		"update peer " + wgp1.Pubkey,
+		"remove peer " + wgp2.Pubkey,
+	}
+	if !reflect.DeepEqual(changeStrings(changes), expected) {
+		t.Errorf("Unexpected changes of second Apply:\n%v\nexpected:\n%v", changeStrings(changes), expected)
+	}
+
+	peers := map[string]WireguardPeer{}
+	err = wg.IteratePeers(wgi, func(p WireguardPeer) {
+		peers[p.Pubkey] = p
+	})
+	if err != nil {
+		t.Fatalf("Unable to execute IteratePeers: %s", err)
+	}
+	if len(peers) != 1 || len(peers[wgp1.Pubkey].AllowedIPs) != 2 {
+		t.Errorf("Unexpected peers after Apply: %v", peers)
+	}
+
+	spec.Up = false
+	changes, err = wg.Apply(spec)
+	if err != nil || !reflect.DeepEqual(changeStrings(changes), []string{"set interface down " + wgi.InterfaceName}) {
+		t.Errorf("Unexpected result of Apply for a down interface: %v, %v", changes, err)
+	}
+
+	_, err = wg.Apply(InterfaceSpec{InterfaceName: wgi.InterfaceName, PrivateKey: "invalid"})
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Apply with invalid private key should fail with ErrInvalidKey, got: %v", err)
+	}
+}
+
+// fieldStrings formats field changes for comparison
+func fieldStrings(fields []FieldChange) []string {
+	res := []string{}
+	for _, f := range fields {
+		res = append(res, f.String())
+	}
+	return res
+}
+
+func conformanceUpsertPeer(t *testing.T, wg WireguardWrapper) {
+	wgi := newWGIntf()
+	err := wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	_, n2, _ := net.ParseCIDR("10.2.0.0/16")
+	psk := "xqr+unDSDc5Fq0W9Zp2SJlzr+wOaFAquNdIMwPLHarw="
+	wgp := WireguardPeer{
+		RemoteEndpointIP: "10.1.2.3",
+		ListenPort:       43210,
+		Pubkey:           "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs:       []net.IPNet{*n1},
+		Psk:              &psk,
+	}
+
+	_, err = wg.UpdatePeer(wgi, wgp, PeerUpdate{})
+	if !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("UpdatePeer of unknown peer should fail with ErrPeerNotFound, got: %v", err)
+	}
+
+	added, fields, err := wg.UpsertPeer(wgi, wgp, PeerUpdate{})
+	if err != nil || !added || len(fields) != 3 {
+		t.Errorf("UpsertPeer of new peer: %t, %v, %v", added, fields, err)
+	}
+	added, fields, err = wg.UpsertPeer(wgi, wgp, PeerUpdate{})
+	if err != nil || added || len(fields) != 0 {
+		t.Errorf("UpsertPeer of unchanged peer: %t, %v, %v", added, fields, err)
+	}
+
+	// endpoint, keepalive and replaced allowed ips; psk is kept
+	wgp.RemoteEndpointIP = "10.1.2.4"
+	wgp.AllowedIPs = []net.IPNet{*n2}
+	wgp.PersistentKeepaliveInterval = 25 * time.Second
+	wgp.Psk = nil
+	fields, err = wg.UpdatePeer(wgi, wgp, PeerUpdate{})
+	expected := []string{
+		"endpoint: 10.1.2.3:43210 -> 10.1.2.4:43210",
+		"persistent keepalive: + 25s",
+		"allowed ip: - 10.1.0.0/16",
+		"allowed ip: + 10.2.0.0/16",
+	}
+	if err != nil || !reflect.DeepEqual(fieldStrings(fields), expected) {
+		t.Errorf("Unexpected result of UpdatePeer: %v, %v", fieldStrings(fields), err)
+	}
+
+	// appended allowed ips, cleared psk
+	wgp.AllowedIPs = []net.IPNet{*n1}
+	fields, err = wg.UpdatePeer(wgi, wgp, PeerUpdate{AllowedIPs: AppendAllowedIPs, ClearPsk: true})
+	expected = []string{
+		"preshared key: - (hidden)",
+		"allowed ip: + 10.1.0.0/16",
+	}
+	if err != nil || !reflect.DeepEqual(fieldStrings(fields), expected) {
+		t.Errorf("Unexpected result of UpdatePeer: %v, %v", fieldStrings(fields), err)
+	}
+
+	// cleared endpoint
+	wgp.RemoteEndpointIP = ""
+	fields, err = wg.UpdatePeer(wgi, wgp, PeerUpdate{AllowedIPs: AppendAllowedIPs, ClearEndpoint: true})
+	expected = []string{
+		"endpoint: - 10.1.2.4:43210",
+	}
+	if err != nil || !reflect.DeepEqual(fieldStrings(fields), expected) {
+		t.Errorf("Unexpected result of UpdatePeer: %v, %v", fieldStrings(fields), err)
+	}
+
+	ok, err := wg.HasPeer(wgi, wgp)
+	if err != nil || !ok {
+		t.Fatalf("Peer should still exist after clearing its endpoint: %t, %v", ok, err)
+	}
+	fields, err = wg.UpdatePeer(wgi, wgp, PeerUpdate{AllowedIPs: AppendAllowedIPs})
+	if err != nil || len(fields) != 0 {
+		t.Errorf("UpdatePeer without changes: %v, %v", fields, err)
+	}
+}
+
+func conformanceSyncPeers(t *testing.T, wg WireguardWrapper) {
+	wgi := newWGIntf()
+	err := wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	_, n2, _ := net.ParseCIDR("10.2.0.0/16")
+	wgp1 := WireguardPeer{
+		RemoteEndpointIP: "10.1.2.3",
+		ListenPort:       43210,
+		Pubkey:           "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs:       []net.IPNet{*n1},
+	}
+	wgp2 := WireguardPeer{
+		RemoteEndpointIP: "10.4.5.6",
+		ListenPort:       32345,
+		Pubkey:           "xqr+unDSDc5Fq0W9Zp2SJlzr+wOaFAquNdIMwPLHarw=",
+		AllowedIPs:       []net.IPNet{*n2},
+	}
+
+	changes, err := wg.SyncPeers(wgi, []WireguardPeer{wgp1})
+	if err != nil || !reflect.DeepEqual(changeStrings(changes), []string{"add peer " + wgp1.Pubkey}) {
+		t.Errorf("Unexpected result of SyncPeers: %v, %v", changes, err)
+	}
+
+	// the network moves from wgp1 to wgp2
+	wgp1.AllowedIPs = []net.IPNet{}
+	wgp2.AllowedIPs = []net.IPNet{*n1, *n2}
+	changes, err = wg.SyncPeers(wgi, []WireguardPeer{wgp2, wgp1})
+	expected := []string{"add peer " + wgp2.Pubkey, "update peer " + wgp1.Pubkey}
+	if err != nil || !reflect.DeepEqual(changeStrings(changes), expected) {
+		t.Errorf("Unexpected result of SyncPeers: %v, %v", changeStrings(changes), err)
+	}
+
+	changes, err = wg.SyncPeers(wgi, []WireguardPeer{wgp1, wgp2})
+	if err != nil || len(changes) != 0 {
+		t.Errorf("SyncPeers without changes: %v, %v", changes, err)
+	}
+
+	changes, err = wg.SyncPeers(wgi, []WireguardPeer{})
+	if err != nil || len(changes) != 2 {
+		t.Errorf("SyncPeers to no peers: %v, %v", changes, err)
+	}
+}
+
+func conformanceBatchPeers(t *testing.T, wg WireguardWrapper) {
+	wgi := newWGIntf()
+	err := wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+
+	peers := batchPeers(t, 2500)
+	n, err := wg.AddPeers(wgi, peers)
+	if err != nil || n != len(peers) {
+		t.Fatalf("Unexpected result of AddPeers: %d, %v", n, err)
+	}
+	if countPeers(t, wg, wgi) != len(peers) {
+		t.Errorf("Expected %d peers", len(peers))
+	}
+
+	n, err = wg.AddPeers(wgi, peers[:10])
+	if err != nil || n != 0 {
+		t.Errorf("AddPeers of existing peers: %d, %v", n, err)
+	}
+
+	pubkeys := make([]string, 0, len(peers))
+	for _, p := range peers[500:] {
+		pubkeys = append(pubkeys, p.Pubkey)
+	}
+	n, err = wg.RemovePeers(wgi, pubkeys)
+	if err != nil || n != len(pubkeys) {
+		t.Errorf("Unexpected result of RemovePeers: %d, %v", n, err)
+	}
+	if countPeers(t, wg, wgi) != 500 {
+		t.Errorf("Expected 500 peers")
+	}
+}
+
+func conformancePeerStatus(t *testing.T, wg WireguardWrapper) {
+	wgi := newWGIntf()
+	err := wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+
+	psk := "GKhd9D/9uV8pdhKOhD3Ki3vqhO+ivHEebHrtKGtiblA="
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	wgp1 := WireguardPeer{
+		RemoteEndpointIP:            "10.1.2.3",
+		ListenPort:                  43210,
+		Pubkey:                      "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs:                  []net.IPNet{*n1},
+		Psk:                         &psk,
+		PersistentKeepaliveInterval: 25 * time.Second,
+	}
+	wgp2 := WireguardPeer{
+		RemoteEndpointIP: "10.4.5.6",
+		ListenPort:       32345,
+		Pubkey:           "xqr+unDSDc5Fq0W9Zp2SJlzr+wOaFAquNdIMwPLHarw=",
+	}
+	for _, p := range []WireguardPeer{wgp1, wgp2} {
+		if _, err := wg.AddPeer(wgi, p); err != nil {
+			t.Fatalf("Unable to execute AddPeer: %s", err)
+		}
+	}
+
+	statuses, err := wg.PeerStatuses(wgi)
+	if err != nil || len(statuses) != 2 {
+		t.Fatalf("Unexpected result of PeerStatuses: %#v, %v", statuses, err)
+	}
+	for _, s := range statuses {
+		if s.ProtocolVersion != 1 || !s.LastHandshakeTime.IsZero() || s.ReceiveBytes != 0 || s.Connected(time.Now()) {
+			t.Errorf("Unexpected state of new peer: %#v", s)
+		}
+	}
+
+	s, err := wg.PeerStatus(wgi, wgp1.Pubkey)
+	if err != nil || !s.HasPsk || s.PersistentKeepaliveInterval != 25*time.Second || s.Endpoint.String() != "10.1.2.3:43210" {
+		t.Errorf("Unexpected status of peer: %#v, %v", s, err)
+	}
+	s, err = wg.PeerStatus(wgi, wgp2.Pubkey)
+	if err != nil || s.HasPsk || s.PersistentKeepaliveInterval != 0 {
+		t.Errorf("Unexpected status of peer: %#v, %v", s, err)
+	}
+
+	// IteratePeers reports the keepalive as well, but never the preshared key
+	err = wg.IteratePeers(wgi, func(p WireguardPeer) {
+		if p.Pubkey == wgp1.Pubkey && p.PersistentKeepaliveInterval != 25*time.Second {
+			t.Errorf("Unexpected peer: %#v", p)
+		}
+		if p.Psk != nil {
+			t.Errorf("IteratePeers should not reveal preshared keys: %#v", p)
+		}
+	})
+	if err != nil {
+		t.Errorf("Unable to execute IteratePeers: %s", err)
+	}
+
+	_, err = wg.PeerStatuses(newWGIntf())
+	if !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("PeerStatuses on nonexisting interface should fail with ErrInterfaceNotFound, got: %v", err)
+	}
+}
+
+func conformancePeerWithoutEndpoint(t *testing.T, wg WireguardWrapper) {
+	wgi := newWGIntf()
+	err := wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	wgp := WireguardPeer{
+		Pubkey:     "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs: []net.IPNet{*n1},
+	}
+	ok, err := wg.AddPeer(wgi, wgp)
+	if err != nil || !ok {
+		t.Fatalf("AddPeer without endpoint: %t, %v", ok, err)
+	}
+
+	peers := []WireguardPeer{}
+	err = wg.IteratePeers(wgi, func(p WireguardPeer) {
+		peers = append(peers, p)
+	})
+	if err != nil || len(peers) != 1 {
+		t.Fatalf("Unexpected result of IteratePeers: %v, %v", peers, err)
+	}
+	if peers[0].RemoteEndpointIP != "" || peers[0].ListenPort != 0 {
+		t.Errorf("Expected peer without endpoint, got %#v", peers[0])
+	}
+	s, err := wg.PeerStatus(wgi, wgp.Pubkey)
+	if err != nil || s.Endpoint != nil {
+		t.Errorf("Expected peer status without endpoint: %#v, %v", s, err)
+	}
+
+	// updating a peer without endpoint keeps it without one
+	wgp.PersistentKeepaliveInterval = 25 * time.Second
+	changes, err := wg.UpdatePeer(wgi, wgp, PeerUpdate{})
+	if err != nil || !reflect.DeepEqual(fieldStrings(changes), []string{"persistent keepalive: + 25s"}) {
+		t.Errorf("Unexpected result of UpdatePeer: %v, %v", fieldStrings(changes), err)
+	}
+
+	// set an endpoint and clear it again
+	wgp.RemoteEndpointIP = "10.1.2.3"
+	wgp.ListenPort = 43210
+	if _, err := wg.UpdatePeer(wgi, wgp, PeerUpdate{}); err != nil {
+		t.Errorf("Unable to execute UpdatePeer: %s", err)
+	}
+	wgp.RemoteEndpointIP = ""
+	wgp.ListenPort = 0
+	changes, err = wg.UpdatePeer(wgi, wgp, PeerUpdate{ClearEndpoint: true})
+	if err != nil || !reflect.DeepEqual(fieldStrings(changes), []string{"endpoint: - 10.1.2.3:43210"}) {
+		t.Errorf("Unexpected result of UpdatePeer: %v, %v", fieldStrings(changes), err)
+	}
+	s, err = wg.PeerStatus(wgi, wgp.Pubkey)
+	if err != nil || s.Endpoint != nil || s.PersistentKeepaliveInterval != 25*time.Second {
+		t.Errorf("Expected peer status without endpoint: %#v, %v", s, err)
+	}
+
+	synced, err := wg.SyncPeers(wgi, []WireguardPeer{wgp})
+	if err != nil || len(synced) != 0 {
+		t.Errorf("SyncPeers of peer without endpoint should not change anything: %v, %v", changeStrings(synced), err)
+	}
+}
+
+// addressStrings returns the addresses of an interface as sorted strings
+func addressStrings(t *testing.T, wg WireguardWrapper, wgi WireguardInterface) []string {
+	a, err := wg.Addresses(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute Addresses: %s", err)
+	}
+	res := make([]string, len(a))
+	for idx, n := range a {
+		res[idx] = n.String()
+	}
+	sort.Strings(res)
+	return res
+}
+
+func conformanceAddresses(t *testing.T, wg WireguardWrapper) {
+	a4 := net.IPNet{IP: net.ParseIP("10.99.98.1"), Mask: net.CIDRMask(24, 32)}
+	a6 := net.IPNet{IP: net.ParseIP("fd00:99::1"), Mask: net.CIDRMask(64, 128)}
+	wgi := NewWireguardInterfaceAddrs(newWGIntf().InterfaceName, []net.IPNet{a4, a6})
+	err := wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+
+	if a := addressStrings(t, wg, wgi); !reflect.DeepEqual(a, []string{"10.99.98.1/24", "fd00:99::1/64"}) {
+		t.Errorf("AddInterface should assign all addresses, got: %v", a)
+	}
+
+	b6 := net.IPNet{IP: net.ParseIP("fd00:99::2"), Mask: net.CIDRMask(64, 128)}
+	ok, err := wg.AddAddress(wgi, b6)
+	if err != nil || !ok {
+		t.Errorf("Unable to execute AddAddress: %t, %v", ok, err)
+	}
+	ok, err = wg.AddAddress(wgi, b6)
+	if err != nil || ok {
+		t.Errorf("AddAddress of existing address should do nothing: %t, %v", ok, err)
+	}
+	ok, err = wg.RemoveAddress(wgi, a6)
+	if err != nil || !ok {
+		t.Errorf("Unable to execute RemoveAddress: %t, %v", ok, err)
+	}
+	ok, err = wg.RemoveAddress(wgi, a6)
+	if err != nil || ok {
+		t.Errorf("RemoveAddress of missing address should do nothing: %t, %v", ok, err)
+	}
+
+	b4 := net.IPNet{IP: net.ParseIP("10.99.97.1"), Mask: net.CIDRMask(24, 32)}
+	if err := wg.ReplaceAddress(wgi, a4, b4); err != nil {
+		t.Errorf("Unable to execute ReplaceAddress: %s", err)
+	}
+	if a := addressStrings(t, wg, wgi); !reflect.DeepEqual(a, []string{"10.99.97.1/24", "fd00:99::2/64"}) {
+		t.Errorf("Unexpected addresses after ReplaceAddress: %v", a)
+	}
+
+	changes, err := wg.SyncAddresses(wgi, []net.IPNet{a4, a6})
+	if err != nil {
+		t.Fatalf("Unable to execute SyncAddresses: %s", err)
+	}
+	// the order of removals follows the listing of the kernel
+	got := changeStrings(changes)
+	sort.Strings(got)
+	exp := []string{"add address 10.99.98.1/24", "add address fd00:99::1/64", "remove address 10.99.97.1/24", "remove address fd00:99::2/64"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Unexpected changes of SyncAddresses: %v", got)
+	}
+	if a := addressStrings(t, wg, wgi); !reflect.DeepEqual(a, []string{"10.99.98.1/24", "fd00:99::1/64"}) {
+		t.Errorf("SyncAddresses should converge exactly, got: %v", a)
+	}
+	changes, err = wg.SyncAddresses(wgi, []net.IPNet{a6, a4})
+	if err != nil || len(changes) != 0 {
+		t.Errorf("SyncAddresses should be idempotent: %v, %v", changes, err)
+	}
+
+	_, err = wg.Addresses(newWGIntf())
+	if !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("Addresses on nonexisting interface should fail with ErrInterfaceNotFound, got: %v", err)
+	}
+}
+
+func conformanceLinkAttributes(t *testing.T, wg WireguardWrapper) {
+	wgi := newWGIntf()
+	wgi.ListenPort = 46536
+	wgi.MTU = 1380
+	wgi.TxQueueLen = 500
+	wgi.Alias = "test tunnel"
+	wgi.FirewallMark = 0x51820
+	err := wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+	defer wg.DeleteInterface(wgi)
+	if err := wg.Configure(&wgi); err != nil {
+		t.Fatalf("Unable to execute Configure: %s", err)
+	}
+
+	r, err := wg.GetInterface(wgi.InterfaceName)
+	if err != nil {
+		t.Fatalf("Unable to execute GetInterface: %s", err)
+	}
+	if r.MTU != 1380 || r.TxQueueLen != 500 || r.Alias != "test tunnel" || r.FirewallMark != 0x51820 {
+		t.Errorf("Unexpected attributes: %#v", r)
+	}
+	if r.ListenPort != 46536 || r.PublicKey != wgi.PublicKey || r.IP.String() != wgi.IP.String() || r.PrivateKey != "" {
+		t.Errorf("Unexpected interface: %#v", r)
+	}
+
+	// attributes of an existing interface are reconciled,
+	// unset ones are left alone
+	wgi.MTU = 1280
+	wgi.TxQueueLen = 0
+	wgi.Alias = ""
+	wgi.FirewallMark = 42
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := wg.Configure(&wgi); err != nil {
+		t.Fatalf("Unable to execute Configure: %s", err)
+	}
+	r, err = wg.GetInterface(wgi.InterfaceName)
+	if err != nil || r.MTU != 1280 || r.TxQueueLen != 500 || r.Alias != "test tunnel" || r.FirewallMark != 42 {
+		t.Errorf("Unexpected attributes: %#v, %v", r, err)
+	}
+
+	wgi.MTU = 10
+	if err := wg.AddInterface(wgi); err == nil {
+		t.Error("AddInterface with invalid MTU should fail but did not")
+	}
+
+	spec := InterfaceSpec{
+		InterfaceName: wgi.InterfaceName,
+		Addresses:     []net.IPNet{wgi.IP},
+		ListenPort:    wgi.ListenPort,
+		FirewallMark:  43,
+		MTU:           1400,
+		Alias:         "tunnel",
+	}
+	changes, err := wg.Apply(spec)
+	if err != nil {
+		t.Fatalf("Unable to execute Apply: %s", err)
+	}
+	exp := []string{"set link attributes " + wgi.InterfaceName, "set firewall mark 43"}
+	if !reflect.DeepEqual(changeStrings(changes), exp) {
+		t.Errorf("Unexpected changes: %v", changeStrings(changes))
+	}
+	if exp := []string{"mtu: 1280 -> 1400", "alias: test tunnel -> tunnel"}; !reflect.DeepEqual(fieldStrings(changes[0].Fields), exp) {
+		t.Errorf("Unexpected fields: %v", fieldStrings(changes[0].Fields))
+	}
+	changes, err = wg.Apply(spec)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Second Apply should not change anything: %v, %v", changes, err)
+	}
+
+	_, err = wg.GetInterface(newWGIntf().InterfaceName)
+	if !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("GetInterface on nonexisting interface should fail with ErrInterfaceNotFound, got: %v", err)
+	}
+}
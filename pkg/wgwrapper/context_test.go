@@ -0,0 +1,64 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := NewRecordingRunner()
+	wgi := NewWireguardInterfaceNoAddr("wg-tst0")
+
+	for name, wg := range map[string]WireguardWrapper{
+		"runner":   NewWithRunner(r).WithContext(ctx),
+		"inmemory": NewInMemory().WithContext(ctx),
+	} {
+		err := wg.AddInterfaceNoAddr(wgi)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: Expected AddInterfaceNoAddr to fail with context.Canceled, got: %v", name, err)
+		}
+		_, err = wg.HasPeer(wgi, WireguardPeer{Pubkey: "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I="})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: Expected HasPeer to fail with context.Canceled, got: %v", name, err)
+		}
+	}
+
+	if len(r.Commands()) != 0 {
+		t.Errorf("Expected no commands with a cancelled context, got: %v", r.Commands())
+	}
+}
+
+func TestContextWithoutContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the original wrapper is not affected by WithContext
+	wg := NewInMemory()
+	_ = wg.WithContext(ctx)
+
+	err := wg.AddInterfaceNoAddr(NewWireguardInterfaceNoAddr("wg-tst0"))
+	if err != nil {
+		t.Errorf("Unable to execute AddInterfaceNoAddr: %s", err)
+	}
+}
+
+func TestContextExecRunnerDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err := execRunner{}.Run(ctx, "sleep", "5")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Command was not killed when the deadline exceeded")
+	}
+}
@@ -4,257 +4,324 @@ package wgwrapper
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
-	"os/exec"
+	"os"
 
-	wgctrl "golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type wgwrapper struct {
 	WireguardWrapper
-}
 
-// AddInterface adds a new wireguard interface
-// by calling /sbin/ip. Also adds given address
-func (wg wgwrapper) AddInterface(intf WireguardInterface) error {
-	i, err := net.InterfaceByName(intf.InterfaceName)
+	backend   linkBackend
+	newClient func(ctx context.Context) (wgClient, error)
 
-	if i == nil || err != nil {
-		// create wireguard interface
-		var cmd *exec.Cmd
+	// client is a shared client, owned by the wrapper
+	client wgClient
 
-		cmd = exec.Command("/sbin/ip", "link", "add", "dev", intf.InterfaceName, "type", "wireguard")
+	// ctx is the context given by WithContext, if any
+	ctx context.Context
 
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Run()
-		if err != nil {
-			e := fmt.Sprintf("/sbin/ip reported: %s", err)
-			return errors.New(e)
-		}
-		_, errStr := string(stdout.Bytes()), string(stderr.Bytes())
-		if len(errStr) > 0 {
-			e := fmt.Sprintf("/sbin/ip reported: %s", errStr)
-			return errors.New(e)
-		}
+	// batchSize is the number of peers per device configuration
+	// of batch operations, 0 for the default
+	batchSize int
+
+	// keyStore keeps the private keys of interfaces, if set
+	keyStore KeyStore
+
+	// routeSync makes peer changes sync routes, see WithRouteSync
+	routeSync bool
+}
+
+// WithContext returns a copy of the wrapper bound to ctx
+func (wg wgwrapper) WithContext(ctx context.Context) WireguardWrapper {
+	wg.ctx = ctx
+	return wg
+}
+
+// context returns the context operations are bound to
+func (wg wgwrapper) context() context.Context {
+	if wg.ctx == nil {
+		return context.Background()
+	}
+	return wg.ctx
+}
+
+// Close releases the shared wgctrl client
+func (wg wgwrapper) Close() error {
+	if wg.client == nil {
+		return nil
 	}
+	return wg.client.Close()
+}
 
-	// try to get this intf via netlink
-	i, err = net.InterfaceByName(intf.InterfaceName)
-	if err != nil {
+// AddInterface adds a new wireguard interface, sets its MTU,
+// transmit queue length and alias, if given, and assigns given
+// addresses. If a step fails, a newly created interface is
+// removed again.
+func (wg wgwrapper) AddInterface(intf WireguardInterface) error {
+	tx := wg.Begin()
+	if err := tx.AddInterface(intf); err != nil {
 		return err
 	}
+	return tx.Commit()
+}
 
-	// Assign IP if desired and not yet present
-	a, err := i.Addrs()
+// addAddress assigns the addresses of intf the interface does not
+// have yet. Other addresses are kept, see SyncAddresses.
+func (wg wgwrapper) addAddress(intf WireguardInterface) (undoFunc, error) {
+	want := intf.addresses()
+	if len(want) == 0 {
+		return nil, wrapError("add address", intf.InterfaceName, errors.New("no address given"))
+	}
+	for _, addr := range want {
+		if err := validAddress(addr); err != nil {
+			return nil, wrapError("add address", intf.InterfaceName, err)
+		}
+	}
+
+	a, err := wg.backend.AddrList(wg.context(), intf.InterfaceName)
 	if err != nil {
-		return err
+		return nil, wrapError("list addresses", intf.InterfaceName, err)
 	}
-	if len(a) == 0 {
-		cmd := exec.Command("/sbin/ip", "address", "add", "dev", intf.InterfaceName, intf.IP.String())
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Run()
+	// undo is set as soon as an address has been added
+	var undo undoFunc
+	added := []net.IPNet{}
+	for _, addr := range want {
+		if indexOfIPNet(a, addr) != -1 || indexOfIPNet(added, addr) != -1 {
+			continue
+		}
+		err = wg.backend.AddrAdd(wg.context(), intf.InterfaceName, addr)
 		if err != nil {
-			return err
+			return undo, wrapError("add address", intf.InterfaceName, err)
 		}
-		_, errStr := string(stdout.Bytes()), string(stderr.Bytes())
-		if len(errStr) > 0 {
-			e := fmt.Sprintf("/sbin/ip reported: %s", errStr)
-			return errors.New(e)
+		added = append(added, addr)
+		undo = func(wg wgwrapper) error {
+			return removeAddresses(wg, intf.InterfaceName, added)
 		}
 	}
 
-	a, err = i.Addrs()
-	if len(a) == 0 {
-		e := fmt.Sprintf("unable to add ip address %s to interface %s: %s", intf.IP.String(), intf.InterfaceName, err)
-		return errors.New(e)
+	a, err = wg.backend.AddrList(wg.context(), intf.InterfaceName)
+	if err != nil {
+		return undo, wrapError("list addresses", intf.InterfaceName, err)
+	}
+	for _, addr := range want {
+		if indexOfIPNet(a, addr) == -1 {
+			e := fmt.Sprintf("unable to add ip address %s", addr.String())
+			return undo, wrapError("add address", intf.InterfaceName, errors.New(e))
+		}
 	}
 
-	return nil
+	return undo, nil
 }
 
 // AddInterfaceNoAddr is similar to AddInterface with the exception that no
 // IP address is added to the interface
 func (wg wgwrapper) AddInterfaceNoAddr(intf WireguardInterface) error {
-	i, err := net.InterfaceByName(intf.InterfaceName)
-
-	if i == nil || err != nil {
-		// create wireguard interface
-		var cmd *exec.Cmd
+	tx := wg.Begin()
+	if err := tx.AddInterfaceNoAddr(intf); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-		cmd = exec.Command("/sbin/ip", "link", "add", "dev", intf.InterfaceName, "type", "wireguard")
+// addInterfaceNoAddr creates the link of intf if it does not exist
+func (wg wgwrapper) addInterfaceNoAddr(intf WireguardInterface) (undoFunc, error) {
+	ex, err := wg.backend.LinkExists(wg.context(), intf.InterfaceName)
+	if err != nil {
+		return nil, wrapError("add interface", intf.InterfaceName, err)
+	}
 
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Run()
+	var undo undoFunc
+	if !ex {
+		// create wireguard interface
+		err = wg.backend.LinkAdd(wg.context(), intf.InterfaceName)
 		if err != nil {
-			e := fmt.Sprintf("/sbin/ip reported: %s", err)
-			return errors.New(e)
+			return nil, wrapError("add interface", intf.InterfaceName, err)
 		}
-		_, errStr := string(stdout.Bytes()), string(stderr.Bytes())
-		if len(errStr) > 0 {
-			e := fmt.Sprintf("/sbin/ip reported: %s", errStr)
-			return errors.New(e)
+		undo = func(wg wgwrapper) error {
+			return wrapError("delete interface", intf.InterfaceName, wg.backend.LinkDelete(wg.context(), intf.InterfaceName))
 		}
 	}
 
-	// try to get this intf via netlink
-	i, err = net.InterfaceByName(intf.InterfaceName)
+	// make sure it is present now
+	ex, err = wg.backend.LinkExists(wg.context(), intf.InterfaceName)
 	if err != nil {
-		return err
+		return undo, wrapError("add interface", intf.InterfaceName, err)
+	}
+	if !ex {
+		return nil, wrapError("add interface", intf.InterfaceName, ErrInterfaceNotFound)
 	}
 
-	return nil
+	return undo, nil
 }
 
+// SetInterfaceUp brings interface in UP state
 func (wg wgwrapper) SetInterfaceUp(intf WireguardInterface) error {
+	_, err := wg.setInterfaceUp(intf)
+	return err
+}
+
+func (wg wgwrapper) setInterfaceUp(intf WireguardInterface) (undoFunc, error) {
 
 	// check status
-	cmd := exec.Command("/sbin/ip", "--br", "link", "show", "dev", intf.InterfaceName, "up", "type", "wireguard")
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+	up, err := wg.backend.LinkIsUp(wg.context(), intf.InterfaceName)
 	if err != nil {
-		return err
+		return nil, wrapError("set interface up", intf.InterfaceName, err)
 	}
-	outStr, errStr := string(stdout.Bytes()), string(stderr.Bytes())
-	if len(errStr) > 0 {
-		e := fmt.Sprintf("/sbin/ip reported: %s", errStr)
-		return errors.New(e)
-	}
-	if len(outStr) > 0 {
-		return nil // already up
+	if up {
+		return nil, nil // already up
 	}
 
 	// bring up wireguard interface
-	cmd = exec.Command("/sbin/ip", "link", "set", "up", "dev", intf.InterfaceName)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
+	err = wg.backend.LinkSetUp(wg.context(), intf.InterfaceName)
 	if err != nil {
-		_, errStr = string(stdout.Bytes()), string(stderr.Bytes())
-		if len(errStr) > 0 {
-			e := fmt.Sprintf("/sbin/ip reported: %s", errStr)
-			return errors.New(e)
-		}
-
-		return err
+		return nil, wrapError("set interface up", intf.InterfaceName, err)
 	}
-
-	return nil
-
+	return func(wg wgwrapper) error {
+		return wrapError("set interface down", intf.InterfaceName, wg.backend.LinkSetDown(wg.context(), intf.InterfaceName))
+	}, nil
 }
 
 // DeleteInterface takes down an existing wireguard interface
-// by calling /sbin/ip
+// and removes it
 func (wg wgwrapper) DeleteInterface(intf WireguardInterface) error {
-	i, err := net.InterfaceByName(intf.InterfaceName)
-
+	ex, err := wg.backend.LinkExists(wg.context(), intf.InterfaceName)
 	if err != nil {
-		return err
+		return wrapError("delete interface", intf.InterfaceName, err)
 	}
-	if i == nil {
-		e := fmt.Sprintf("No network/interface by name %s", intf.InterfaceName)
-		return errors.New(e)
+	if !ex {
+		return wrapError("delete interface", intf.InterfaceName, ErrInterfaceNotFound)
 	}
 
 	// take down wireguard interface
-	var cmd *exec.Cmd
-
-	cmd = exec.Command("/sbin/ip", "link", "set", "down", "dev", intf.InterfaceName)
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
+	err = wg.backend.LinkSetDown(wg.context(), intf.InterfaceName)
 	if err != nil {
-		e := fmt.Sprintf("/sbin/ip reported: %s", err)
-		return errors.New(e)
-	}
-	_, errStr := string(stdout.Bytes()), string(stderr.Bytes())
-	if len(errStr) > 0 {
-		e := fmt.Sprintf("/sbin/ip reported: %s", errStr)
-		return errors.New(e)
+		return wrapError("delete interface", intf.InterfaceName, err)
 	}
 
 	// remove wireguard interface
-	cmd = exec.Command("/sbin/ip", "link", "delete", "dev", intf.InterfaceName, "type", "wireguard")
-
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
-	if err != nil {
-		return err
-	}
-	_, errStr = string(stdout.Bytes()), string(stderr.Bytes())
-	if len(errStr) > 0 {
-		e := fmt.Sprintf("/sbin/ip reported: %s", errStr)
-		return errors.New(e)
-	}
-
-	return nil
+	err = wg.backend.LinkDelete(wg.context(), intf.InterfaceName)
+	return wrapError("delete interface", intf.InterfaceName, err)
 }
 
 // HasInterface checks if the interface is already present
 func (wg wgwrapper) HasInterface(intf WireguardInterface) (bool, error) {
-	wgClient, err := wgctrl.New()
+	wgClient, err := wg.newClient(wg.context())
 	if err != nil {
-		return false, err
+		return false, wrapError("query interface", intf.InterfaceName, err)
 	}
 	defer wgClient.Close()
 
 	device, err := wgClient.Device(intf.InterfaceName)
 	if err != nil {
-		return false, nil
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, wrapError("query interface", intf.InterfaceName, err)
 	}
 
 	return (device != nil), nil
 }
 
 // Configure makes sure that the wireguard interface
-// has a keypair and a listen port configured. Extracts public key
-// part and stores it in intf.
+// has a keypair and a listen port configured, as well as the
+// firewall mark of intf, if given. Extracts public key part and
+// stores it in intf. If intf.PrivateKey is set, it is used
+// instead of a generated key, as is a key of the key store, see
+// WithKeyStore. Generated keys are saved in the key store once the
+// device has them. An interface that already has a different key is
+// left alone and ErrKeyMismatch is returned.
 func (wg wgwrapper) Configure(intf *WireguardInterface) error {
+	_, err := wg.configure(intf)
+	return err
+}
+
+func (wg wgwrapper) configure(intf *WireguardInterface) (undoFunc, error) {
+	if err := validLinkAttrs(linkAttrs{}, intf.FirewallMark); err != nil {
+		return nil, wrapError("configure", intf.InterfaceName, err)
+	}
+
 	// wireguard: create private key, add device (listen-port)
-	wgClient, err := wgctrl.New()
+	wgClient, err := wg.newClient(wg.context())
 	if err != nil {
-		return err
+		return nil, wrapError("configure", intf.InterfaceName, err)
 	}
 	defer wgClient.Close()
 
 	wgDevice, err := wgClient.Device(intf.InterfaceName)
 	if err != nil {
-		return err
+		return nil, wrapError("configure", intf.InterfaceName, err)
 	}
 
-	// check if device already has key and Listen port set. If not, do so
-	if bytes.Compare(wgDevice.PrivateKey[:], emptyBytes32) == 0 {
+	// restore brings back the key and port found before,
+	// undo is set as soon as there is something to restore
+	restore := wgtypes.Config{}
+	var undo undoFunc
+	restoreFunc := func(wg wgwrapper) error {
+		wgClient, err := wg.newClient(wg.context())
+		if err != nil {
+			return wrapError("configure", intf.InterfaceName, err)
+		}
+		defer wgClient.Close()
+
+		return wrapError("configure", intf.InterfaceName, wgClient.ConfigureDevice(intf.InterfaceName, restore))
+	}
+
+	// a given or stored key must match the one of the device, if any
+	hasKey := bytes.Compare(wgDevice.PrivateKey[:], emptyBytes32) != 0
+	key, stored, err := wg.interfaceKey(intf)
+	if err != nil {
+		return nil, wrapError("configure", intf.InterfaceName, err)
+	}
+	if key != nil && hasKey && wgDevice.PrivateKey != *key {
+		return nil, wrapError("configure", intf.InterfaceName, fmt.Errorf("%w: has public key %s, expected %s", ErrKeyMismatch, wgDevice.PublicKey, key.PublicKey()))
+	}
+	if key == nil && !hasKey {
 		newKey, err := wgtypes.GeneratePrivateKey()
 		if err != nil {
-			return err
+			return nil, wrapError("configure", intf.InterfaceName, err)
 		}
+		key = &newKey
+	}
 
+	// check if device already has key and Listen port set. If not, do so
+	if !hasKey {
 		newConfig := wgtypes.Config{
-			PrivateKey: &newKey,
+			PrivateKey: key,
 		}
 		err = wgClient.ConfigureDevice(intf.InterfaceName, newConfig)
 		if err != nil {
-			return err
+			return nil, wrapError("configure", intf.InterfaceName, err)
+		}
+		restore.PrivateKey = &wgtypes.Key{}
+		undo = restoreFunc
+	}
+
+	// the key is stored once the device has it, see rotateKey
+	if wg.keyStore != nil && !stored {
+		k := wgDevice.PrivateKey
+		if key != nil {
+			k = *key
+		}
+		if err := wg.keyStore.Store(intf.InterfaceName, k.String()); err != nil {
+			err = wrapError("configure", intf.InterfaceName, fmt.Errorf("unable to store key: %w", err))
+			if undo != nil {
+				if uerr := undo(wg); uerr != nil {
+					return nil, &RollbackError{Err: err, Errors: []error{uerr}}
+				}
+			}
+			return nil, err
 		}
 	}
 
 	if wgDevice.ListenPort == 0 {
 		if intf.ListenPort == 0 {
-			return errors.New("wg listenPort may not be 0")
+			return undo, wrapError("configure", intf.InterfaceName, ErrListenPortMissing)
 		}
 
 		newConfig := wgtypes.Config{
@@ -262,26 +329,80 @@ func (wg wgwrapper) Configure(intf *WireguardInterface) error {
 		}
 		err = wgClient.ConfigureDevice(intf.InterfaceName, newConfig)
 		if err != nil {
-			return err
+			return undo, wrapError("configure", intf.InterfaceName, err)
 		}
+		restore.ListenPort = new(int)
+		undo = restoreFunc
+	}
+
+	if intf.FirewallMark != 0 && wgDevice.FirewallMark != intf.FirewallMark {
+		newConfig := wgtypes.Config{
+			FirewallMark: &intf.FirewallMark,
+		}
+		err = wgClient.ConfigureDevice(intf.InterfaceName, newConfig)
+		if err != nil {
+			return undo, wrapError("configure", intf.InterfaceName, err)
+		}
+		previous := wgDevice.FirewallMark
+		restore.FirewallMark = &previous
+		undo = restoreFunc
 	}
 
 	// query again make sure stuff is present
 	wgDevice, err = wgClient.Device(intf.InterfaceName)
 	if err != nil {
-		return err
+		return undo, wrapError("configure", intf.InterfaceName, err)
 	}
 	if wgDevice == nil {
-		return errors.New("error reading wg device configuration")
+		return undo, wrapError("configure", intf.InterfaceName, errors.New("error reading wg device configuration"))
 	}
 
 	if bytes.Compare(wgDevice.PrivateKey[:], emptyBytes32) == 0 || bytes.Compare(wgDevice.PublicKey[:], emptyBytes32) == 0 || wgDevice.ListenPort == 0 {
-		return errors.New("unable to set wireguard key configuration")
+		return undo, wrapError("configure", intf.InterfaceName, errors.New("unable to set wireguard key configuration"))
+	}
+	if key != nil && wgDevice.PrivateKey != *key {
+		return undo, wrapError("configure", intf.InterfaceName, fmt.Errorf("%w: key has not been applied", ErrKeyMismatch))
+	}
+	if intf.FirewallMark != 0 && wgDevice.FirewallMark != intf.FirewallMark {
+		return undo, wrapError("configure", intf.InterfaceName, errors.New("unable to set firewall mark"))
 	}
 
 	intf.PublicKey = base64.StdEncoding.EncodeToString(wgDevice.PublicKey[:])
 
-	return nil
+	return undo, nil
+}
+
+// interfaceKey returns the key given by intf.PrivateKey or the key
+// store, nil if there is none, and whether the key store holds it.
+// A given key must match the stored one.
+func (wg wgwrapper) interfaceKey(intf *WireguardInterface) (*wgtypes.Key, bool, error) {
+	var key *wgtypes.Key
+	if intf.PrivateKey != "" {
+		k, err := wgtypes.ParseKey(intf.PrivateKey)
+		if err != nil {
+			return nil, false, invalidKey(err)
+		}
+		key = &k
+	}
+	if wg.keyStore == nil {
+		return key, false, nil
+	}
+
+	s, err := wg.keyStore.Load(intf.InterfaceName)
+	if errors.Is(err, ErrKeyNotFound) {
+		return key, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to load key: %w", err)
+	}
+	k, err := wgtypes.ParseKey(s)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to load key: %w", invalidKey(err))
+	}
+	if key != nil && *key != k {
+		return nil, false, fmt.Errorf("%w: key store holds public key %s, expected %s", ErrKeyMismatch, k.PublicKey(), key.PublicKey())
+	}
+	return &k, true, nil
 }
 
 var (
@@ -0,0 +1,247 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// AddressFamily selects the addresses a host name endpoint resolves to
+type AddressFamily int
+
+const (
+	// PreferIPv4 uses an IPv4 address if there is one, IPv6 otherwise
+	PreferIPv4 AddressFamily = iota
+
+	// PreferIPv6 uses an IPv6 address if there is one, IPv4 otherwise
+	PreferIPv6
+
+	// IPv4Only uses IPv4 addresses only
+	IPv4Only
+
+	// IPv6Only uses IPv6 addresses only
+	IPv6Only
+)
+
+// defaultResolveInterval is the time between re-resolutions
+// of WatchEndpoints, unless set by EndpointResolver.Interval
+const defaultResolveInterval = 5 * time.Minute
+
+// LookupFunc resolves a host name to its addresses
+type LookupFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+// lookupIP resolves host names via the default resolver
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// EndpointResolver controls the re-resolution of host name
+// endpoints by ResolveEndpoints and WatchEndpoints
+type EndpointResolver struct {
+	// Interval is the time between re-resolutions of all host name
+	// endpoints by WatchEndpoints. Defaults to 5 minutes.
+	Interval time.Duration
+
+	// StaleHandshake makes WatchEndpoints re-resolve the endpoint of
+	// a peer early when its last handshake is older, or there has been
+	// none. The handshakes are checked every StaleHandshake. 0 disables it.
+	StaleHandshake time.Duration
+
+	// Lookup resolves host names. Defaults to the resolver of package net.
+	Lookup LookupFunc
+
+	// OnChange receives the endpoints changed by WatchEndpoints
+	OnChange func(changes []Change)
+
+	// OnError receives errors of WatchEndpoints, which keeps going
+	OnError func(err error)
+}
+
+// selectIP picks an address of family from addrs. Returns nil if there is none.
+func selectIP(addrs []net.IP, family AddressFamily) net.IP {
+	var v4, v6 net.IP
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip.To4()
+			}
+		} else if v6 == nil {
+			v6 = ip
+		}
+	}
+
+	switch family {
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	case PreferIPv6:
+		if v6 != nil {
+			return v6
+		}
+		return v4
+	default:
+		if v4 != nil {
+			return v4
+		}
+		return v6
+	}
+}
+
+// resolveHost resolves the host name endpoint of a peer. If the
+// current endpoint is among the addresses of the selected family,
+// it is kept, so that peers do not move between addresses of a host.
+func resolveHost(ctx context.Context, lookup LookupFunc, peer WireguardPeer, current *net.UDPAddr) (*net.UDPAddr, error) {
+	if lookup == nil {
+		lookup = lookupIP
+	}
+	addrs, err := lookup(ctx, peer.RemoteEndpointHost)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := selectIP(addrs, peer.EndpointFamily)
+	if ip == nil {
+		return nil, fmt.Errorf("no suitable address for %s", peer.RemoteEndpointHost)
+	}
+
+	if current != nil && current.Port == peer.ListenPort && (current.IP.To4() == nil) == (ip.To4() == nil) {
+		for _, a := range addrs {
+			if a.Equal(current.IP) {
+				return current, nil
+			}
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: peer.ListenPort}, nil
+}
+
+// ResolveEndpoints resolves the host name endpoints of peers again
+// and updates the peers whose address changed, in a single device
+// configuration. Peers without RemoteEndpointHost, or not present on
+// the interface, are skipped. If a host name cannot be resolved, the
+// other peers are updated and the first error is returned along with
+// the changes made.
+func (wg wgwrapper) ResolveEndpoints(intf WireguardInterface, peers []WireguardPeer, r EndpointResolver) ([]Change, error) {
+	return wg.resolveEndpoints(intf, peers, r, func(p wgtypes.Peer) bool {
+		return true
+	})
+}
+
+// resolveEndpoints implements ResolveEndpoints for the peers
+// of the device selected by due
+func (wg wgwrapper) resolveEndpoints(intf WireguardInterface, peers []WireguardPeer, r EndpointResolver, due func(p wgtypes.Peer) bool) ([]Change, error) {
+	current, err := wg.devicePeers("resolve endpoints", intf)
+	if err != nil {
+		return []Change{}, err
+	}
+	byKey := make(map[wgtypes.Key]wgtypes.Peer, len(current))
+	for _, p := range current {
+		byKey[p.PublicKey] = p
+	}
+
+	changes := []Change{}
+	configs := []wgtypes.PeerConfig{}
+	var firstErr error
+	for _, peer := range peers {
+		if peer.RemoteEndpointHost == "" {
+			continue
+		}
+		pk, err := wgtypes.ParseKey(peer.Pubkey)
+		if err != nil {
+			return []Change{}, wrapError("resolve endpoints", intf.InterfaceName, invalidKey(err))
+		}
+		p, ok := byKey[pk]
+		if !ok || !due(p) {
+			continue
+		}
+
+		ep, err := resolveHost(wg.context(), r.Lookup, peer, p.Endpoint)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = wrapError("resolve endpoints", intf.InterfaceName, err)
+			}
+			continue
+		}
+		if p.Endpoint != nil && ep.IP.Equal(p.Endpoint.IP) && ep.Port == p.Endpoint.Port {
+			continue
+		}
+
+		f := FieldChange{Field: "endpoint", After: ep.String()}
+		if p.Endpoint != nil {
+			f.Before = p.Endpoint.String()
+		}
+		changes = append(changes, Change{Op: "update peer", Target: peer.Pubkey, Fields: []FieldChange{f}})
+		configs = append(configs, wgtypes.PeerConfig{PublicKey: pk, UpdateOnly: true, Endpoint: ep})
+	}
+	if len(configs) == 0 {
+		return changes, firstErr
+	}
+
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return []Change{}, wrapError("resolve endpoints", intf.InterfaceName, err)
+	}
+	defer wgClient.Close()
+
+	err = wgClient.ConfigureDevice(intf.InterfaceName, wgtypes.Config{Peers: configs})
+	if err != nil {
+		return []Change{}, wrapError("resolve endpoints", intf.InterfaceName, err)
+	}
+	return changes, firstErr
+}
+
+// WatchEndpoints resolves the host name endpoints of peers every
+// r.Interval, and early for peers with a stale handshake, see
+// EndpointResolver. It starts with resolving all of them. Changes and
+// errors are reported to the callbacks of r. It runs until ctx, or the
+// context of the wrapper, is done, see WithContext, and returns its error.
+func (wg wgwrapper) WatchEndpoints(ctx context.Context, intf WireguardInterface, peers []WireguardPeer, r EndpointResolver) error {
+	wctx := wg.context()
+
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultResolveInterval
+	}
+
+	report := func(changes []Change, err error) {
+		if len(changes) > 0 && r.OnChange != nil {
+			r.OnChange(changes)
+		}
+		if err != nil && r.OnError != nil {
+			r.OnError(err)
+		}
+	}
+
+	report(wg.ResolveEndpoints(intf, peers, r))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// stale is nil, and never fires, without StaleHandshake
+	var stale <-chan time.Time
+	if r.StaleHandshake > 0 {
+		staleTicker := time.NewTicker(r.StaleHandshake)
+		defer staleTicker.Stop()
+		stale = staleTicker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wctx.Done():
+			return wctx.Err()
+		case <-ticker.C:
+			report(wg.ResolveEndpoints(intf, peers, r))
+		case now := <-stale:
+			report(wg.resolveEndpoints(intf, peers, r, func(p wgtypes.Peer) bool {
+				return p.LastHandshakeTime.IsZero() || now.Sub(p.LastHandshakeTime) >= r.StaleHandshake
+			}))
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSelectIP(t *testing.T) {
+	v4 := net.ParseIP("192.0.2.1")
+	v6 := net.ParseIP("2001:db8::1")
+	for _, tc := range []struct {
+		addrs    []net.IP
+		family   AddressFamily
+		expected net.IP
+	}{
+		{[]net.IP{v6, v4}, PreferIPv4, v4},
+		{[]net.IP{v6}, PreferIPv4, v6},
+		{[]net.IP{v4, v6}, PreferIPv6, v6},
+		{[]net.IP{v4}, PreferIPv6, v4},
+		{[]net.IP{v6, v4}, IPv4Only, v4},
+		{[]net.IP{v6}, IPv4Only, nil},
+		{[]net.IP{v4, v6}, IPv6Only, v6},
+		{[]net.IP{v4}, IPv6Only, nil},
+	} {
+		ip := selectIP(tc.addrs, tc.family)
+		if (ip == nil) != (tc.expected == nil) || !ip.Equal(tc.expected) {
+			t.Errorf("selectIP(%v, %d): expected %v, got %v", tc.addrs, tc.family, tc.expected, ip)
+		}
+	}
+}
+
+func TestPeerEndpointContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// host names are resolved until the context of the wrapper is done
+	peer := WireguardPeer{RemoteEndpointHost: "peer.example.invalid", ListenPort: 51820}
+	if _, err := peerEndpoint(ctx, peer); !errors.Is(err, context.Canceled) {
+		t.Errorf("peerEndpoint should fail with context.Canceled, got: %v", err)
+	}
+	if _, err := peerEndpoints(ctx, []WireguardPeer{peer}); !errors.Is(err, context.Canceled) {
+		t.Errorf("peerEndpoints should fail with context.Canceled, got: %v", err)
+	}
+	if _, err := peerConfig(ctx, WireguardPeer{Pubkey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", RemoteEndpointHost: peer.RemoteEndpointHost}); !errors.Is(err, context.Canceled) {
+		t.Errorf("peerConfig should fail with context.Canceled, got: %v", err)
+	}
+}
+
+// fakeDNS resolves host names from a map, and is safe for concurrent use
+type fakeDNS struct {
+	mu    sync.Mutex
+	hosts map[string][]net.IP
+}
+
+func (d *fakeDNS) set(host string, addrs ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hosts[host] = []net.IP{}
+	for _, a := range addrs {
+		d.hosts[host] = append(d.hosts[host], net.ParseIP(a))
+	}
+}
+
+func (d *fakeDNS) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	addrs, ok := d.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestResolveEndpoints(t *testing.T) {
+	wg, c := newRecordingInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	dns := &fakeDNS{hosts: map[string][]net.IP{}}
+	r := EndpointResolver{Lookup: dns.lookup}
+
+	wgp1 := WireguardPeer{
+		RemoteEndpointIP:   "192.0.2.1",
+		RemoteEndpointHost: "peer1.example.com",
+		ListenPort:         51820,
+		Pubkey:             "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+	}
+	wgp2 := WireguardPeer{
+		RemoteEndpointIP:   "192.0.2.2",
+		RemoteEndpointHost: "peer2.example.com",
+		EndpointFamily:     PreferIPv6,
+		ListenPort:         51820,
+		Pubkey:             "xqr+unDSDc5Fq0W9Zp2SJlzr+wOaFAquNdIMwPLHarw=",
+	}
+	for _, p := range []WireguardPeer{wgp1, wgp2} {
+		p.RemoteEndpointHost = ""
+		if _, err := wg.AddPeer(wgi, p); err != nil {
+			t.Fatalf("Unable to execute AddPeer: %s", err)
+		}
+	}
+	peers := []WireguardPeer{wgp1, wgp2}
+
+	// no change, the current address of peer1 is kept
+	dns.set("peer1.example.com", "192.0.2.9", "192.0.2.1")
+	dns.set("peer2.example.com", "192.0.2.2")
+	c.configs = nil
+	changes, err := wg.ResolveEndpoints(wgi, peers, r)
+	if err != nil || len(changes) != 0 || len(c.configs) != 0 {
+		t.Errorf("ResolveEndpoints without changes: %v, %v", changeStrings(changes), err)
+	}
+
+	// both move, in a single configuration
+	dns.set("peer1.example.com", "192.0.2.11")
+	dns.set("peer2.example.com", "192.0.2.2", "2001:db8::2")
+	changes, err = wg.ResolveEndpoints(wgi, peers, r)
+	if err != nil || len(changes) != 2 || len(c.configs) != 1 {
+		t.Fatalf("Unexpected result of ResolveEndpoints: %v, %v", changeStrings(changes), err)
+	}
+	expected := []string{"endpoint: 192.0.2.1:51820 -> 192.0.2.11:51820"}
+	if !reflect.DeepEqual(fieldStrings(changes[0].Fields), expected) {
+		t.Errorf("Unexpected changes: %v", fieldStrings(changes[0].Fields))
+	}
+	s, err := wg.PeerStatus(wgi, wgp2.Pubkey)
+	if err != nil || s.Endpoint.String() != "[2001:db8::2]:51820" {
+		t.Errorf("Expected peer to prefer IPv6: %v, %v", s.Endpoint, err)
+	}
+
+	// a failing host name does not prevent updates of others
+	c.configs = nil
+	dns.set("peer1.example.com", "192.0.2.12")
+	delete(dns.hosts, "peer2.example.com")
+	changes, err = wg.ResolveEndpoints(wgi, peers, r)
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || len(changes) != 1 || changes[0].Target != wgp1.Pubkey {
+		t.Errorf("Unexpected result of ResolveEndpoints: %v, %v", changeStrings(changes), err)
+	}
+
+	// no suitable address
+	dns.set("peer2.example.com", "192.0.2.2")
+	wgp2.EndpointFamily = IPv6Only
+	_, err = wg.ResolveEndpoints(wgi, []WireguardPeer{wgp2}, r)
+	if err == nil {
+		t.Errorf("ResolveEndpoints without IPv6 address should fail")
+	}
+}
+
+func TestWatchEndpoints(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	dns := &fakeDNS{hosts: map[string][]net.IP{}}
+	dns.set("peer1.example.com", "192.0.2.1")
+
+	wgp := WireguardPeer{
+		RemoteEndpointIP: "192.0.2.1",
+		ListenPort:       51820,
+		Pubkey:           "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+	}
+	if _, err := wg.AddPeer(wgi, wgp); err != nil {
+		t.Fatalf("Unable to execute AddPeer: %s", err)
+	}
+	wgp.RemoteEndpointHost = "peer1.example.com"
+
+	changed := make(chan []Change, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- wg.WatchEndpoints(ctx, wgi, []WireguardPeer{wgp}, EndpointResolver{
+			Interval:       time.Hour,
+			StaleHandshake: 10 * time.Millisecond,
+			Lookup:         dns.lookup,
+			OnChange: func(changes []Change) {
+				changed <- changes
+			},
+		})
+	}()
+
+	// the peer never had a handshake, so it is re-resolved early
+	dns.set("peer1.example.com", "192.0.2.2")
+	select {
+	case changes := <-changed:
+		expected := []string{"endpoint: 192.0.2.1:51820 -> 192.0.2.2:51820"}
+		if len(changes) != 1 || !reflect.DeepEqual(fieldStrings(changes[0].Fields), expected) {
+			t.Errorf("Unexpected changes: %v", changeStrings(changes))
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected endpoint to be updated")
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected WatchEndpoints to end with context.Canceled, got: %v", err)
+	}
+
+	// the context of the wrapper ends it as well
+	err := wg.WithContext(ctx).WatchEndpoints(context.Background(), wgi, nil, EndpointResolver{Lookup: dns.lookup})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected WatchEndpoints to end with context.Canceled, got: %v", err)
+	}
+}
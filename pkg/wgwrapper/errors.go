@@ -0,0 +1,226 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Errors that can be checked for using errors.Is
+var (
+	// ErrInterfaceNotFound is returned when an interface does not exist
+	ErrInterfaceNotFound = errors.New("interface does not exist")
+
+	// ErrInterfaceExists is returned when an interface cannot be created because it exists
+	ErrInterfaceExists = errors.New("interface already exists")
+
+	// ErrNotWireguard is returned when an interface exists but is not of type wireguard
+	ErrNotWireguard = errors.New("interface is not of type wireguard")
+
+	// ErrPermissionDenied is returned when lacking privileges (CAP_NET_ADMIN)
+	ErrPermissionDenied = errors.New("permission denied")
+
+	// ErrModuleNotLoaded is returned when the kernel does not support wireguard interfaces
+	ErrModuleNotLoaded = errors.New("wireguard kernel module not loaded")
+
+	// ErrAddressExists is returned when an address is already assigned to an interface
+	ErrAddressExists = errors.New("address already assigned")
+
+	// ErrRouteExists is returned when a route is already present
+	ErrRouteExists = errors.New("route already exists")
+
+	// ErrPeerNotFound is returned when a peer to be updated does not exist
+	ErrPeerNotFound = errors.New("peer does not exist")
+
+	// ErrInvalidKey is returned for keys that cannot be parsed
+	ErrInvalidKey = errors.New("invalid key")
+
+	// ErrKeyMismatch is returned when an interface holds a different private key than the one given
+	ErrKeyMismatch = errors.New("interface has a different private key")
+
+	// ErrKeyNotFound is returned by a KeyStore that has no key for an interface
+	ErrKeyNotFound = errors.New("no key stored for interface")
+
+	// ErrKeyStoreReadOnly is returned by a KeyStore that cannot store keys
+	ErrKeyStoreReadOnly = errors.New("key store is read-only")
+
+	// ErrListenPortMissing is returned when configuring an interface without listen port
+	ErrListenPortMissing = errors.New("wg listenPort may not be 0")
+
+	// ErrTransactionDone is returned when using a transaction after Commit or Rollback
+	ErrTransactionDone = errors.New("transaction has already been committed or rolled back")
+)
+
+// InterfaceError is returned by operations on an interface. Its Kind
+// is one of the Err... values above (or nil if the cause is unknown),
+// so errors.Is(err, ErrPermissionDenied) works. The underlying error,
+// e.g. a *CommandError or a syscall error, is available via errors.As.
+type InterfaceError struct {
+	Op        string // operation, such as "add address"
+	Interface string // name of the interface
+	Kind      error  // classification of Err
+	Err       error  // underlying error
+}
+
+func (e *InterfaceError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Op, e.Interface, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *InterfaceError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the kind of the error
+func (e *InterfaceError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// RollbackError is returned when reverting the steps of a
+// transaction failed, so the system may be left half-configured
+type RollbackError struct {
+	Err    error   // error of the step that caused the rollback, nil for Rollback
+	Errors []error // errors of the steps that could not be reverted
+}
+
+func (e *RollbackError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for idx, err := range e.Errors {
+		msgs[idx] = err.Error()
+	}
+	if e.Err == nil {
+		return fmt.Sprintf("rollback failed: %s", strings.Join(msgs, "; "))
+	}
+	return fmt.Sprintf("%s (rollback failed: %s)", e.Err, strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the error that caused the rollback
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// CommandError is returned when a call to the ip binary fails
+type CommandError struct {
+	Command   string   // path of the binary
+	Args      []string // arguments
+	ExitCode  int      // exit code, -1 if the command did not exit normally
+	Stderr    string   // output on stderr
+	Interface string   // name of the interface the command was about, if any
+	Err       error    // error returned by the CommandRunner, if any
+}
+
+func (e *CommandError) Error() string {
+	if len(e.Stderr) > 0 {
+		return fmt.Sprintf("%s reported: %s", e.Command, strings.TrimSpace(e.Stderr))
+	}
+	return fmt.Sprintf("%s reported: %s", e.Command, e.Err)
+}
+
+// Unwrap returns the error of the CommandRunner
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// newCommandError collects details of a failed command
+func newCommandError(command string, args []string, intf string, stderr []byte, err error) *CommandError {
+	res := &CommandError{
+		Command:   command,
+		Args:      args,
+		Stderr:    string(stderr),
+		Interface: intf,
+		Err:       err,
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		res.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		res.ExitCode = -1
+	}
+	return res
+}
+
+// stderrKinds maps messages of iproute2 to error kinds. "File exists"
+// is handled by classify, because its meaning depends on the operation.
+var stderrKinds = []struct {
+	msg  string
+	kind error
+}{
+	{"does not exist", ErrInterfaceNotFound},
+	{"Cannot find device", ErrInterfaceNotFound},
+	{"No such device", ErrInterfaceNotFound},
+	{"Operation not permitted", ErrPermissionDenied},
+	{"Permission denied", ErrPermissionDenied},
+	{"Unknown device type", ErrModuleNotLoaded},
+	{"not of type wireguard", ErrNotWireguard},
+}
+
+// classify determines the kind of err, returned by given operation
+func classify(op string, err error) error {
+	for _, kind := range []error{
+		ErrInterfaceNotFound, ErrInterfaceExists, ErrNotWireguard, ErrPermissionDenied,
+		ErrModuleNotLoaded, ErrAddressExists, ErrRouteExists, ErrPeerNotFound, ErrInvalidKey, ErrKeyMismatch,
+		ErrKeyNotFound, ErrKeyStoreReadOnly, ErrListenPortMissing,
+	} {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+
+	exists := errors.Is(err, unix.EEXIST)
+
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		for _, sk := range stderrKinds {
+			if strings.Contains(cmdErr.Stderr, sk.msg) {
+				return sk.kind
+			}
+		}
+		exists = strings.Contains(cmdErr.Stderr, "File exists") || strings.Contains(cmdErr.Stderr, "already assigned")
+	}
+
+	switch {
+	case exists && strings.Contains(op, "address"):
+		return ErrAddressExists
+	case exists && strings.Contains(op, "route"):
+		return ErrRouteExists
+	case exists && strings.Contains(op, "interface"):
+		return ErrInterfaceExists
+	case errors.Is(err, os.ErrNotExist) || errors.Is(err, unix.ENODEV):
+		// wgctrl reports missing devices as os.ErrNotExist, rtnetlink as ENODEV
+		return ErrInterfaceNotFound
+	case errors.Is(err, os.ErrPermission):
+		return ErrPermissionDenied
+	case errors.Is(err, unix.EOPNOTSUPP):
+		return ErrModuleNotLoaded
+	}
+	return nil
+}
+
+// wrapError returns err as an *InterfaceError, classified by op
+func wrapError(op string, intf string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var ie *InterfaceError
+	if errors.As(err, &ie) {
+		return err
+	}
+	return &InterfaceError{
+		Op:        op,
+		Interface: intf,
+		Kind:      classify(op, err),
+		Err:       err,
+	}
+}
+
+// invalidKey marks an error of wgtypes.ParseKey
+func invalidKey(err error) error {
+	return fmt.Errorf("%w: %s", ErrInvalidKey, err)
+}
@@ -0,0 +1,75 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		op   string
+		err  error
+		kind error
+	}{
+		{"add interface", &netlink.OpError{Op: "receive", Err: unix.EPERM}, ErrPermissionDenied},
+		{"add interface", &netlink.OpError{Op: "receive", Err: unix.EOPNOTSUPP}, ErrModuleNotLoaded},
+		{"add interface", &netlink.OpError{Op: "receive", Err: unix.EEXIST}, ErrInterfaceExists},
+		{"add address", &netlink.OpError{Op: "receive", Err: unix.EEXIST}, ErrAddressExists},
+		{"add route", &netlink.OpError{Op: "receive", Err: unix.EEXIST}, ErrRouteExists},
+		{"set interface up", &netlink.OpError{Op: "receive", Err: unix.ENODEV}, ErrInterfaceNotFound},
+		{"configure", os.ErrNotExist, ErrInterfaceNotFound},
+		{"add interface", &CommandError{Stderr: "Error: Unknown device type.\n"}, ErrModuleNotLoaded},
+		{"add interface", &CommandError{Stderr: "RTNETLINK answers: Operation not permitted\n"}, ErrPermissionDenied},
+		{"add address", &CommandError{Stderr: "Error: ipv4: Address already assigned.\n"}, ErrAddressExists},
+		{"add route", &CommandError{Stderr: "RTNETLINK answers: File exists\n"}, ErrRouteExists},
+		{"set interface up", &CommandError{Stderr: "Cannot find device \"wg0\"\n"}, ErrInterfaceNotFound},
+		{"add peer", invalidKey(errors.New("wgtypes: incorrect key size: 5")), ErrInvalidKey},
+		{"add peer", errors.New("something else"), nil},
+	} {
+		err := wrapError(tc.op, "wg0", tc.err)
+		if tc.kind != nil && !errors.Is(err, tc.kind) {
+			t.Errorf("%s, %v: expected %v", tc.op, tc.err, tc.kind)
+		}
+		var ie *InterfaceError
+		if !errors.As(err, &ie) || ie.Kind != tc.kind || ie.Interface != "wg0" {
+			t.Errorf("%s, %v: expected InterfaceError of kind %v, got %#v", tc.op, tc.err, tc.kind, err)
+		}
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	r := NewRecordingRunner()
+	wg := NewWithRunner(r)
+	wgi := NewWireguardInterface("wg-tst0", net.IPNet{
+		IP:   net.IPv4(10, 99, 99, 99),
+		Mask: net.CIDRMask(24, 32),
+	})
+
+	r.On(RunResult{Stderr: "RTNETLINK answers: Operation not permitted\n", Err: errors.New("exit status 2")}, "route", "add", "10.1.0.0/16", "dev", "wg-tst0")
+
+	err := wg.SetRoute(wgi, "10.1.0.0/16")
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied, got: %v", err)
+	}
+
+	var ce *CommandError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Expected a CommandError, got: %#v", err)
+	}
+	if ce.Command != "/sbin/ip" || ce.Interface != "wg-tst0" || ce.ExitCode != -1 || ce.Stderr != "RTNETLINK answers: Operation not permitted\n" {
+		t.Errorf("Unexpected content of CommandError: %#v", ce)
+	}
+	if len(ce.Args) != 5 || ce.Args[0] != "route" || ce.Args[1] != "add" {
+		t.Errorf("Unexpected arguments in CommandError: %v", ce.Args)
+	}
+	if err.Error() != "add route wg-tst0: /sbin/ip reported: RTNETLINK answers: Operation not permitted" {
+		t.Errorf("Unexpected error message: %s", err)
+	}
+}
@@ -0,0 +1,400 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ipCommand implements linkBackend by calling the ip
+// binary via a CommandRunner
+type ipCommand struct {
+	path    string
+	runner  CommandRunner
+	logger  Logger
+	timeout time.Duration
+}
+
+// exec runs the ip binary and logs the call
+func (ip ipCommand) exec(ctx context.Context, args ...string) ([]byte, []byte, error) {
+	ctx, cancel := withTimeout(ctx, ip.timeout)
+	defer cancel()
+
+	ip.logger.Debug("calling ip", "path", ip.path, "args", strings.Join(args, " "))
+	stdout, stderr, err := ip.runner.Run(ctx, ip.path, args...)
+	if err != nil {
+		ip.logger.Debug("ip reported an error", "args", strings.Join(args, " "), "err", err, "stderr", strings.TrimSpace(string(stderr)))
+	}
+	return stdout, stderr, err
+}
+
+// run executes the ip binary with given arguments and returns its output.
+// Anything written to stderr is treated as an error, returned as *CommandError.
+func (ip ipCommand) run(ctx context.Context, intf string, args ...string) (string, error) {
+	stdout, stderr, err := ip.exec(ctx, args...)
+	if isContextError(err) {
+		return "", err
+	}
+	if len(stderr) > 0 || err != nil {
+		return string(stdout), newCommandError(ip.path, args, intf, stderr, err)
+	}
+	return string(stdout), nil
+}
+
+func (ip ipCommand) LinkExists(ctx context.Context, name string) (bool, error) {
+	_, stderr, err := ip.exec(ctx, "-o", "link", "show", "dev", name)
+	if isContextError(err) {
+		return false, err
+	}
+	if err != nil {
+		if strings.Contains(string(stderr), "does not exist") {
+			return false, nil
+		}
+		return false, newCommandError(ip.path, []string{"-o", "link", "show", "dev", name}, name, stderr, err)
+	}
+	return true, nil
+}
+
+func (ip ipCommand) LinkAdd(ctx context.Context, name string) error {
+	_, err := ip.run(ctx, name, "link", "add", "dev", name, "type", "wireguard")
+	return err
+}
+
+func (ip ipCommand) LinkDelete(ctx context.Context, name string) error {
+	_, err := ip.run(ctx, name, "link", "delete", "dev", name, "type", "wireguard")
+	return err
+}
+
+func (ip ipCommand) LinkIsUp(ctx context.Context, name string) (bool, error) {
+	outStr, err := ip.run(ctx, name, "--br", "link", "show", "dev", name, "up", "type", "wireguard")
+	if err != nil {
+		return false, err
+	}
+	return len(outStr) > 0, nil
+}
+
+func (ip ipCommand) LinkSetUp(ctx context.Context, name string) error {
+	_, err := ip.run(ctx, name, "link", "set", "up", "dev", name)
+	return err
+}
+
+func (ip ipCommand) LinkSetDown(ctx context.Context, name string) error {
+	_, err := ip.run(ctx, name, "link", "set", "down", "dev", name)
+	return err
+}
+
+func (ip ipCommand) LinkAttrs(ctx context.Context, name string) (linkAttrs, error) {
+	outStr, err := ip.run(ctx, name, "-o", "link", "show", "dev", name)
+	if err != nil {
+		return linkAttrs{}, err
+	}
+	return parseLinkAttrs(outStr)
+}
+
+// parseLinkAttrs parses the output of "ip -o link show", which looks like
+// "9: wg0: <POINTOPOINT,NOARP,UP,LOWER_UP> mtu 1420 qdisc noqueue state
+// UNKNOWN mode DEFAULT group default qlen 1000\    link/none \    alias foo"
+func parseLinkAttrs(outStr string) (linkAttrs, error) {
+	res := linkAttrs{}
+	for idx, part := range strings.Split(strings.TrimSpace(outStr), "\\") {
+		if idx > 0 {
+			if a := strings.TrimSpace(part); strings.HasPrefix(a, "alias ") {
+				res.Alias = strings.TrimPrefix(a, "alias ")
+			}
+			continue
+		}
+		a := strings.Fields(part)
+		for i := 0; i+1 < len(a); i++ {
+			var err error
+			switch a[i] {
+			case "mtu":
+				res.MTU, err = strconv.Atoi(a[i+1])
+			case "qlen":
+				res.TxQueueLen, err = strconv.Atoi(a[i+1])
+			}
+			if err != nil {
+				return res, fmt.Errorf("unable to parse link attributes: %w", err)
+			}
+		}
+	}
+	if res.MTU == 0 {
+		return res, fmt.Errorf("unable to parse link attributes: %q", outStr)
+	}
+	return res, nil
+}
+
+func (ip ipCommand) LinkSetMTU(ctx context.Context, name string, mtu int) error {
+	_, err := ip.run(ctx, name, "link", "set", "dev", name, "mtu", strconv.Itoa(mtu))
+	return err
+}
+
+func (ip ipCommand) LinkSetTxQueueLen(ctx context.Context, name string, qlen int) error {
+	_, err := ip.run(ctx, name, "link", "set", "dev", name, "txqueuelen", strconv.Itoa(qlen))
+	return err
+}
+
+func (ip ipCommand) LinkSetAlias(ctx context.Context, name string, alias string) error {
+	_, err := ip.run(ctx, name, "link", "set", "dev", name, "alias", alias)
+	return err
+}
+
+func (ip ipCommand) AddrList(ctx context.Context, name string) ([]net.IPNet, error) {
+	outStr, err := ip.run(ctx, name, "-o", "address", "show", "dev", name)
+	if err != nil {
+		return nil, err
+	}
+
+	// each line looks like "4: wg0    inet 10.0.0.1/24 scope global wg0 ..."
+	res := []net.IPNet{}
+	for _, line := range strings.Split(outStr, "\n") {
+		a := strings.Fields(line)
+		if len(a) < 4 || (a[2] != "inet" && a[2] != "inet6") {
+			continue
+		}
+		addr, ipnet, err := net.ParseCIDR(a[3])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, net.IPNet{
+			IP:   addr,
+			Mask: ipnet.Mask,
+		})
+	}
+	return res, nil
+}
+
+func (ip ipCommand) AddrAdd(ctx context.Context, name string, addr net.IPNet) error {
+	_, err := ip.run(ctx, name, "address", "add", "dev", name, addr.String())
+	return err
+}
+
+func (ip ipCommand) AddrDel(ctx context.Context, name string, addr net.IPNet) error {
+	_, err := ip.run(ctx, name, "address", "del", "dev", name, addr.String())
+	return err
+}
+
+func (ip ipCommand) RouteList(ctx context.Context, name string, family uint8, table int) ([]Route, error) {
+	args := []string{"route", "show"}
+	switch {
+	case family == unix.AF_INET6:
+		args = append([]string{"-6"}, args...)
+	case table == routeTableAll:
+		// ip lists all families for all tables
+		args = append([]string{"-4"}, args...)
+	}
+	switch {
+	case table == routeTableAll:
+		args = append(args, "table", "all")
+	case table != 0:
+		args = append(args, "table", strconv.Itoa(table))
+	}
+	args = append(args, "dev", name)
+
+	outStr, err := ip.run(ctx, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := parseRoutes(outStr, family)
+	if err != nil {
+		return nil, err
+	}
+
+	// ip omits the table when listing a single one
+	if table > 0 {
+		for idx := range routes {
+			if routes[idx].Table == 0 {
+				routes[idx].Table = table
+			}
+		}
+	}
+	return routes, nil
+}
+
+// routeTypes are the types of routes ip prints in front of the
+// destination. Unicast routes have none.
+var routeTypes = map[string]bool{
+	"local": true, "broadcast": true, "anycast": true, "multicast": true, "unreachable": true,
+	"blackhole": true, "prohibit": true, "throw": true, "nat": true, "unicast": false,
+}
+
+// routeFlags are the attributes of routes ip prints without value
+var routeFlags = map[string]bool{
+	"linkdown": true, "onlink": true, "dead": true, "pervasive": true, "offload": true,
+	"trap": true, "notify": true, "rt_offload": true, "rt_trap": true, "rt_offload_failed": true,
+}
+
+// parseRoutes parses the output of "ip route show dev", which looks like
+// "10.1.0.0/16 table 100 proto static scope link src 10.0.0.1 metric 5"
+func parseRoutes(outStr string, family uint8) ([]Route, error) {
+	res := []Route{}
+	for _, line := range strings.Split(outStr, "\n") {
+		a := strings.Fields(line)
+		if len(a) == 0 || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			// empty, or a nexthop of a multipath route
+			continue
+		}
+		if isType, ok := routeTypes[a[0]]; ok {
+			if isType {
+				continue
+			}
+			a = a[1:]
+		}
+		if len(a) == 0 {
+			continue
+		}
+
+		r := Route{Protocol: "boot", Scope: ScopeGlobal}
+		dst := a[0]
+		switch {
+		case dst == "default" && family == unix.AF_INET6:
+			dst = "::/0"
+		case dst == "default":
+			dst = "0.0.0.0/0"
+		case !strings.Contains(dst, "/") && family == unix.AF_INET6:
+			dst += "/128"
+		case !strings.Contains(dst, "/"):
+			dst += "/32"
+		}
+		_, n, err := net.ParseCIDR(dst)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse route %q: %w", line, err)
+		}
+		r.Dst = *n
+
+		for idx := 1; idx < len(a); idx++ {
+			if routeFlags[a[idx]] {
+				continue
+			}
+			if idx+1 >= len(a) {
+				break
+			}
+			key, value := a[idx], a[idx+1]
+			idx++
+			switch key {
+			case "table":
+				r.Table, err = parseRouteTable(value)
+			case "proto":
+				r.Protocol = value
+			case "scope":
+				r.Scope = RouteScope(value)
+			case "src":
+				if r.Src = net.ParseIP(value); r.Src == nil {
+					err = fmt.Errorf("invalid source address %s", value)
+				}
+			case "metric":
+				r.Metric, err = strconv.Atoi(value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse route %q: %w", line, err)
+			}
+		}
+		if r.Scope == "universe" {
+			r.Scope = ScopeGlobal
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// parseRouteTable returns the number of a routing table as printed by ip,
+// 0 for the main table
+func parseRouteTable(s string) (int, error) {
+	switch s {
+	case "main":
+		return 0, nil
+	case "local":
+		return unix.RT_TABLE_LOCAL, nil
+	case "default":
+		return unix.RT_TABLE_DEFAULT, nil
+	}
+	t, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("unknown table %s", s)
+	}
+	if t == unix.RT_TABLE_MAIN {
+		t = 0
+	}
+	return t, nil
+}
+
+// routeArgs returns the arguments of ip route for op and r. The
+// attributes other than destination, table and metric only matter
+// when adding routes.
+func routeArgs(op string, name string, r Route) []string {
+	args := []string{"route", op, r.Dst.String(), "dev", name}
+	if r.Table != 0 {
+		args = append(args, "table", strconv.Itoa(r.Table))
+	}
+	if r.Metric != 0 {
+		args = append(args, "metric", strconv.Itoa(r.Metric))
+	}
+	if op == "del" {
+		return args
+	}
+	if r.Src != nil {
+		args = append(args, "src", r.Src.String())
+	}
+	if r.Scope != "" {
+		args = append(args, "scope", string(r.Scope))
+	}
+	if r.Protocol != "" && r.Protocol != "boot" {
+		args = append(args, "proto", r.Protocol)
+	}
+	return args
+}
+
+func (ip ipCommand) RouteAdd(ctx context.Context, name string, r Route) error {
+	_, err := ip.run(ctx, name, routeArgs("add", name, r)...)
+	return err
+}
+
+func (ip ipCommand) RouteReplace(ctx context.Context, name string, r Route) error {
+	_, err := ip.run(ctx, name, routeArgs("replace", name, r)...)
+	return err
+}
+
+func (ip ipCommand) RouteDel(ctx context.Context, name string, r Route) error {
+	_, err := ip.run(ctx, name, routeArgs("del", name, r)...)
+	return err
+}
+
+func (ip ipCommand) DefaultRouteInterface(ctx context.Context) (string, error) {
+	outStr, err := ip.run(ctx, "", "route", "show", "default")
+	if err != nil {
+		return "", err
+	}
+	a := strings.Split(outStr, " ")
+	b := false
+	for _, p := range a {
+		if b {
+			return p, nil
+		}
+		if p == "dev" {
+			b = true
+		}
+	}
+	return "", nil
+}
+
+func (ip ipCommand) RouteGet(ctx context.Context, dst net.IP) (string, error) {
+	outStr, err := ip.run(ctx, "", "route", "get", dst.String())
+	if err != nil {
+		return "", err
+	}
+
+	// e.g. "1.2.3.4 via 10.0.2.2 dev eth0 src 10.0.2.15 uid 0 \n    cache"
+	a := strings.Fields(outStr)
+	for idx := 0; idx+1 < len(a); idx++ {
+		if a[idx] == "dev" {
+			return a[idx+1], nil
+		}
+	}
+	return "", fmt.Errorf("no device in route to %s: %q", dst, outStr)
+}
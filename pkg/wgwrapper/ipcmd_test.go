@@ -0,0 +1,305 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func assertCommands(t *testing.T, r *RecordingRunner, expected ...string) {
+	t.Helper()
+
+	cmds := r.Commands()
+	if len(cmds) != len(expected) {
+		t.Fatalf("Expected %d commands, got %d: %v", len(expected), len(cmds), cmds)
+	}
+	for idx, cmd := range cmds {
+		if cmd.String() != expected[idx] {
+			t.Errorf("Command #%d: expected [%s], got [%s]", idx, expected[idx], cmd.String())
+		}
+	}
+}
+
+func TestRunnerAddInterface(t *testing.T) {
+	r := NewRecordingRunner()
+	wg := NewWithRunner(r)
+	wgi := NewWireguardInterface("wg-tst0", net.IPNet{
+		IP:   net.IPv4(10, 99, 99, 99),
+		Mask: net.CIDRMask(24, 32),
+	})
+
+	r.On(RunResult{Stderr: "Device \"wg-tst0\" does not exist.\n", Err: errors.New("exit status 1")}, "-o", "link", "show", "dev", "wg-tst0")
+	r.On(RunResult{Stdout: "9: wg-tst0: <POINTOPOINT,NOARP> mtu 1420 ...\n"}, "-o", "link", "show", "dev", "wg-tst0")
+	r.On(RunResult{}, "-o", "address", "show", "dev", "wg-tst0")
+	r.On(RunResult{Stdout: "9: wg-tst0    inet 10.99.99.99/24 scope global wg-tst0\\       valid_lft forever preferred_lft forever\n"}, "-o", "address", "show", "dev", "wg-tst0")
+
+	err := wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+
+	assertCommands(t, r,
+		"/sbin/ip -o link show dev wg-tst0",
+		"/sbin/ip link add dev wg-tst0 type wireguard",
+		"/sbin/ip -o link show dev wg-tst0",
+		"/sbin/ip -o address show dev wg-tst0",
+		"/sbin/ip address add dev wg-tst0 10.99.99.99/24",
+		"/sbin/ip -o address show dev wg-tst0",
+	)
+
+	// second call finds link and address present
+	r.Reset()
+	err = wg.AddInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterface:  %s", err)
+	}
+
+	assertCommands(t, r,
+		"/sbin/ip -o link show dev wg-tst0",
+		"/sbin/ip -o link show dev wg-tst0",
+		"/sbin/ip -o address show dev wg-tst0",
+		"/sbin/ip -o address show dev wg-tst0",
+	)
+}
+
+func TestRunnerAddInterfaceError(t *testing.T) {
+	r := NewRecordingRunner()
+	wg := NewWithRunner(r)
+	wgi := NewWireguardInterfaceNoAddr("wg-tst0")
+
+	r.On(RunResult{Stderr: "Device \"wg-tst0\" does not exist.\n", Err: errors.New("exit status 1")}, "-o", "link", "show", "dev", "wg-tst0")
+	r.On(RunResult{Stderr: "Error: Unknown device type.\n", Err: errors.New("exit status 2")}, "link", "add", "dev", "wg-tst0", "type", "wireguard")
+
+	err := wg.AddInterfaceNoAddr(wgi)
+	if err == nil {
+		t.Fatal("AddInterfaceNoAddr should fail but did not")
+	}
+	if !strings.Contains(err.Error(), "Unknown device type") {
+		t.Errorf("Expected stderr of /sbin/ip in error, got: %s", err)
+	}
+
+	assertCommands(t, r,
+		"/sbin/ip -o link show dev wg-tst0",
+		"/sbin/ip link add dev wg-tst0 type wireguard",
+	)
+}
+
+func TestRunnerAddInterfaceRollback(t *testing.T) {
+	r := NewRecordingRunner()
+	wg := NewWithRunner(r)
+	wgi := NewWireguardInterface("wg-tst0", net.IPNet{
+		IP:   net.IPv4(10, 99, 99, 99),
+		Mask: net.CIDRMask(24, 32),
+	})
+
+	r.On(RunResult{Stderr: "Device \"wg-tst0\" does not exist.\n", Err: errors.New("exit status 1")}, "-o", "link", "show", "dev", "wg-tst0")
+	r.On(RunResult{Stdout: "9: wg-tst0: <POINTOPOINT,NOARP> mtu 1420 ...\n"}, "-o", "link", "show", "dev", "wg-tst0")
+	r.On(RunResult{Stderr: "RTNETLINK answers: Permission denied\n", Err: errors.New("exit status 2")}, "address", "add", "dev", "wg-tst0", "10.99.99.99/24")
+
+	err := wg.AddInterface(wgi)
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("AddInterface should fail with ErrPermissionDenied, got: %v", err)
+	}
+
+	// the new interface is removed again
+	assertCommands(t, r,
+		"/sbin/ip -o link show dev wg-tst0",
+		"/sbin/ip link add dev wg-tst0 type wireguard",
+		"/sbin/ip -o link show dev wg-tst0",
+		"/sbin/ip -o address show dev wg-tst0",
+		"/sbin/ip address add dev wg-tst0 10.99.99.99/24",
+		"/sbin/ip link delete dev wg-tst0 type wireguard",
+	)
+}
+
+func TestRunnerSetInterfaceUp(t *testing.T) {
+	r := NewRecordingRunner()
+	wg := NewWithRunner(r)
+	wgi := NewWireguardInterfaceNoAddr("wg-tst0")
+
+	err := wg.SetInterfaceUp(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp:  %s", err)
+	}
+	assertCommands(t, r,
+		"/sbin/ip --br link show dev wg-tst0 up type wireguard",
+		"/sbin/ip link set up dev wg-tst0",
+	)
+
+	// already up
+	r.Reset()
+	r.On(RunResult{Stdout: "wg-tst0    UNKNOWN    <POINTOPOINT,NOARP,UP,LOWER_UP>\n"}, "--br", "link", "show", "dev", "wg-tst0", "up", "type", "wireguard")
+	err = wg.SetInterfaceUp(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp:  %s", err)
+	}
+	assertCommands(t, r,
+		"/sbin/ip --br link show dev wg-tst0 up type wireguard",
+	)
+}
+
+func TestRunnerDeleteInterface(t *testing.T) {
+	r := NewRecordingRunner()
+	wg := NewWithRunner(r)
+	wgi := NewWireguardInterfaceNoAddr("wg-tst0")
+
+	err := wg.DeleteInterface(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute DeleteInterface:  %s", err)
+	}
+	assertCommands(t, r,
+		"/sbin/ip -o link show dev wg-tst0",
+		"/sbin/ip link set down dev wg-tst0",
+		"/sbin/ip link delete dev wg-tst0 type wireguard",
+	)
+
+	// nonexisting interface
+	r.Reset()
+	r.On(RunResult{Stderr: "Device \"wg-tst0\" does not exist.\n", Err: errors.New("exit status 1")}, "-o", "link", "show", "dev", "wg-tst0")
+	err = wg.DeleteInterface(wgi)
+	if err == nil {
+		t.Fatal("DeleteInterface on nonexisting interface succeeds but should not")
+	}
+	assertCommands(t, r,
+		"/sbin/ip -o link show dev wg-tst0",
+	)
+}
+
+func TestRunnerRoutes(t *testing.T) {
+	r := NewRecordingRunner()
+	wg := NewWithRunner(r)
+	wgi := NewWireguardInterfaceNoAddr("wg-tst0")
+
+	r.On(RunResult{Stdout: "10.99.0.0/16 scope link \n"}, "route", "show", "dev", "wg-tst0")
+	err := wg.SetRoute(wgi, "10.99.0.0/16")
+	if err != nil {
+		t.Fatalf("Unable to execute SetRoute:  %s", err)
+	}
+	assertCommands(t, r,
+		"/sbin/ip route show dev wg-tst0",
+	)
+
+	r.Reset()
+	err = wg.SetRoute(wgi, "10.98.0.0/16")
+	if err != nil {
+		t.Fatalf("Unable to execute SetRoute:  %s", err)
+	}
+	assertCommands(t, r,
+		"/sbin/ip route show dev wg-tst0",
+		"/sbin/ip route add 10.98.0.0/16 dev wg-tst0",
+	)
+
+	r.On(RunResult{Stdout: "default via 192.0.2.1 dev eth0 proto dhcp metric 100 \n"}, "route", "show", "default")
+	intf, err := wg.DefaultRouteInterface()
+	if err != nil {
+		t.Fatalf("Unable to execute DefaultRouteInterface:  %s", err)
+	}
+	if intf != "eth0" {
+		t.Errorf("Expected default route interface eth0, got %s", intf)
+	}
+}
+
+func TestRunnerRouteAttributes(t *testing.T) {
+	r := NewRecordingRunner()
+	wg := NewWithRunner(r)
+	wgi := NewWireguardInterfaceNoAddr("wg-tst0")
+
+	r.On(RunResult{Stdout: "10.99.0.0/16 proto kernel scope link src 10.99.0.1 \n10.98.0.0/16 table 100 scope link metric 10 \n"}, "-4", "route", "show", "table", "all", "dev", "wg-tst0")
+	r.On(RunResult{Stdout: "fd00:99::/64 proto kernel metric 256 pref medium\n"}, "-6", "route", "show", "table", "all", "dev", "wg-tst0")
+	routes, err := wg.Routes(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute Routes:  %s", err)
+	}
+	if len(routes) != 3 || routes[1].Table != 100 || routes[1].Metric != 10 || routes[2].Metric != 256 {
+		t.Errorf("Unexpected routes: %v", routes)
+	}
+
+	// ip omits the table when listing a single one
+	r.On(RunResult{Stdout: "10.98.0.0/16 scope link metric 10 \n"}, "route", "show", "table", "100", "dev", "wg-tst0")
+	route := mustRoute("10.98.0.0/16")
+	route.Table, route.Metric = 100, 10
+	route.Src = net.ParseIP("10.99.0.1")
+	route.Scope = ScopeGlobal
+
+	r.Reset()
+	if _, err := wg.AddRoute(wgi, route); !errors.Is(err, ErrRouteExists) {
+		t.Errorf("AddRoute of a different route should fail with ErrRouteExists, got: %v", err)
+	}
+	if err := wg.ReplaceRoute(wgi, route); err != nil {
+		t.Fatalf("Unable to execute ReplaceRoute:  %s", err)
+	}
+	if ok, err := wg.DeleteRoute(wgi, route); err != nil || !ok {
+		t.Fatalf("Unexpected result of DeleteRoute: %t, %v", ok, err)
+	}
+	assertCommands(t, r,
+		"/sbin/ip route show table 100 dev wg-tst0",
+		"/sbin/ip route show table 100 dev wg-tst0",
+		"/sbin/ip route replace 10.98.0.0/16 dev wg-tst0 table 100 metric 10 src 10.99.0.1 scope global",
+		"/sbin/ip route show table 100 dev wg-tst0",
+		"/sbin/ip route del 10.98.0.0/16 dev wg-tst0 table 100 metric 10",
+	)
+
+	// routes are added with their protocol
+	r.Reset()
+	if _, err := wg.AddRoute(wgi, Route{Dst: route.Dst, Protocol: PeerRouteProtocol}); err != nil {
+		t.Fatalf("Unable to execute AddRoute:  %s", err)
+	}
+	if _, err := wg.AddRoute(wgi, Route{Dst: route.Dst, Protocol: "nonsense"}); err == nil {
+		t.Error("AddRoute with an unknown protocol should fail but did not")
+	}
+	assertCommands(t, r,
+		"/sbin/ip route show dev wg-tst0",
+		"/sbin/ip route add 10.98.0.0/16 dev wg-tst0 proto 77",
+	)
+}
+
+func TestParseLinkAttrs(t *testing.T) {
+	a, err := parseLinkAttrs("9: wg0: <POINTOPOINT,NOARP,UP,LOWER_UP> mtu 1380 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 500\\    link/none \\    alias site to site\n")
+	if err != nil {
+		t.Fatalf("Unable to parse link attributes: %s", err)
+	}
+	if a.MTU != 1380 || a.TxQueueLen != 500 || a.Alias != "site to site" {
+		t.Errorf("Unexpected link attributes: %#v", a)
+	}
+
+	if _, err := parseLinkAttrs("9: wg0: <POINTOPOINT,NOARP> mtu x\n"); err == nil {
+		t.Error("Parsing an invalid MTU should fail but did not")
+	}
+}
+
+func TestRunnerLinkAttrs(t *testing.T) {
+	r := NewRecordingRunner()
+	wg := NewWithRunner(r)
+	wgi := NewWireguardInterfaceNoAddr("wg-tst0")
+	wgi.MTU = 1380
+	wgi.Alias = "site to site"
+
+	r.On(RunResult{Stdout: "9: wg-tst0: <POINTOPOINT,NOARP> mtu 1420 qdisc noop state DOWN mode DEFAULT group default qlen 1000\\    link/none \n"}, "-o", "link", "show", "dev", "wg-tst0")
+
+	err := wg.AddInterfaceNoAddr(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute AddInterfaceNoAddr:  %s", err)
+	}
+	assertCommands(t, r,
+		"/sbin/ip -o link show dev wg-tst0",
+		"/sbin/ip -o link show dev wg-tst0",
+		"/sbin/ip -o link show dev wg-tst0",
+		"/sbin/ip link set dev wg-tst0 mtu 1380",
+		"/sbin/ip link set dev wg-tst0 alias site to site",
+	)
+}
+
+func TestRunnerRouteGet(t *testing.T) {
+	r := NewRecordingRunner()
+	wg := NewWithRunner(r).(wgwrapper)
+
+	r.On(RunResult{Stdout: "192.95.5.67 via 10.0.2.2 dev enp0s3 src 10.0.2.15 uid 0 \n    cache \n"}, "route", "get", "192.95.5.67")
+	link, err := wg.backend.RouteGet(wg.context(), net.ParseIP("192.95.5.67"))
+	if err != nil || link != "enp0s3" {
+		t.Errorf("Unexpected result of RouteGet: %s, %v", link, err)
+	}
+	assertCommands(t, r, "/sbin/ip route get 192.95.5.67")
+}
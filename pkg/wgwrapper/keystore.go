@@ -0,0 +1,257 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// KeyStore keeps the private keys of interfaces, so that their identity
+// survives the deletion of an interface. Configure loads the key of an
+// interface from it, and stores keys it generates, see WithKeyStore.
+// Keys are base64 encoded, as in WireguardInterface.PrivateKey.
+type KeyStore interface {
+	// Load returns the key of an interface, or ErrKeyNotFound
+	Load(interfaceName string) (string, error)
+
+	// Store saves the key of an interface, replacing an existing one
+	Store(interfaceName string, key string) error
+}
+
+// fileKeyStore keeps each key in a file of a directory
+type fileKeyStore struct {
+	dir string
+}
+
+// NewFileKeyStore returns a KeyStore that keeps the key of each interface
+// in a file named after it, e.g. wg0.key, in dir. The directory is created
+// if necessary. Files are only accessible by their owner (0600) and written
+// atomically, so a key is never lost halfway. Key files that others can
+// access are refused.
+func NewFileKeyStore(dir string) KeyStore {
+	return fileKeyStore{dir: dir}
+}
+
+// path returns the name of the key file of an interface
+func (s fileKeyStore) path(interfaceName string) (string, error) {
+	if interfaceName == "" || interfaceName == "." || interfaceName == ".." || strings.ContainsRune(interfaceName, os.PathSeparator) {
+		return "", fmt.Errorf("invalid interface name %q", interfaceName)
+	}
+	return filepath.Join(s.dir, interfaceName+".key"), nil
+}
+
+func (s fileKeyStore) Load(interfaceName string) (string, error) {
+	path, err := s.path(interfaceName)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, path)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("key file %s is accessible by others (mode %s)", path, fi.Mode().Perm())
+	}
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (s fileKeyStore) Store(interfaceName string, key string) error {
+	path, err := s.path(interfaceName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	// write to a temporary file (created with 0600) and rename it
+	f, err := ioutil.TempFile(s.dir, "."+interfaceName+".key.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(key + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	// persist the rename as well
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// envKeyStore reads keys from environment variables
+type envKeyStore struct {
+	prefix string
+}
+
+// NewEnvKeyStore returns a read-only KeyStore that takes the key of an
+// interface from an environment variable named prefix followed by the
+// interface name in upper case, with characters other than letters and
+// digits replaced by '_'. E.g. with prefix "WG_PRIVATE_KEY_", the key of
+// wg-hub0 is in WG_PRIVATE_KEY_WG_HUB0. Store fails with
+// ErrKeyStoreReadOnly.
+func NewEnvKeyStore(prefix string) KeyStore {
+	return envKeyStore{prefix: prefix}
+}
+
+// variable returns the name of the environment variable of an interface
+func (s envKeyStore) variable(interfaceName string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, interfaceName)
+	return s.prefix + strings.ToUpper(name)
+}
+
+func (s envKeyStore) Load(interfaceName string) (string, error) {
+	v := s.variable(interfaceName)
+	key, ok := os.LookupEnv(v)
+	if !ok || key == "" {
+		return "", fmt.Errorf("%w: $%s is not set", ErrKeyNotFound, v)
+	}
+	return strings.TrimSpace(key), nil
+}
+
+func (s envKeyStore) Store(interfaceName string, key string) error {
+	return fmt.Errorf("%w: cannot set $%s", ErrKeyStoreReadOnly, s.variable(interfaceName))
+}
+
+// encryptedKeyStore encrypts keys before passing them to another KeyStore
+type encryptedKeyStore struct {
+	store      KeyStore
+	passphrase []byte
+}
+
+// encryptedKeyPrefix marks keys encrypted by encryptedKeyStore, and the
+// version of the format: scrypt (N=32768, r=8, p=1) derives an AES-256-GCM
+// key from the passphrase and a random salt. The key is stored as the
+// prefix followed by base64 of salt, nonce and sealed private key.
+const encryptedKeyPrefix = "wgenc1:"
+
+const encryptedKeySaltSize = 16
+
+// NewEncryptedKeyStore returns a KeyStore that encrypts keys with a key
+// derived from passphrase, and keeps them in store, e.g. one returned by
+// NewFileKeyStore. Keys that cannot be decrypted fail to load.
+func NewEncryptedKeyStore(store KeyStore, passphrase []byte) KeyStore {
+	return encryptedKeyStore{
+		store:      store,
+		passphrase: append([]byte{}, passphrase...),
+	}
+}
+
+// aead returns the cipher for a salt
+func (s encryptedKeyStore) aead(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(s.passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s encryptedKeyStore) Load(interfaceName string) (string, error) {
+	stored, err := s.store.Load(interfaceName)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(stored, encryptedKeyPrefix) {
+		return "", errors.New("stored key is not encrypted")
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedKeyPrefix))
+	if err != nil {
+		return "", fmt.Errorf("stored key is malformed: %w", err)
+	}
+	if len(b) < encryptedKeySaltSize {
+		return "", errors.New("stored key is malformed")
+	}
+
+	aead, err := s.aead(b[:encryptedKeySaltSize])
+	if err != nil {
+		return "", err
+	}
+	b = b[encryptedKeySaltSize:]
+	if len(b) < aead.NonceSize() {
+		return "", errors.New("stored key is malformed")
+	}
+	key, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(interfaceName))
+	if err != nil {
+		return "", errors.New("unable to decrypt stored key, wrong passphrase?")
+	}
+	if len(key) != wgtypes.KeyLen {
+		return "", errors.New("stored key is malformed")
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func (s encryptedKeyStore) Store(interfaceName string, key string) error {
+	k, err := wgtypes.ParseKey(key)
+	if err != nil {
+		return invalidKey(err)
+	}
+
+	salt := make([]byte, encryptedKeySaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	aead, err := s.aead(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	// the interface name is authenticated, so keys cannot be swapped
+	b := append(salt, nonce...)
+	b = aead.Seal(b, nonce, k[:], []byte(interfaceName))
+	return s.store.Store(interfaceName, encryptedKeyPrefix+base64.StdEncoding.EncodeToString(b))
+}
@@ -0,0 +1,219 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestFileKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgwrapper")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ks := NewFileKeyStore(filepath.Join(dir, "keys"))
+
+	if _, err := ks.Load("wg0"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Load of missing key should fail with ErrKeyNotFound, got: %v", err)
+	}
+
+	key, _ := wgtypes.GeneratePrivateKey()
+	if err := ks.Store("wg0", key.String()); err != nil {
+		t.Fatalf("Unable to store key: %s", err)
+	}
+	if k, err := ks.Load("wg0"); err != nil || k != key.String() {
+		t.Errorf("Unexpected key loaded: %s, %v", k, err)
+	}
+
+	// replacing a key leaves no temporary files behind
+	key2, _ := wgtypes.GeneratePrivateKey()
+	if err := ks.Store("wg0", key2.String()); err != nil {
+		t.Fatalf("Unable to store key: %s", err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "keys"))
+	if len(files) != 1 || files[0].Name() != "wg0.key" || files[0].Mode().Perm() != 0600 {
+		t.Errorf("Expected a single key file with mode 0600, got %v", files)
+	}
+	if k, err := ks.Load("wg0"); err != nil || k != key2.String() {
+		t.Errorf("Unexpected key loaded: %s, %v", k, err)
+	}
+
+	os.Chmod(filepath.Join(dir, "keys", "wg0.key"), 0644)
+	if _, err := ks.Load("wg0"); err == nil {
+		t.Errorf("Load of key file accessible by others should fail")
+	}
+
+	for _, name := range []string{"", "..", "../wg0"} {
+		if err := ks.Store(name, key.String()); err == nil {
+			t.Errorf("Store with interface name %q should fail", name)
+		}
+	}
+}
+
+func TestEnvKeyStore(t *testing.T) {
+	ks := NewEnvKeyStore("WGWRAPPER_TEST_KEY_")
+	key, _ := wgtypes.GeneratePrivateKey()
+
+	os.Setenv("WGWRAPPER_TEST_KEY_WG_HUB0", key.String()+"\n")
+	defer os.Unsetenv("WGWRAPPER_TEST_KEY_WG_HUB0")
+
+	if k, err := ks.Load("wg-hub0"); err != nil || k != key.String() {
+		t.Errorf("Unexpected key loaded: %s, %v", k, err)
+	}
+	if _, err := ks.Load("wg1"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Load of missing key should fail with ErrKeyNotFound, got: %v", err)
+	}
+	if err := ks.Store("wg1", key.String()); !errors.Is(err, ErrKeyStoreReadOnly) {
+		t.Errorf("Store should fail with ErrKeyStoreReadOnly, got: %v", err)
+	}
+}
+
+// mapKeyStore keeps keys in memory
+type mapKeyStore map[string]string
+
+func (s mapKeyStore) Load(interfaceName string) (string, error) {
+	k, ok := s[interfaceName]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return k, nil
+}
+
+func (s mapKeyStore) Store(interfaceName string, key string) error {
+	s[interfaceName] = key
+	return nil
+}
+
+func TestEncryptedKeyStore(t *testing.T) {
+	inner := mapKeyStore{}
+	ks := NewEncryptedKeyStore(inner, []byte("secret"))
+	key, _ := wgtypes.GeneratePrivateKey()
+
+	if err := ks.Store("wg0", key.String()); err != nil {
+		t.Fatalf("Unable to store key: %s", err)
+	}
+	if !strings.HasPrefix(inner["wg0"], encryptedKeyPrefix) || strings.Contains(inner["wg0"], key.String()) {
+		t.Errorf("Expected key to be encrypted, got %s", inner["wg0"])
+	}
+	if k, err := ks.Load("wg0"); err != nil || k != key.String() {
+		t.Errorf("Unexpected key loaded: %s, %v", k, err)
+	}
+
+	if _, err := NewEncryptedKeyStore(inner, []byte("wrong")).Load("wg0"); err == nil {
+		t.Errorf("Load with wrong passphrase should fail")
+	}
+	inner["wg1"] = inner["wg0"]
+	if _, err := ks.Load("wg1"); err == nil {
+		t.Errorf("Load of key stored for another interface should fail")
+	}
+	inner["wg2"] = key.String()
+	if _, err := ks.Load("wg2"); err == nil {
+		t.Errorf("Load of unencrypted key should fail")
+	}
+	if _, err := ks.Load("wg3"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Load of missing key should fail with ErrKeyNotFound, got: %v", err)
+	}
+	if err := ks.Store("wg0", "invalid"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Store of invalid key should fail with ErrInvalidKey, got: %v", err)
+	}
+}
+
+func TestConfigureKeyStore(t *testing.T) {
+	k := newMemoryKernel()
+	ks := mapKeyStore{}
+	wg := newInMemory(k, k, WithKeyStore(ks))
+	wgi := newWGIntf()
+	wgi.ListenPort = 46534
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+
+	// a generated key is stored
+	if err := wg.Configure(&wgi); err != nil {
+		t.Fatalf("Unable to execute Configure: %s", err)
+	}
+	stored, err := wgtypes.ParseKey(ks[wgi.InterfaceName])
+	if err != nil || stored.PublicKey().String() != wgi.PublicKey {
+		t.Fatalf("Expected key of interface to be stored, got %s", ks[wgi.InterfaceName])
+	}
+
+	// and used when the interface is created again
+	pk := wgi.PublicKey
+	if err := wg.DeleteInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute DeleteInterface: %s", err)
+	}
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	wgi.PublicKey = ""
+	if err := wg.Configure(&wgi); err != nil || wgi.PublicKey != pk {
+		t.Errorf("Expected stored key to be used: %s, %v", wgi.PublicKey, err)
+	}
+
+	// rotated keys are stored
+	if err := wg.RotateKey(&wgi); err != nil {
+		t.Fatalf("Unable to execute RotateKey: %s", err)
+	}
+	stored, _ = wgtypes.ParseKey(ks[wgi.InterfaceName])
+	if stored.PublicKey().String() != wgi.PublicKey {
+		t.Errorf("Expected rotated key to be stored")
+	}
+
+	// a given key must match the stored one
+	other, _ := wgtypes.GeneratePrivateKey()
+	wgi.PrivateKey = other.String()
+	if err := wg.Configure(&wgi); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("Configure with a key other than the stored one should fail with ErrKeyMismatch, got: %v", err)
+	}
+
+	// a key that cannot be stored is not used
+	wg = newInMemory(k, k, WithKeyStore(NewEnvKeyStore("WGWRAPPER_TEST_KEY_")))
+	wgi2 := newWGIntf()
+	wgi2.ListenPort = 46535
+	if err := wg.AddInterface(wgi2); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := wg.Configure(&wgi2); !errors.Is(err, ErrKeyStoreReadOnly) {
+		t.Errorf("Configure with read-only key store should fail with ErrKeyStoreReadOnly, got: %v", err)
+	}
+	if k.links[wgi2.InterfaceName].device.PrivateKey != (wgtypes.Key{}) {
+		t.Errorf("Expected interface to be left without key")
+	}
+}
+
+func TestConfigureKeyStoreFailure(t *testing.T) {
+	k := newMemoryKernel()
+	c := &failingClient{wgClient: k, skip: 0}
+	ks := mapKeyStore{}
+	wg := newInMemory(k, c, WithKeyStore(ks))
+	wgi := newWGIntf()
+	wgi.ListenPort = 46534
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+
+	// the device refuses the generated key, it is not stored
+	if err := wg.Configure(&wgi); err == nil {
+		t.Fatal("Configure should fail but did not")
+	}
+	if _, ok := ks[wgi.InterfaceName]; ok {
+		t.Errorf("Expected key refused by the device not to be stored")
+	}
+
+	// the stored key is the one of the device
+	c.skip = -1
+	if err := wg.Configure(&wgi); err != nil {
+		t.Fatalf("Unable to execute Configure: %s", err)
+	}
+	if ks[wgi.InterfaceName] != k.links[wgi.InterfaceName].device.PrivateKey.String() {
+		t.Errorf("Expected key of the device to be stored")
+	}
+}
@@ -0,0 +1,187 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// linkAttrs returns the link attributes given by intf. Zero
+// values stand for attributes that are left as they are.
+func (intf WireguardInterface) linkAttrs() linkAttrs {
+	return linkAttrs{
+		MTU:        intf.MTU,
+		TxQueueLen: intf.TxQueueLen,
+		Alias:      intf.Alias,
+	}
+}
+
+// validLinkAttrs checks the attributes given by an
+// interface or spec, and its firewall mark
+func validLinkAttrs(a linkAttrs, fwmark int) error {
+	if a.MTU != 0 && a.MTU != AutoMTU && (a.MTU < 68 || a.MTU > 65535) {
+		return fmt.Errorf("invalid mtu %d", a.MTU)
+	}
+	if a.TxQueueLen < 0 {
+		return fmt.Errorf("invalid txqueuelen %d", a.TxQueueLen)
+	}
+	if len(a.Alias) >= 256 {
+		return errors.New("alias too long")
+	}
+	if fwmark < 0 || int64(fwmark) > 0xffffffff {
+		return fmt.Errorf("invalid firewall mark %d", fwmark)
+	}
+	return nil
+}
+
+// linkAttrChange is a single attribute of a link that differs
+// from the desired one, along with the ways to change and restore it
+type linkAttrChange struct {
+	FieldChange
+	apply  func(wg wgwrapper, name string) error
+	revert func(wg wgwrapper, name string) error
+}
+
+// diffLinkAttrs compares the attributes of a link with the desired
+// ones. Attributes with a zero desired value are not compared.
+func diffLinkAttrs(current, desired linkAttrs) []linkAttrChange {
+	itoa := func(v int) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.Itoa(v)
+	}
+
+	res := []linkAttrChange{}
+	if desired.MTU != 0 && desired.MTU != current.MTU {
+		before, after := current.MTU, desired.MTU
+		res = append(res, linkAttrChange{
+			FieldChange: FieldChange{Field: "mtu", Before: itoa(before), After: itoa(after)},
+			apply: func(wg wgwrapper, name string) error {
+				return wg.backend.LinkSetMTU(wg.context(), name, after)
+			},
+			revert: func(wg wgwrapper, name string) error {
+				return wg.backend.LinkSetMTU(wg.context(), name, before)
+			},
+		})
+	}
+	if desired.TxQueueLen != 0 && desired.TxQueueLen != current.TxQueueLen {
+		before, after := current.TxQueueLen, desired.TxQueueLen
+		res = append(res, linkAttrChange{
+			FieldChange: FieldChange{Field: "txqueuelen", Before: itoa(before), After: itoa(after)},
+			apply: func(wg wgwrapper, name string) error {
+				return wg.backend.LinkSetTxQueueLen(wg.context(), name, after)
+			},
+			revert: func(wg wgwrapper, name string) error {
+				return wg.backend.LinkSetTxQueueLen(wg.context(), name, before)
+			},
+		})
+	}
+	if desired.Alias != "" && desired.Alias != current.Alias {
+		before, after := current.Alias, desired.Alias
+		res = append(res, linkAttrChange{
+			FieldChange: FieldChange{Field: "alias", Before: before, After: after},
+			apply: func(wg wgwrapper, name string) error {
+				return wg.backend.LinkSetAlias(wg.context(), name, after)
+			},
+			revert: func(wg wgwrapper, name string) error {
+				return wg.backend.LinkSetAlias(wg.context(), name, before)
+			},
+		})
+	}
+	return res
+}
+
+// setLinkAttrs applies the MTU, transmit queue length and alias of
+// intf to its link, if given. AutoMTU is replaced by the MTU derived
+// from the underlay. The undoFunc restores the previous ones.
+func (wg wgwrapper) setLinkAttrs(intf WireguardInterface) (undoFunc, error) {
+	want := intf.linkAttrs()
+	if want == (linkAttrs{}) {
+		return nil, nil
+	}
+	if err := validLinkAttrs(want, 0); err != nil {
+		return nil, wrapError("set link attributes", intf.InterfaceName, err)
+	}
+	if want.MTU == AutoMTU {
+		mtu, err := wg.DeriveMTU(intf)
+		if err != nil {
+			return nil, err
+		}
+		want.MTU = mtu
+	}
+
+	current, err := wg.backend.LinkAttrs(wg.context(), intf.InterfaceName)
+	if err != nil {
+		return nil, wrapError("set link attributes", intf.InterfaceName, err)
+	}
+	return wg.applyLinkAttrs(intf.InterfaceName, diffLinkAttrs(current, want))
+}
+
+// applyLinkAttrs applies changes to link name. The undoFunc reverts
+// those applied, it is also returned if one fails.
+func (wg wgwrapper) applyLinkAttrs(name string, changes []linkAttrChange) (undoFunc, error) {
+	// undo is set as soon as an attribute has been changed
+	var undo undoFunc
+	applied := []linkAttrChange{}
+	for _, c := range changes {
+		if err := c.apply(wg, name); err != nil {
+			return undo, wrapError("set "+c.Field, name, err)
+		}
+		applied = append(applied, c)
+		undo = func(wg wgwrapper) error {
+			for idx := len(applied) - 1; idx >= 0; idx-- {
+				if err := applied[idx].revert(wg, name); err != nil {
+					return wrapError("set "+applied[idx].Field, name, err)
+				}
+			}
+			return nil
+		}
+	}
+	return undo, nil
+}
+
+// GetInterface reads back an existing interface: its addresses, listen
+// port, public key, firewall mark, MTU, transmit queue length and alias.
+// The private key is not included. Fails with ErrInterfaceNotFound if
+// there is no such interface.
+func (wg wgwrapper) GetInterface(interfaceName string) (WireguardInterface, error) {
+	res := WireguardInterface{InterfaceName: interfaceName}
+
+	attrs, err := wg.backend.LinkAttrs(wg.context(), interfaceName)
+	if err != nil {
+		return res, wrapError("query interface", interfaceName, err)
+	}
+	res.MTU = attrs.MTU
+	res.TxQueueLen = attrs.TxQueueLen
+	res.Alias = attrs.Alias
+
+	res.Addresses, err = wg.backend.AddrList(wg.context(), interfaceName)
+	if err != nil {
+		return res, wrapError("list addresses", interfaceName, err)
+	}
+	if len(res.Addresses) > 0 {
+		res.IP = res.Addresses[0]
+	}
+
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return res, wrapError("query interface", interfaceName, err)
+	}
+	defer wgClient.Close()
+
+	wgDevice, err := wgClient.Device(interfaceName)
+	if err != nil {
+		return res, wrapError("query interface", interfaceName, err)
+	}
+	res.ListenPort = wgDevice.ListenPort
+	res.FirewallMark = wgDevice.FirewallMark
+	if wgDevice.PublicKey != (wgtypes.Key{}) {
+		res.PublicKey = wgDevice.PublicKey.String()
+	}
+	return res, nil
+}
@@ -0,0 +1,60 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLinkAttrsRollback(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+
+	// attributes are set before the invalid address fails
+	wgi.MTU = 1380
+	wgi.TxQueueLen = 500
+	wgi.Alias = "test tunnel"
+	wgi.Addresses = []net.IPNet{wgi.IP, {IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(24, 32)}}
+	if err := wg.AddInterface(wgi); err == nil {
+		t.Fatal("AddInterface with invalid address should fail but did not")
+	}
+
+	r, err := wg.GetInterface(wgi.InterfaceName)
+	if err != nil {
+		t.Fatalf("Unable to execute GetInterface: %s", err)
+	}
+	if r.MTU != 1420 || r.TxQueueLen != 1000 || r.Alias != "" {
+		t.Errorf("Failed AddInterface should restore link attributes, got: %#v", r)
+	}
+}
+
+func TestConfigureFirewallMarkRollback(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	wgi.ListenPort = 46537
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+
+	tx := wg.Begin()
+	wgi.FirewallMark = 51820
+	if err := tx.Configure(&wgi); err != nil {
+		t.Fatalf("Unable to execute Configure: %s", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Unable to execute Rollback: %s", err)
+	}
+	r, err := wg.GetInterface(wgi.InterfaceName)
+	if err != nil || r.FirewallMark != 0 || r.ListenPort != 0 {
+		t.Errorf("Rollback should restore firewall mark and port: %#v, %v", r, err)
+	}
+
+	wgi.FirewallMark = -1
+	if err := wg.Configure(&wgi); err == nil {
+		t.Error("Configure with invalid firewall mark should fail but did not")
+	}
+}
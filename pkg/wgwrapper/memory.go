@@ -0,0 +1,744 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// memoryLink is a wireguard link held by memoryKernel
+type memoryLink struct {
+	up     bool
+	attrs  linkAttrs
+	addrs  []net.IPNet
+	routes []Route
+	device wgtypes.Device
+}
+
+// memoryKernel simulates the parts of the kernel that wgwrapper
+// talks to: links, addresses and routes (as linkBackend) and
+// wireguard devices (as wgClient). It is safe for concurrent use.
+type memoryKernel struct {
+	mu    sync.Mutex
+	links map[string]*memoryLink
+	// defaultRouteInterface is reported by DefaultRouteInterface
+	defaultRouteInterface string
+	// underlay holds the attributes of links other than wireguard
+	// ones, such as the one behind the default route. They are only
+	// visible to LinkAttrs.
+	underlay map[string]linkAttrs
+}
+
+// NewInMemory sets up a WireguardWrapper that does not touch the
+// system. It keeps interfaces, addresses, keys, peers and routes
+// in memory and behaves like New() otherwise, including errors.
+// Intended as a test double for code that uses WireguardWrapper.
+// Takes the options of New, those that select how the system is
+// accessed (WithIPCommand, WithIPPath, WithCommandRunner, WithNetlink
+// and WithWireguardClient) are ignored.
+func NewInMemory(opts ...Option) WireguardWrapper {
+	k := newMemoryKernel()
+	return newInMemory(k, k, opts...)
+}
+
+// newInMemory returns an in-memory wrapper of kernel k, whose
+// devices are accessed via c, usually k itself
+func newInMemory(k *memoryKernel, c wgClient, opts ...Option) wgwrapper {
+	return newOptions(opts).wrapper(k, c)
+}
+
+func newMemoryKernel() *memoryKernel {
+	return &memoryKernel{
+		links:                 map[string]*memoryLink{},
+		defaultRouteInterface: "eth0",
+		underlay: map[string]linkAttrs{
+			"eth0": {MTU: 1500, TxQueueLen: 1000},
+		},
+	}
+}
+
+// errno wraps a syscall error the same way rtnetlink does
+func (k *memoryKernel) errno(e unix.Errno) error {
+	return &netlink.OpError{
+		Op:  "receive",
+		Err: e,
+	}
+}
+
+// link returns a link by name or ENODEV. Callers must hold k.mu
+func (k *memoryKernel) link(name string) (*memoryLink, error) {
+	l, ok := k.links[name]
+	if !ok {
+		return nil, k.errno(unix.ENODEV)
+	}
+	return l, nil
+}
+
+func (k *memoryKernel) LinkExists(ctx context.Context, name string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	_, ok := k.links[name]
+	return ok, nil
+}
+
+func (k *memoryKernel) LinkAdd(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.links[name]; ok {
+		return k.errno(unix.EEXIST)
+	}
+	if len(name) == 0 || len(name) >= unix.IFNAMSIZ || strings.ContainsAny(name, "/: \t\n") {
+		return k.errno(unix.EINVAL)
+	}
+
+	k.links[name] = &memoryLink{
+		// defaults of the wireguard module
+		attrs:  linkAttrs{MTU: 1420, TxQueueLen: 1000},
+		addrs:  []net.IPNet{},
+		routes: []Route{},
+		device: wgtypes.Device{
+			Name:  name,
+			Type:  wgtypes.LinuxKernel,
+			Peers: []wgtypes.Peer{},
+		},
+	}
+	return nil
+}
+
+func (k *memoryKernel) LinkDelete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, err := k.link(name); err != nil {
+		return err
+	}
+	delete(k.links, name)
+	return nil
+}
+
+func (k *memoryKernel) LinkIsUp(ctx context.Context, name string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.link(name)
+	if err != nil {
+		return false, err
+	}
+	return l.up, nil
+}
+
+func (k *memoryKernel) LinkSetUp(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.link(name)
+	if err != nil {
+		return err
+	}
+	if !l.up {
+		l.up = true
+		for _, a := range l.addrs {
+			l.addPrefixRoute(a)
+		}
+	}
+	return nil
+}
+
+func (k *memoryKernel) LinkSetDown(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.link(name)
+	if err != nil {
+		return err
+	}
+
+	// like the kernel, drop all routes via a link that goes down
+	l.up = false
+	l.routes = []Route{}
+	return nil
+}
+
+func (k *memoryKernel) LinkAttrs(ctx context.Context, name string) (linkAttrs, error) {
+	if err := ctx.Err(); err != nil {
+		return linkAttrs{}, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if a, ok := k.underlay[name]; ok {
+		return a, nil
+	}
+	l, err := k.link(name)
+	if err != nil {
+		return linkAttrs{}, err
+	}
+	return l.attrs, nil
+}
+
+func (k *memoryKernel) LinkSetMTU(ctx context.Context, name string, mtu int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.link(name)
+	if err != nil {
+		return err
+	}
+	if mtu < 68 || mtu > 65535 {
+		return k.errno(unix.EINVAL)
+	}
+	l.attrs.MTU = mtu
+	return nil
+}
+
+func (k *memoryKernel) LinkSetTxQueueLen(ctx context.Context, name string, qlen int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.link(name)
+	if err != nil {
+		return err
+	}
+	if qlen < 0 {
+		return k.errno(unix.EINVAL)
+	}
+	l.attrs.TxQueueLen = qlen
+	return nil
+}
+
+func (k *memoryKernel) LinkSetAlias(ctx context.Context, name string, alias string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.link(name)
+	if err != nil {
+		return err
+	}
+	if len(alias) >= 256 { // IFALIASZ
+		return k.errno(unix.EINVAL)
+	}
+	l.attrs.Alias = alias
+	return nil
+}
+
+// addPrefixRoute adds the route to the network of an address,
+// as the kernel does for addresses on links that are up
+func (l *memoryLink) addPrefixRoute(a net.IPNet) {
+	ones, bits := a.Mask.Size()
+	if ones == bits {
+		return
+	}
+	r := Route{
+		Dst: net.IPNet{
+			IP:   a.IP.Mask(a.Mask),
+			Mask: a.Mask,
+		},
+		Scope:    ScopeLink,
+		Protocol: "kernel",
+	}
+	if a.IP.To4() != nil {
+		r.Src = a.IP
+	} else {
+		r.Scope, r.Metric = ScopeGlobal, 256
+	}
+	if indexOfRoute(l.routes, r) == -1 {
+		l.routes = append(l.routes, r)
+	}
+}
+
+// indexOfRoute returns the position of the route with the
+// destination, table and metric of r, or -1
+func indexOfRoute(a []Route, r Route) int {
+	for idx, e := range a {
+		if e.sameKey(r) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// hasAddr checks if ip is an address of any link
+func (k *memoryKernel) hasAddr(ip net.IP) bool {
+	for _, l := range k.links {
+		for _, a := range l.addrs {
+			if a.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// indexOfIPNet returns the position of n in a, or -1
+func indexOfIPNet(a []net.IPNet, n net.IPNet) int {
+	for idx, e := range a {
+		if e.String() == n.String() {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (k *memoryKernel) AddrList(ctx context.Context, name string) ([]net.IPNet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.link(name)
+	if err != nil {
+		return nil, err
+	}
+	return append([]net.IPNet{}, l.addrs...), nil
+}
+
+func (k *memoryKernel) AddrAdd(ctx context.Context, name string, addr net.IPNet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.link(name)
+	if err != nil {
+		return err
+	}
+	if addr.IP == nil || addr.Mask == nil {
+		return k.errno(unix.EINVAL)
+	}
+
+	a := net.IPNet{
+		IP:   normalizeIP(addr.IP),
+		Mask: addr.Mask,
+	}
+	if indexOfIPNet(l.addrs, a) != -1 {
+		return k.errno(unix.EEXIST)
+	}
+	l.addrs = append(l.addrs, a)
+	if l.up {
+		l.addPrefixRoute(a)
+	}
+	return nil
+}
+
+func (k *memoryKernel) AddrDel(ctx context.Context, name string, addr net.IPNet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.link(name)
+	if err != nil {
+		return err
+	}
+
+	a := net.IPNet{
+		IP:   normalizeIP(addr.IP),
+		Mask: addr.Mask,
+	}
+	idx := indexOfIPNet(l.addrs, a)
+	if idx == -1 {
+		return k.errno(unix.EADDRNOTAVAIL)
+	}
+	l.addrs = append(l.addrs[:idx], l.addrs[idx+1:]...)
+
+	// the prefix route goes with the last address of the network
+	dst := net.IPNet{
+		IP:   a.IP.Mask(a.Mask),
+		Mask: a.Mask,
+	}
+	for _, other := range l.addrs {
+		if other.Contains(dst.IP) && other.Mask.String() == dst.Mask.String() {
+			return nil
+		}
+	}
+	for ridx, r := range l.routes {
+		if r.Protocol == "kernel" && r.Dst.String() == dst.String() {
+			l.routes = append(l.routes[:ridx], l.routes[ridx+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (k *memoryKernel) RouteList(ctx context.Context, name string, family uint8, table int) ([]Route, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.link(name)
+	if err != nil {
+		return nil, err
+	}
+	res := []Route{}
+	for _, r := range l.routes {
+		if familyOf(r.Dst.IP) == family && (table == routeTableAll || r.Table == table) {
+			res = append(res, r)
+		}
+	}
+	return res, nil
+}
+
+// routeChange checks that route r can be set via link name,
+// and returns the link with the position of r's key in its routes
+func (k *memoryKernel) routeChange(ctx context.Context, name string, r Route) (*memoryLink, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, -1, err
+	}
+
+	l, err := k.link(name)
+	if err != nil {
+		return nil, -1, err
+	}
+	if !l.up {
+		return nil, -1, k.errno(unix.ENETDOWN)
+	}
+	if r.Src != nil && !k.hasAddr(normalizeIP(r.Src)) {
+		return nil, -1, k.errno(unix.EINVAL)
+	}
+	return l, indexOfRoute(l.routes, r), nil
+}
+
+// storedRoute returns r as listed by the kernel
+func storedRoute(r Route) Route {
+	r = r.normalize()
+	switch {
+	case r.Dst.IP.To4() == nil:
+		// IPv6 routes have no scope
+		r.Scope = ScopeGlobal
+	case r.Scope == "":
+		r.Scope = ScopeLink
+	}
+	if r.Protocol == "" {
+		r.Protocol = "boot"
+	}
+	return r
+}
+
+func (k *memoryKernel) RouteAdd(ctx context.Context, name string, r Route) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, idx, err := k.routeChange(ctx, name, r)
+	if err != nil {
+		return err
+	}
+	if idx != -1 {
+		return k.errno(unix.EEXIST)
+	}
+	l.routes = append(l.routes, storedRoute(r))
+	return nil
+}
+
+func (k *memoryKernel) RouteReplace(ctx context.Context, name string, r Route) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, idx, err := k.routeChange(ctx, name, r)
+	if err != nil {
+		return err
+	}
+	if idx == -1 {
+		l.routes = append(l.routes, storedRoute(r))
+	} else {
+		l.routes[idx] = storedRoute(r)
+	}
+	return nil
+}
+
+func (k *memoryKernel) RouteDel(ctx context.Context, name string, r Route) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.link(name)
+	if err != nil {
+		return err
+	}
+	idx := indexOfRoute(l.routes, r)
+	if idx == -1 {
+		return k.errno(unix.ESRCH)
+	}
+	l.routes = append(l.routes[:idx], l.routes[idx+1:]...)
+	return nil
+}
+
+func (k *memoryKernel) DefaultRouteInterface(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	return k.defaultRouteInterface, nil
+}
+
+// RouteGet picks the route with the longest prefix containing ip,
+// or the default route
+func (k *memoryKernel) RouteGet(ctx context.Context, ip net.IP) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	res, best := k.defaultRouteInterface, -1
+	for name, l := range k.links {
+		for _, r := range l.routes {
+			if ones, _ := r.Dst.Mask.Size(); r.Table == 0 && ones > best && r.Dst.Contains(ip) {
+				res, best = name, ones
+			}
+		}
+	}
+	if res == "" {
+		return "", k.errno(unix.ENETUNREACH)
+	}
+	return res, nil
+}
+
+// Device returns a copy of the wireguard device, like wgctrl does
+func (k *memoryKernel) Device(name string) (*wgtypes.Device, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, ok := k.links[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	d := l.device
+	d.Peers = make([]wgtypes.Peer, len(l.device.Peers))
+	for idx, p := range l.device.Peers {
+		d.Peers[idx] = copyPeer(p)
+	}
+	return &d, nil
+}
+
+func copyPeer(p wgtypes.Peer) wgtypes.Peer {
+	res := p
+	if p.Endpoint != nil {
+		ep := *p.Endpoint
+		res.Endpoint = &ep
+	}
+	res.AllowedIPs = append([]net.IPNet{}, p.AllowedIPs...)
+	return res
+}
+
+// ConfigureDevice applies cfg with the semantics of the kernel module
+func (k *memoryKernel) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, ok := k.links[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	d := &l.device
+
+	// like the kernel, reject the configuration before anything
+	// is changed, so that it is applied as a whole or not at all
+	if err := k.validDeviceConfig(name, cfg); err != nil {
+		return err
+	}
+
+	if cfg.PrivateKey != nil {
+		d.PrivateKey = *cfg.PrivateKey
+		if d.PrivateKey == (wgtypes.Key{}) {
+			d.PublicKey = wgtypes.Key{}
+		} else {
+			d.PublicKey = d.PrivateKey.PublicKey()
+		}
+	}
+	if cfg.ListenPort != nil {
+		d.ListenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		d.FirewallMark = *cfg.FirewallMark
+	}
+	if cfg.ReplacePeers {
+		d.Peers = []wgtypes.Peer{}
+	}
+
+	// index peers by key and networks by owner, so that large
+	// configurations are applied in linear time
+	index := make(map[wgtypes.Key]int, len(d.Peers))
+	owner := map[string]int{}
+	for i, p := range d.Peers {
+		index[p.PublicKey] = i
+		for _, a := range p.AllowedIPs {
+			owner[a.String()] = i
+		}
+	}
+	removed := map[int]bool{}
+
+	for _, pc := range cfg.Peers {
+		idx, ok := index[pc.PublicKey]
+
+		if pc.Remove {
+			if ok {
+				for _, a := range d.Peers[idx].AllowedIPs {
+					delete(owner, a.String())
+				}
+				delete(index, pc.PublicKey)
+				removed[idx] = true
+			}
+			continue
+		}
+		if !ok {
+			if pc.UpdateOnly {
+				continue
+			}
+			d.Peers = append(d.Peers, wgtypes.Peer{
+				PublicKey:       pc.PublicKey,
+				AllowedIPs:      []net.IPNet{},
+				ProtocolVersion: 1,
+			})
+			idx = len(d.Peers) - 1
+			index[pc.PublicKey] = idx
+		}
+		p := &d.Peers[idx]
+
+		if pc.PresharedKey != nil {
+			p.PresharedKey = *pc.PresharedKey
+		}
+		if pc.Endpoint != nil {
+			ep := *pc.Endpoint
+			p.Endpoint = &ep
+		}
+		if pc.PersistentKeepaliveInterval != nil {
+			p.PersistentKeepaliveInterval = pc.PersistentKeepaliveInterval.Truncate(time.Second)
+		}
+		if pc.ReplaceAllowedIPs {
+			for _, a := range p.AllowedIPs {
+				delete(owner, a.String())
+			}
+			p.AllowedIPs = []net.IPNet{}
+		}
+		for _, a := range pc.AllowedIPs {
+			k.addAllowedIP(d, owner, idx, a)
+		}
+	}
+
+	if len(removed) > 0 {
+		peers := make([]wgtypes.Peer, 0, len(d.Peers)-len(removed))
+		for i, p := range d.Peers {
+			if !removed[i] {
+				peers = append(peers, p)
+			}
+		}
+		d.Peers = peers
+	}
+
+	return nil
+}
+
+// validDeviceConfig checks the configuration of device name: the listen
+// port must be valid and not be used by another device, allowed IPs
+// must be networks of their family. Callers must hold k.mu
+func (k *memoryKernel) validDeviceConfig(name string, cfg wgtypes.Config) error {
+	if cfg.ListenPort != nil {
+		port := *cfg.ListenPort
+		if port < 0 || port > 65535 {
+			return unix.EINVAL
+		}
+		for n, l := range k.links {
+			if n != name && port != 0 && l.device.ListenPort == port {
+				return unix.EADDRINUSE
+			}
+		}
+	}
+	for _, pc := range cfg.Peers {
+		for _, a := range pc.AllowedIPs {
+			ones, _ := a.Mask.Size()
+			bits := 8 * len(normalizeIP(a.IP))
+			if bits == 0 || ones > bits {
+				return unix.EINVAL
+			}
+		}
+	}
+	return nil
+}
+
+// addAllowedIP assigns a network to a peer. As with the kernel's
+// cryptokey routing table, a network belongs to at most one peer
+// of a device, so it is taken away from any other peer. owner
+// maps networks to the index of the peer they belong to.
+func (k *memoryKernel) addAllowedIP(d *wgtypes.Device, owner map[string]int, idx int, a net.IPNet) {
+	n := net.IPNet{
+		IP:   normalizeIP(a.IP).Mask(a.Mask),
+		Mask: a.Mask,
+	}
+	key := n.String()
+	if i, ok := owner[key]; ok {
+		if i == idx {
+			return
+		}
+		j := indexOfIPNet(d.Peers[i].AllowedIPs, n)
+		d.Peers[i].AllowedIPs = append(d.Peers[i].AllowedIPs[:j], d.Peers[i].AllowedIPs[j+1:]...)
+	}
+	owner[key] = idx
+	d.Peers[idx].AllowedIPs = append(d.Peers[idx].AllowedIPs, n)
+}
+
+// Close does nothing, the kernel stays around
+func (k *memoryKernel) Close() error {
+	return nil
+}
@@ -0,0 +1,222 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// AutoMTU as MTU of a WireguardInterface or InterfaceSpec derives
+// the MTU from the underlay, see DeriveMTU
+const AutoMTU = -1
+
+const (
+	// overhead of wireguard packets: outer IP header, UDP header
+	// and wireguard data message header
+	wireguardOverheadIPv4 = 20 + 8 + 32
+	wireguardOverheadIPv6 = 40 + 8 + 32
+
+	// defaultUnderlayMTU is assumed if no underlay link is found
+	defaultUnderlayMTU = 1500
+
+	// defaultMTUInterval is the default time between two
+	// evaluations of the underlay by WatchMTU
+	defaultMTUInterval = time.Minute
+)
+
+// MTUWatcher controls the re-evaluation of the MTU of an
+// interface by WatchMTU
+type MTUWatcher struct {
+	// Interval is the time between two evaluations of the
+	// underlay. Defaults to 1 minute.
+	Interval time.Duration
+
+	// OnChange receives the change of the MTU, if any
+	OnChange func(changes []Change)
+
+	// OnError receives errors of WatchMTU, which keeps going
+	OnError func(err error)
+}
+
+// DeriveMTU computes a safe MTU for an interface from its underlay: the
+// links behind the default route and the routes to the endpoints of its
+// peers. Their smallest MTU is reduced by the overhead of wireguard over
+// IPv4 (60 bytes) or IPv6 (80 bytes). As traffic to peers that are not
+// known yet takes the default route, possibly over IPv6, the overhead
+// of IPv6 applies there. Without any underlay, 1420 is returned.
+func (wg wgwrapper) DeriveMTU(intf WireguardInterface) (int, error) {
+	endpoints, err := wg.deviceEndpoints(intf)
+	if err != nil {
+		return 0, err
+	}
+	return wg.deriveMTU(intf.InterfaceName, endpoints)
+}
+
+// deviceEndpoints returns the endpoint addresses of the peers of an
+// interface. A missing interface has none.
+func (wg wgwrapper) deviceEndpoints(intf WireguardInterface) ([]net.IP, error) {
+	ex, err := wg.backend.LinkExists(wg.context(), intf.InterfaceName)
+	if err != nil {
+		return nil, wrapError("derive mtu", intf.InterfaceName, err)
+	}
+	res := []net.IP{}
+	if !ex {
+		return res, nil
+	}
+
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return nil, wrapError("derive mtu", intf.InterfaceName, err)
+	}
+	defer wgClient.Close()
+
+	wgDevice, err := wgClient.Device(intf.InterfaceName)
+	if err != nil {
+		return nil, wrapError("derive mtu", intf.InterfaceName, err)
+	}
+	for _, p := range wgDevice.Peers {
+		if p.Endpoint != nil {
+			res = append(res, p.Endpoint.IP)
+		}
+	}
+	return res, nil
+}
+
+// peerEndpoints returns the endpoint addresses of peers,
+// resolving host names until ctx is done
+func peerEndpoints(ctx context.Context, peers []WireguardPeer) ([]net.IP, error) {
+	res := []net.IP{}
+	for _, p := range peers {
+		ep, err := peerEndpoint(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		if ep != nil {
+			res = append(res, ep.IP)
+		}
+	}
+	return res, nil
+}
+
+// deriveMTU implements DeriveMTU for the interface name and
+// given endpoint addresses
+func (wg wgwrapper) deriveMTU(name string, endpoints []net.IP) (int, error) {
+	mtu := 0
+	consider := func(link string, overhead int) error {
+		if link == "" || link == name {
+			return nil
+		}
+		a, err := wg.backend.LinkAttrs(wg.context(), link)
+		if err != nil {
+			return err
+		}
+		if m := a.MTU - overhead; mtu == 0 || m < mtu {
+			mtu = m
+		}
+		return nil
+	}
+
+	link, err := wg.backend.DefaultRouteInterface(wg.context())
+	if err != nil {
+		return 0, wrapError("derive mtu", name, err)
+	}
+	if err := consider(link, wireguardOverheadIPv6); err != nil {
+		return 0, wrapError("derive mtu", name, err)
+	}
+
+	for _, ip := range endpoints {
+		link, err := wg.backend.RouteGet(wg.context(), ip)
+		if err != nil {
+			return 0, wrapError("derive mtu", name, fmt.Errorf("no route to endpoint %s: %w", ip, err))
+		}
+		overhead := wireguardOverheadIPv6
+		if ip.To4() != nil {
+			overhead = wireguardOverheadIPv4
+		}
+		if err := consider(link, overhead); err != nil {
+			return 0, wrapError("derive mtu", name, err)
+		}
+	}
+
+	if mtu == 0 {
+		mtu = defaultUnderlayMTU - wireguardOverheadIPv6
+	}
+	if mtu < 68 {
+		return 0, wrapError("derive mtu", name, errors.New("mtu of underlay too small"))
+	}
+	return mtu, nil
+}
+
+// UpdateMTU derives the MTU of an interface from its underlay again, see
+// DeriveMTU, and applies it if it differs. Returns the change made, if any.
+func (wg wgwrapper) UpdateMTU(intf WireguardInterface) ([]Change, error) {
+	changes, _, err := wg.updateMTU(intf)
+	return changes, err
+}
+
+func (wg wgwrapper) updateMTU(intf WireguardInterface) ([]Change, undoFunc, error) {
+	mtu, err := wg.DeriveMTU(intf)
+	if err != nil {
+		return []Change{}, nil, err
+	}
+	intf = WireguardInterface{InterfaceName: intf.InterfaceName, MTU: mtu}
+
+	current, err := wg.backend.LinkAttrs(wg.context(), intf.InterfaceName)
+	if err != nil {
+		return []Change{}, nil, wrapError("set mtu", intf.InterfaceName, err)
+	}
+	if current.MTU == mtu {
+		return []Change{}, nil, nil
+	}
+	undo, err := wg.setLinkAttrs(intf)
+	if err != nil {
+		return []Change{}, undo, err
+	}
+	return []Change{{
+		Op:     "set mtu",
+		Target: strconv.Itoa(mtu),
+		Fields: []FieldChange{{Field: "mtu", Before: strconv.Itoa(current.MTU), After: strconv.Itoa(mtu)}},
+	}}, undo, nil
+}
+
+// WatchMTU keeps the MTU of an interface in line with its underlay:
+// every w.Interval, it derives the MTU again and applies it if it
+// changed, see UpdateMTU. It runs until ctx, or the context of the
+// wrapper, is done, see WithContext, and returns its error.
+func (wg wgwrapper) WatchMTU(ctx context.Context, intf WireguardInterface, w MTUWatcher) error {
+	wctx := wg.context()
+
+	interval := w.Interval
+	if interval <= 0 {
+		interval = defaultMTUInterval
+	}
+
+	report := func(changes []Change, err error) {
+		if len(changes) > 0 && w.OnChange != nil {
+			w.OnChange(changes)
+		}
+		if err != nil && w.OnError != nil {
+			w.OnError(err)
+		}
+	}
+
+	report(wg.UpdateMTU(intf))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wctx.Done():
+			return wctx.Err()
+		case <-ticker.C:
+			report(wg.UpdateMTU(intf))
+		}
+	}
+}
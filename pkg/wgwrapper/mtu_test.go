@@ -0,0 +1,202 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newUnderlayInMemory returns an in-memory wrapper along with its
+// kernel, to change the underlay links
+func newUnderlayInMemory() (WireguardWrapper, *memoryKernel) {
+	k := newMemoryKernel()
+	return newInMemory(k, k), k
+}
+
+// setUnderlayMTU changes the MTU of an underlay link
+func setUnderlayMTU(k *memoryKernel, name string, mtu int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.underlay[name] = linkAttrs{MTU: mtu}
+}
+
+func TestDeriveMTU(t *testing.T) {
+	wg, k := newUnderlayInMemory()
+	wgi := newWGIntf()
+
+	// the default route to eth0, with IPv6 overhead
+	mtu, err := wg.DeriveMTU(wgi)
+	if err != nil || mtu != 1420 {
+		t.Errorf("Unexpected MTU: %d, %v", mtu, err)
+	}
+	setUnderlayMTU(k, "eth0", 9000)
+	if mtu, err = wg.DeriveMTU(wgi); err != nil || mtu != 8920 {
+		t.Errorf("Unexpected MTU for jumbo frames: %d, %v", mtu, err)
+	}
+
+	// no underlay at all
+	k.defaultRouteInterface = ""
+	if mtu, err = wg.DeriveMTU(wgi); err != nil || mtu != 1420 {
+		t.Errorf("Unexpected MTU without underlay: %d, %v", mtu, err)
+	}
+	k.defaultRouteInterface = "eth0"
+
+	// endpoints are reached via another link with a smaller MTU
+	ul := NewWireguardInterfaceAddrs("wg-underlay", []net.IPNet{
+		{IP: net.ParseIP("10.5.0.1"), Mask: net.CIDRMask(24, 32)},
+		{IP: net.ParseIP("fd05::1"), Mask: net.CIDRMask(64, 128)},
+	})
+	ul.MTU = 1300
+	if err := wg.AddInterface(ul); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := wg.SetInterfaceUp(ul); err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp: %s", err)
+	}
+	wgi.ListenPort = 46538
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := wg.Configure(&wgi); err != nil {
+		t.Fatalf("Unable to execute Configure: %s", err)
+	}
+	peers := batchPeers(t, 2)
+	peers[0].RemoteEndpointIP = "10.5.0.7"
+	if _, err := wg.AddPeer(wgi, peers[0]); err != nil {
+		t.Fatalf("Unable to execute AddPeer: %s", err)
+	}
+	if mtu, err = wg.DeriveMTU(wgi); err != nil || mtu != 1240 {
+		t.Errorf("Unexpected MTU for IPv4 endpoint: %d, %v", mtu, err)
+	}
+	peers[1].RemoteEndpointIP = "fd05::7"
+	if _, err := wg.AddPeer(wgi, peers[1]); err != nil {
+		t.Fatalf("Unable to execute AddPeer: %s", err)
+	}
+	if mtu, err = wg.DeriveMTU(wgi); err != nil || mtu != 1220 {
+		t.Errorf("Unexpected MTU for IPv6 endpoint: %d, %v", mtu, err)
+	}
+
+	setUnderlayMTU(k, "eth0", 60)
+	if _, err = wg.DeriveMTU(wgi); err == nil {
+		t.Error("DeriveMTU with tiny underlay MTU should fail but did not")
+	}
+}
+
+func TestAutoMTU(t *testing.T) {
+	wg, k := newUnderlayInMemory()
+	wgi := newWGIntf()
+	wgi.MTU = AutoMTU
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	r, err := wg.GetInterface(wgi.InterfaceName)
+	if err != nil || r.MTU != 1420 {
+		t.Errorf("AddInterface should derive the MTU: %d, %v", r.MTU, err)
+	}
+
+	setUnderlayMTU(k, "eth0", 1400)
+	changes, err := wg.UpdateMTU(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute UpdateMTU: %s", err)
+	}
+	if !reflect.DeepEqual(changeStrings(changes), []string{"set mtu 1320"}) || changes[0].Fields[0].String() != "mtu: 1420 -> 1320" {
+		t.Errorf("Unexpected changes: %v %v", changeStrings(changes), changes)
+	}
+	if changes, err = wg.UpdateMTU(wgi); err != nil || len(changes) != 0 {
+		t.Errorf("Second UpdateMTU should not change anything: %v, %v", changes, err)
+	}
+
+	// transactions restore the previous MTU
+	setUnderlayMTU(k, "eth0", 1500)
+	tx := wg.Begin()
+	if _, err := tx.UpdateMTU(wgi); err != nil {
+		t.Fatalf("Unable to execute UpdateMTU: %s", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Unable to execute Rollback: %s", err)
+	}
+	if r, _ := wg.GetInterface(wgi.InterfaceName); r.MTU != 1320 {
+		t.Errorf("Rollback should restore the MTU, got %d", r.MTU)
+	}
+
+	// Apply derives the MTU from the peers of the spec
+	peers := batchPeers(t, 1)
+	changes, err = wg.Apply(InterfaceSpec{
+		InterfaceName: wgi.InterfaceName,
+		Addresses:     []net.IPNet{wgi.IP},
+		ListenPort:    46539,
+		MTU:           AutoMTU,
+		Peers:         peers,
+	})
+	if err != nil {
+		t.Fatalf("Unable to execute Apply: %s", err)
+	}
+	if len(changes) == 0 || changes[0].String() != "set link attributes "+wgi.InterfaceName || fieldStrings(changes[0].Fields)[0] != "mtu: 1320 -> 1420" {
+		t.Errorf("Unexpected changes: %v", changeStrings(changes))
+	}
+}
+
+func TestWatchMTU(t *testing.T) {
+	wg, k := newUnderlayInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	setUnderlayMTU(k, "eth0", 1400)
+
+	var mu sync.Mutex
+	changes := []Change{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- wg.WatchMTU(ctx, wgi, MTUWatcher{
+			Interval: 10 * time.Millisecond,
+			OnChange: func(c []Change) {
+				mu.Lock()
+				defer mu.Unlock()
+				changes = append(changes, c...)
+			},
+			OnError: func(err error) {
+				t.Errorf("Unexpected error: %s", err)
+			},
+		})
+	}()
+
+	// the MTU is updated right away, and when the underlay changes
+	waitFor := func(n int) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			mu.Lock()
+			l := len(changes)
+			mu.Unlock()
+			if l >= n {
+				return
+			}
+		}
+		t.Fatalf("Timed out waiting for %d changes", n)
+	}
+	waitFor(1)
+	setUnderlayMTU(k, "eth0", 1500)
+	waitFor(2)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("WatchMTU should return the error of the context, got: %v", err)
+	}
+
+	// the context of the wrapper ends it as well
+	err := wg.WithContext(ctx).WatchMTU(context.Background(), wgi, MTUWatcher{Interval: time.Hour})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("WatchMTU should return the error of the context, got: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(changeStrings(changes), []string{"set mtu 1320", "set mtu 1420"}) {
+		t.Errorf("Unexpected changes: %v", changeStrings(changes))
+	}
+}
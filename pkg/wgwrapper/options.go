@@ -0,0 +1,263 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	wgctrl "golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Logger receives log events of a WireguardWrapper. Messages are
+// short and constant, details are given as alternating keys and values.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// noopLogger discards everything
+type noopLogger struct {
+}
+
+func (l noopLogger) Debug(msg string, keysAndValues ...interface{}) {}
+func (l noopLogger) Error(msg string, keysAndValues ...interface{}) {}
+
+// stdLogger writes key=value formatted lines to a log.Logger
+type stdLogger struct {
+	l *log.Logger
+}
+
+// NewStdLogger returns a Logger that writes to l, formatting
+// keys and values as key=value pairs
+func NewStdLogger(l *log.Logger) Logger {
+	return stdLogger{l: l}
+}
+
+func (l stdLogger) print(level string, msg string, keysAndValues ...interface{}) {
+	var sb strings.Builder
+	sb.WriteString(level)
+	sb.WriteString(" ")
+	sb.WriteString(msg)
+	for idx := 0; idx+1 < len(keysAndValues); idx += 2 {
+		sb.WriteString(fmt.Sprintf(" %v=%v", keysAndValues[idx], keysAndValues[idx+1]))
+	}
+	l.l.Println(sb.String())
+}
+
+func (l stdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.print("DEBUG", msg, keysAndValues...)
+}
+
+func (l stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.print("ERROR", msg, keysAndValues...)
+}
+
+// options collects the settings given to New
+type options struct {
+	ipPath    string
+	runner    CommandRunner
+	ipCommand bool
+	logger    Logger
+	client    *wgctrl.Client
+	timeout   time.Duration
+	batchSize int
+	keyStore  KeyStore
+	routeSync bool
+}
+
+// Option configures a WireguardWrapper created by New
+type Option func(*options)
+
+// newOptions applies opts to the defaults
+func newOptions(opts []Option) options {
+	o := options{
+		ipPath: "/sbin/ip",
+		logger: noopLogger{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// wrapper returns a wgwrapper with the settings of o, which manages
+// links via backend. Wireguard devices are accessed via shared, a
+// client that is never closed, if given.
+func (o options) wrapper(backend linkBackend, shared wgClient) wgwrapper {
+	wg := wgwrapper{
+		backend:   backend,
+		batchSize: o.batchSize,
+		keyStore:  o.keyStore,
+		routeSync: o.routeSync,
+	}
+	if shared != nil {
+		wg.newClient = func(ctx context.Context) (wgClient, error) {
+			return managedClient{c: shared, shared: true, ctx: ctx, logger: o.logger}, nil
+		}
+	}
+	return wg
+}
+
+// WithIPCommand manages links, addresses and routes by calling the
+// ip binary instead of via rtnetlink, e.g. where netlink requests are
+// filtered.
+func WithIPCommand() Option {
+	return func(o *options) {
+		o.ipCommand = true
+	}
+}
+
+// WithIPPath sets the path of the ip binary. Defaults to /sbin/ip.
+// Implies WithIPCommand.
+func WithIPPath(path string) Option {
+	return func(o *options) {
+		o.ipPath = path
+		o.ipCommand = true
+	}
+}
+
+// WithCommandRunner sets the CommandRunner used to call the ip binary,
+// e.g. a RecordingRunner in tests. Implies WithIPCommand.
+func WithCommandRunner(runner CommandRunner) Option {
+	return func(o *options) {
+		o.runner = runner
+		o.ipCommand = true
+	}
+}
+
+// WithNetlink manages links, addresses and routes via rtnetlink, which
+// is the default. Overrides an earlier WithIPCommand.
+func WithNetlink() Option {
+	return func(o *options) {
+		o.ipCommand = false
+	}
+}
+
+// WithLogger sets a logger that receives all commands, netlink
+// requests and wireguard configuration changes. Defaults to no logging.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithWireguardClient makes the wrapper use a single, long-lived wgctrl
+// client for all operations instead of opening one per call. The wrapper
+// takes ownership of the client, it is closed by WireguardWrapper.Close.
+func WithWireguardClient(client *wgctrl.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithTimeout limits the duration of each call to the ip binary and each
+// netlink request. Defaults to no limit. Operations exceeding it fail with
+// context.DeadlineExceeded. Wireguard device operations cannot be
+// interrupted, they are not limited.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithBatchSize sets the maximum number of peers AddPeers and
+// RemovePeers send in a single device configuration. Defaults to 1000.
+func WithBatchSize(n int) Option {
+	return func(o *options) {
+		o.batchSize = n
+	}
+}
+
+// WithKeyStore makes Configure load the private keys of interfaces from
+// store, and store the keys it generates, so that an interface keeps its
+// identity when it is created again. RotateKey stores the new key.
+func WithKeyStore(store KeyStore) Option {
+	return func(o *options) {
+		o.keyStore = store
+	}
+}
+
+// WithRouteSync keeps the routes via an interface in line with the allowed
+// IPs of its peers: AddPeer, AddPeers, RemovePeerByPubkey, RemovePeers,
+// RemoveAllPeers, UpdatePeer, UpsertPeer and SyncPeers call SyncRoutes
+// once they changed peers, also within a transaction. Interfaces that are
+// down are skipped. If syncing fails, the error is returned, the peers stay
+// changed unless the call was part of a transaction.
+func WithRouteSync() Option {
+	return func(o *options) {
+		o.routeSync = true
+	}
+}
+
+// withTimeout derives the context of a single operation from ctx,
+// limited by timeout if it is set
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// isContextError checks if err is caused by a cancelled or expired context
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// managedClient wraps a wgClient with the context and logger
+// of a wrapper. A shared client is not closed after each call.
+type managedClient struct {
+	c      wgClient
+	shared bool
+	ctx    context.Context
+	logger Logger
+}
+
+// do runs fn unless the context is done. wgctrl calls cannot be
+// interrupted, so once started, fn runs to completion and its result
+// is returned, even if the context is done meanwhile. A call that
+// fails with the context's error has not been made. Nothing is left
+// running when do returns, so the client can be closed.
+func (mc managedClient) do(fn func() error) error {
+	if err := mc.ctx.Err(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+func (mc managedClient) Device(name string) (*wgtypes.Device, error) {
+	var res *wgtypes.Device
+	err := mc.do(func() error {
+		var err error
+		res, err = mc.c.Device(name)
+		return err
+	})
+	if err != nil {
+		mc.logger.Debug("wireguard device query failed", "device", name, "err", err)
+		return nil, err
+	}
+	return res, nil
+}
+
+func (mc managedClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	mc.logger.Debug("configuring wireguard device", "device", name, "peers", len(cfg.Peers), "replacePeers", cfg.ReplacePeers)
+	err := mc.do(func() error {
+		return mc.c.ConfigureDevice(name, cfg)
+	})
+	if err != nil {
+		mc.logger.Error("unable to configure wireguard device", "device", name, "err", err)
+	}
+	return err
+}
+
+func (mc managedClient) Close() error {
+	if mc.shared {
+		return nil
+	}
+	return mc.c.Close()
+}
@@ -0,0 +1,110 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestOptionIPPath(t *testing.T) {
+	r := NewRecordingRunner()
+	wg := New(WithIPPath("/usr/local/sbin/ip"), WithCommandRunner(r))
+	defer wg.Close()
+
+	err := wg.SetInterfaceUp(NewWireguardInterfaceNoAddr("wg-tst0"))
+	if err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp:  %s", err)
+	}
+	assertCommands(t, r,
+		"/usr/local/sbin/ip --br link show dev wg-tst0 up type wireguard",
+		"/usr/local/sbin/ip link set up dev wg-tst0",
+	)
+}
+
+func TestOptionBackend(t *testing.T) {
+	for _, tc := range []struct {
+		opts      []Option
+		ipCommand bool
+	}{
+		{nil, false},
+		{[]Option{WithNetlink()}, false},
+		{[]Option{WithIPCommand()}, true},
+		{[]Option{WithIPPath("/usr/local/sbin/ip")}, true},
+		{[]Option{WithCommandRunner(NewRecordingRunner())}, true},
+		{[]Option{WithIPCommand(), WithNetlink()}, false},
+	} {
+		_, ok := New(tc.opts...).(wgwrapper).backend.(ipCommand)
+		if ok != tc.ipCommand {
+			t.Errorf("Unexpected backend for %d option(s), ip command: %t", len(tc.opts), ok)
+		}
+	}
+}
+
+func TestOptionLogger(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRecordingRunner()
+	wg := New(WithCommandRunner(r), WithLogger(NewStdLogger(log.New(&buf, "", 0))))
+
+	err := wg.SetRoute(NewWireguardInterfaceNoAddr("wg-tst0"), "10.1.0.0/16")
+	if err != nil {
+		t.Fatalf("Unable to execute SetRoute:  %s", err)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "DEBUG calling ip path=/sbin/ip args=route add 10.1.0.0/16 dev wg-tst0") {
+		t.Errorf("Expected ip call to be logged, got: %s", out)
+	}
+}
+
+// slowClient is a wgClient that takes its time,
+// it counts the configurations applied
+type slowClient struct {
+	delay   time.Duration
+	applied *int
+}
+
+func (c slowClient) Device(name string) (*wgtypes.Device, error) {
+	time.Sleep(c.delay)
+	return &wgtypes.Device{Name: name}, nil
+}
+
+func (c slowClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	time.Sleep(c.delay)
+	*c.applied++
+	return nil
+}
+
+func (c slowClient) Close() error {
+	return nil
+}
+
+func TestManagedClientContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	applied := 0
+	mc := managedClient{
+		c:      slowClient{delay: 100 * time.Millisecond, applied: &applied},
+		ctx:    ctx,
+		logger: noopLogger{},
+	}
+
+	// a call that has started is completed and reported as such
+	if err := mc.ConfigureDevice("wg-tst0", wgtypes.Config{}); err != nil || applied != 1 {
+		t.Errorf("Started configuration should complete, got %d applied: %v", applied, err)
+	}
+
+	// once the context is done, calls are not made
+	if err := mc.ConfigureDevice("wg-tst0", wgtypes.Config{}); err != context.DeadlineExceeded || applied != 1 {
+		t.Errorf("Expected context.DeadlineExceeded without configuring, got %d applied: %v", applied, err)
+	}
+	if _, err := mc.Device("wg-tst0"); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded querying a device, got: %v", err)
+	}
+}
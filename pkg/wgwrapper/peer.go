@@ -3,16 +3,19 @@
 package wgwrapper
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net"
 	"time"
 
-	wgctrl "golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// WireguardPeer is a single wireguard peer
+// WireguardPeer is a single wireguard peer. RemoteEndpointIP, or
+// RemoteEndpointHost, and ListenPort form its endpoint. It is
+// optional, a peer without endpoint waits for the remote side to
+// connect, its endpoint is then learned from the handshake.
 type WireguardPeer struct {
 	RemoteEndpointIP            string
 	ListenPort                  int
@@ -20,84 +23,129 @@ type WireguardPeer struct {
 	AllowedIPs                  []net.IPNet
 	Psk                         *string
 	PersistentKeepaliveInterval time.Duration
+
+	// RemoteEndpointHost is a host name the endpoint is resolved from,
+	// instead of RemoteEndpointIP, see ResolveEndpoints
+	RemoteEndpointHost string
+
+	// EndpointFamily selects the address of RemoteEndpointHost
+	EndpointFamily AddressFamily
 }
 
-// AddPeer adds a new peer to an existing interface
+// AddPeer adds a new peer to an existing interface. Existing
+// peers are left untouched, see UpsertPeer.
 func (wg wgwrapper) AddPeer(intf WireguardInterface, peer WireguardPeer) (bool, error) {
-	wgClient, err := wgctrl.New()
+	undo, err := wg.addPeer(intf, peer)
+	return undo != nil, err
+}
+
+// addPeer adds peer unless it is present. Returns no undoFunc
+// if the peer has not been added.
+func (wg wgwrapper) addPeer(intf WireguardInterface, peer WireguardPeer) (undoFunc, error) {
+	wgClient, err := wg.newClient(wg.context())
 	if err != nil {
-		return false, err
+		return nil, wrapError("add peer", intf.InterfaceName, err)
 	}
 	defer wgClient.Close()
 
 	pk, err := wgtypes.ParseKey(peer.Pubkey)
 	if err != nil {
-		return false, err
+		return nil, wrapError("add peer", intf.InterfaceName, invalidKey(err))
 	}
 
 	wgDevice, err := wgClient.Device(intf.InterfaceName)
 	if err != nil {
-		return false, err
+		return nil, wrapError("add peer", intf.InterfaceName, err)
 	}
 	for _, p := range wgDevice.Peers {
 		if p.PublicKey == pk {
 			// Already present, skipping
-			return false, nil
+			return nil, nil
 		}
 	}
 
-	var pskAsKey wgtypes.Key
-	if peer.Psk != nil {
-		pskAsKey, err = wgtypes.ParseKey(*peer.Psk)
-		if err != nil {
-			return false, err
-		}
-	}
-
-	// process peer
-	ep, err := net.ResolveUDPAddr("udp", net.JoinHostPort(peer.RemoteEndpointIP, fmt.Sprintf("%d", peer.ListenPort)))
+	pc, err := peerConfig(wg.context(), peer)
 	if err != nil {
-		return false, err
+		return nil, wrapError("add peer", intf.InterfaceName, err)
 	}
 
 	newConfig := wgtypes.Config{
 		ReplacePeers: false,
-		Peers: []wgtypes.PeerConfig{
-			wgtypes.PeerConfig{
-				PublicKey:                   pk,
-				Remove:                      false,
-				PresharedKey:                &pskAsKey,
-				Endpoint:                    ep,
-				AllowedIPs:                  peer.AllowedIPs,
-				PersistentKeepaliveInterval: &peer.PersistentKeepaliveInterval,
-			},
-		},
+		Peers:        []wgtypes.PeerConfig{pc},
 	}
 
 	err = wgClient.ConfigureDevice(intf.InterfaceName, newConfig)
 	if err != nil {
-		return false, err
+		return nil, wrapError("add peer", intf.InterfaceName, err)
+	}
+
+	return wg.syncPeerRoutes(intf, func(wg wgwrapper) error {
+		return wg.removePeer(intf, peer.Pubkey)
+	})
+}
+
+// peerConfig converts peer to the configuration of a wireguard device.
+// Without Psk, the preshared key is left as it is.
+func peerConfig(ctx context.Context, peer WireguardPeer) (wgtypes.PeerConfig, error) {
+	pk, err := wgtypes.ParseKey(peer.Pubkey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, invalidKey(err)
+	}
+
+	var psk *wgtypes.Key
+	if peer.Psk != nil {
+		k, err := wgtypes.ParseKey(*peer.Psk)
+		if err != nil {
+			return wgtypes.PeerConfig{}, invalidKey(err)
+		}
+		psk = &k
+	}
+
+	ep, err := peerEndpoint(ctx, peer)
+	if err != nil {
+		return wgtypes.PeerConfig{}, err
 	}
 
-	return true, nil
+	keepalive := peer.PersistentKeepaliveInterval
+	return wgtypes.PeerConfig{
+		PublicKey:                   pk,
+		Remove:                      false,
+		PresharedKey:                psk,
+		Endpoint:                    ep,
+		AllowedIPs:                  peer.AllowedIPs,
+		PersistentKeepaliveInterval: &keepalive,
+	}, nil
+}
+
+// peerEndpoint resolves the endpoint of a peer, host names until ctx
+// is done. Returns nil if the peer has none, e.g. a roaming client
+// whose endpoint is learned from its handshakes.
+func peerEndpoint(ctx context.Context, peer WireguardPeer) (*net.UDPAddr, error) {
+	if peer.RemoteEndpointHost != "" {
+		return resolveHost(ctx, nil, peer, nil)
+	}
+	if peer.RemoteEndpointIP == "" {
+		return nil, nil
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(peer.RemoteEndpointIP, fmt.Sprintf("%d", peer.ListenPort)))
 }
 
 // HasPeer check if a peer is present on an interface. Compares by public key only
 func (wg wgwrapper) HasPeer(intf WireguardInterface, peer WireguardPeer) (bool, error) {
-	wgClient, err := wgctrl.New()
+	wgClient, err := wg.newClient(wg.context())
 	if err != nil {
-		return false, err
+		return false, wrapError("query peer", intf.InterfaceName, err)
 	}
 	defer wgClient.Close()
 
 	pk, err := wgtypes.ParseKey(peer.Pubkey)
 	if err != nil {
-		return false, err
+		return false, wrapError("query peer", intf.InterfaceName, invalidKey(err))
 	}
 
 	wgDevice, err := wgClient.Device(intf.InterfaceName)
 	if err != nil {
-		return false, err
+		return false, wrapError("query peer", intf.InterfaceName, err)
 	}
 	for _, p := range wgDevice.Peers {
 		if p.PublicKey == pk {
@@ -110,16 +158,25 @@ func (wg wgwrapper) HasPeer(intf WireguardInterface, peer WireguardPeer) (bool,
 
 // RemovePeerByPubkey remove a single peer from an interface
 func (wg wgwrapper) RemovePeerByPubkey(intf WireguardInterface, pubkey string) error {
-	wgClient, err := wgctrl.New()
-	if err != nil {
+	if err := wg.removePeer(intf, pubkey); err != nil {
 		return err
 	}
+	_, err := wg.syncPeerRoutes(intf, nil)
+	return err
+}
+
+// removePeer implements RemovePeerByPubkey, leaving routes alone
+func (wg wgwrapper) removePeer(intf WireguardInterface, pubkey string) error {
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return wrapError("remove peer", intf.InterfaceName, err)
+	}
 	defer wgClient.Close()
 
 	// process peer
 	pk, err := wgtypes.ParseKey(pubkey)
 	if err != nil {
-		return err
+		return wrapError("remove peer", intf.InterfaceName, invalidKey(err))
 	}
 
 	newConfig := wgtypes.Config{
@@ -134,18 +191,47 @@ func (wg wgwrapper) RemovePeerByPubkey(intf WireguardInterface, pubkey string) e
 
 	err = wgClient.ConfigureDevice(intf.InterfaceName, newConfig)
 	if err != nil {
-		return err
+		return wrapError("remove peer", intf.InterfaceName, err)
 	}
 
 	return nil
 }
 
+// removePeerByPubkey removes a peer, remembering its configuration
+// so that it can be restored
+func (wg wgwrapper) removePeerByPubkey(intf WireguardInterface, pubkey string) (undoFunc, error) {
+	peers, err := wg.devicePeers("remove peer", intf)
+	if err != nil {
+		return nil, err
+	}
+	err = wg.removePeer(intf, pubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range peers {
+		if p.PublicKey.String() == pubkey {
+			return wg.syncPeerRoutes(intf, restorePeers(intf, []wgtypes.Peer{p}, false))
+		}
+	}
+	return nil, nil
+}
+
 // RemoveAllPeers removes all peers on an existing interface
 func (wg wgwrapper) RemoveAllPeers(intf WireguardInterface) error {
-	wgClient, err := wgctrl.New()
-	if err != nil {
+	if err := wg.clearPeers(intf); err != nil {
 		return err
 	}
+	_, err := wg.syncPeerRoutes(intf, nil)
+	return err
+}
+
+// clearPeers implements RemoveAllPeers, leaving routes alone
+func (wg wgwrapper) clearPeers(intf WireguardInterface) error {
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return wrapError("remove all peers", intf.InterfaceName, err)
+	}
 	defer wgClient.Close()
 
 	newConfig := wgtypes.Config{
@@ -153,29 +239,108 @@ func (wg wgwrapper) RemoveAllPeers(intf WireguardInterface) error {
 		Peers:        []wgtypes.PeerConfig{},
 	}
 
-	return wgClient.ConfigureDevice(intf.InterfaceName, newConfig)
+	err = wgClient.ConfigureDevice(intf.InterfaceName, newConfig)
+	return wrapError("remove all peers", intf.InterfaceName, err)
+}
+
+// removeAllPeers removes all peers, remembering their configuration
+// so that they can be restored
+func (wg wgwrapper) removeAllPeers(intf WireguardInterface) (undoFunc, error) {
+	peers, err := wg.devicePeers("remove all peers", intf)
+	if err != nil {
+		return nil, err
+	}
+	err = wg.clearPeers(intf)
+	if err != nil {
+		return nil, err
+	}
+	if len(peers) == 0 {
+		return nil, nil
+	}
+	return wg.syncPeerRoutes(intf, restorePeers(intf, peers, true))
 }
 
-// IteratePeers walks over the current list of peers of an interface
+// devicePeers returns the current peers of an interface
+func (wg wgwrapper) devicePeers(op string, intf WireguardInterface) ([]wgtypes.Peer, error) {
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return nil, wrapError(op, intf.InterfaceName, err)
+	}
+	defer wgClient.Close()
+
+	wgDevice, err := wgClient.Device(intf.InterfaceName)
+	if err != nil {
+		return nil, wrapError(op, intf.InterfaceName, err)
+	}
+	return wgDevice.Peers, nil
+}
+
+// restorePeers returns an undoFunc that configures peers as given,
+// optionally replacing all other peers
+func restorePeers(intf WireguardInterface, peers []wgtypes.Peer, replace bool) undoFunc {
+	cfg := wgtypes.Config{
+		ReplacePeers: replace,
+		Peers:        make([]wgtypes.PeerConfig, len(peers)),
+	}
+	for idx, p := range peers {
+		cfg.Peers[idx] = restoreConfig(p)
+	}
+	return configureUndo(intf, cfg)
+}
+
+// restoreConfig returns the configuration that sets up a peer as given
+func restoreConfig(p wgtypes.Peer) wgtypes.PeerConfig {
+	keepalive := p.PersistentKeepaliveInterval
+	psk := p.PresharedKey
+	return wgtypes.PeerConfig{
+		PublicKey:                   p.PublicKey,
+		PresharedKey:                &psk,
+		Endpoint:                    p.Endpoint,
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+		AllowedIPs:                  p.AllowedIPs,
+	}
+}
+
+// configureUndo returns an undoFunc that applies cfg to the device
+func configureUndo(intf WireguardInterface, cfg wgtypes.Config) undoFunc {
+	return func(wg wgwrapper) error {
+		wgClient, err := wg.newClient(wg.context())
+		if err != nil {
+			return wrapError("restore peers", intf.InterfaceName, err)
+		}
+		defer wgClient.Close()
+
+		return wrapError("restore peers", intf.InterfaceName, wgClient.ConfigureDevice(intf.InterfaceName, cfg))
+	}
+}
+
+// IteratePeers walks over the current list of peers of an interface.
+// Psk is always nil, preshared keys are secrets and not read back, see
+// PeerStatus.HasPsk. For the runtime state of peers, see PeerStatuses.
 func (wg wgwrapper) IteratePeers(intf WireguardInterface, it WireguardPeerIterator) error {
-	wgClient, err := wgctrl.New()
+	wgClient, err := wg.newClient(wg.context())
 	if err != nil {
-		return err
+		return wrapError("iterate peers", intf.InterfaceName, err)
 	}
 	defer wgClient.Close()
 
 	wgDevice, err := wgClient.Device(intf.InterfaceName)
 	if err != nil {
-		return err
+		return wrapError("iterate peers", intf.InterfaceName, err)
 	}
 	for _, p := range wgDevice.Peers {
-		it(WireguardPeer{
-			RemoteEndpointIP: p.Endpoint.IP.String(),
-			ListenPort:       p.Endpoint.Port,
-			Pubkey:           base64.StdEncoding.EncodeToString(p.PublicKey[:]),
-			AllowedIPs:       p.AllowedIPs,
-			Psk:              nil, //p.PresharedKey.String(),
-		})
+		peer := WireguardPeer{
+			Pubkey:                      base64.StdEncoding.EncodeToString(p.PublicKey[:]),
+			AllowedIPs:                  p.AllowedIPs,
+			PersistentKeepaliveInterval: p.PersistentKeepaliveInterval,
+		}
+		// peers without endpoint have not been seen yet
+		if p.Endpoint != nil {
+			peer.RemoteEndpointIP = p.Endpoint.IP.String()
+			peer.ListenPort = p.Endpoint.Port
+		}
+		it(peer)
 	}
 
 	return nil
@@ -0,0 +1,66 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// SyncPeers makes the peers of an interface match the given ones: missing
+// peers are added, changed ones updated in place and others removed, all
+// in a single device configuration. Unchanged peers are not touched, so
+// their sessions continue. Returns the changes made.
+func (wg wgwrapper) SyncPeers(intf WireguardInterface, peers []WireguardPeer) ([]Change, error) {
+	changes, _, err := wg.syncPeers(intf, peers)
+	return changes, err
+}
+
+func (wg wgwrapper) syncPeers(intf WireguardInterface, peers []WireguardPeer) ([]Change, undoFunc, error) {
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return nil, nil, wrapError("sync peers", intf.InterfaceName, err)
+	}
+	defer wgClient.Close()
+
+	wgDevice, err := wgClient.Device(intf.InterfaceName)
+	if err != nil {
+		return nil, nil, wrapError("sync peers", intf.InterfaceName, err)
+	}
+
+	configs, changes, err := diffPeers(wg.context(), wgDevice.Peers, peers)
+	if err != nil {
+		return nil, nil, wrapError("sync peers", intf.InterfaceName, err)
+	}
+	if len(configs) == 0 {
+		return changes, nil, nil
+	}
+
+	err = wgClient.ConfigureDevice(intf.InterfaceName, wgtypes.Config{Peers: configs})
+	if err != nil {
+		return nil, nil, wrapError("sync peers", intf.InterfaceName, err)
+	}
+
+	restore := wgtypes.Config{Peers: restorePeerConfigs(wgDevice.Peers, configs)}
+	undo, err := wg.syncPeerRoutes(intf, configureUndo(intf, restore))
+	return changes, undo, err
+}
+
+// restorePeerConfigs returns the configurations that revert configs
+// applied to a device with peers current: added peers are removed,
+// changed and removed ones restored
+func restorePeerConfigs(current []wgtypes.Peer, configs []wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	byKey := make(map[wgtypes.Key]wgtypes.Peer, len(current))
+	for _, p := range current {
+		byKey[p.PublicKey] = p
+	}
+
+	res := make([]wgtypes.PeerConfig, 0, len(configs))
+	for _, pc := range configs {
+		if p, ok := byKey[pc.PublicKey]; ok {
+			res = append(res, restoreConfig(p))
+		} else {
+			res = append(res, wgtypes.PeerConfig{PublicKey: pc.PublicKey, Remove: true})
+		}
+	}
+	return res
+}
@@ -0,0 +1,112 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// recordingClient records the configurations applied to devices
+type recordingClient struct {
+	wgClient
+	configs []wgtypes.Config
+}
+
+func (c *recordingClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	c.configs = append(c.configs, cfg)
+	return c.wgClient.ConfigureDevice(name, cfg)
+}
+
+// newRecordingInMemory returns an in-memory wrapper whose device
+// configurations are recorded by the returned client
+func newRecordingInMemory(opts ...Option) (WireguardWrapper, *recordingClient) {
+	k := newMemoryKernel()
+	c := &recordingClient{wgClient: k}
+	return newInMemory(k, c, opts...), c
+}
+
+func TestSyncPeers(t *testing.T) {
+	wg, c := newRecordingInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	_, n2, _ := net.ParseCIDR("10.2.0.0/16")
+	_, n3, _ := net.ParseCIDR("10.3.0.0/16")
+	wgp1 := WireguardPeer{
+		RemoteEndpointIP: "10.1.2.3",
+		ListenPort:       43210,
+		Pubkey:           "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs:       []net.IPNet{*n1},
+	}
+	wgp2 := WireguardPeer{
+		RemoteEndpointIP: "10.4.5.6",
+		ListenPort:       32345,
+		Pubkey:           "xqr+unDSDc5Fq0W9Zp2SJlzr+wOaFAquNdIMwPLHarw=",
+		AllowedIPs:       []net.IPNet{*n2},
+	}
+	wgp3 := WireguardPeer{
+		RemoteEndpointIP: "10.7.8.9",
+		ListenPort:       51820,
+		Pubkey:           "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=",
+		AllowedIPs:       []net.IPNet{*n3},
+	}
+
+	changes, err := wg.SyncPeers(wgi, []WireguardPeer{wgp1, wgp2})
+	if err != nil || len(changes) != 2 || len(c.configs) != 1 {
+		t.Fatalf("Unexpected result of SyncPeers: %v, %v, %d configurations", changes, err, len(c.configs))
+	}
+
+	// keep wgp1, update wgp2, add wgp3
+	c.configs = nil
+	wgp2.ListenPort = 32346
+	changes, err = wg.SyncPeers(wgi, []WireguardPeer{wgp1, wgp2, wgp3})
+	if err != nil {
+		t.Fatalf("Unable to execute SyncPeers: %s", err)
+	}
+	expected := []string{"update peer " + wgp2.Pubkey, "add peer " + wgp3.Pubkey}
+	if !reflect.DeepEqual(changeStrings(changes), expected) {
+		t.Errorf("Unexpected changes: %v", changeStrings(changes))
+	}
+	if len(c.configs) != 1 || len(c.configs[0].Peers) != 2 || c.configs[0].ReplacePeers {
+		t.Fatalf("Expected a single configuration of two peers, got %#v", c.configs)
+	}
+	for _, pc := range c.configs[0].Peers {
+		if pc.PublicKey.String() == wgp1.Pubkey {
+			t.Errorf("Unchanged peer should not be configured: %#v", pc)
+		}
+		if pc.Remove {
+			t.Errorf("Peers should be updated in place, not removed: %#v", pc)
+		}
+	}
+
+	// remove wgp1
+	c.configs = nil
+	changes, err = wg.SyncPeers(wgi, []WireguardPeer{wgp2, wgp3})
+	if err != nil || !reflect.DeepEqual(changeStrings(changes), []string{"remove peer " + wgp1.Pubkey}) || len(c.configs) != 1 {
+		t.Errorf("Unexpected result of SyncPeers: %v, %v", changes, err)
+	}
+
+	// nothing to do
+	c.configs = nil
+	changes, err = wg.SyncPeers(wgi, []WireguardPeer{wgp3, wgp2})
+	if err != nil || len(changes) != 0 || len(c.configs) != 0 {
+		t.Errorf("SyncPeers without changes: %v, %v, %d configurations", changes, err, len(c.configs))
+	}
+
+	// invalid peers are rejected before anything is changed
+	_, err = wg.SyncPeers(wgi, []WireguardPeer{wgp1, {Pubkey: "invalid"}})
+	if err == nil || len(c.configs) != 0 {
+		t.Errorf("SyncPeers with invalid peer should fail without changes: %v", err)
+	}
+	_, err = wg.SyncPeers(wgi, []WireguardPeer{wgp1, wgp1})
+	if err == nil || len(c.configs) != 0 {
+		t.Errorf("SyncPeers with duplicate peer should fail without changes: %v", err)
+	}
+}
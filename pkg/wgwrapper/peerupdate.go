@@ -0,0 +1,154 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// AllowedIPsMode tells UpdatePeer how to treat the allowed IPs
+// of an existing peer
+type AllowedIPsMode int
+
+const (
+	// ReplaceAllowedIPs sets exactly the allowed IPs given
+	ReplaceAllowedIPs AllowedIPsMode = iota
+
+	// AppendAllowedIPs adds the allowed IPs given, keeping existing ones
+	AppendAllowedIPs
+)
+
+// PeerUpdate controls how UpdatePeer and UpsertPeer apply a
+// WireguardPeer to an existing peer. The persistent keepalive
+// interval is always set, 0 disables it.
+type PeerUpdate struct {
+	AllowedIPs AllowedIPsMode
+
+	// ClearEndpoint removes the endpoint if the peer has none
+	// (empty RemoteEndpointIP). Otherwise the current one is kept.
+	// As wireguard cannot unset an endpoint, the peer is removed
+	// and added again, which resets its handshake and statistics.
+	ClearEndpoint bool
+
+	// ClearPsk removes the preshared key if the peer has none
+	// (nil Psk). Otherwise the current one is kept.
+	ClearPsk bool
+}
+
+// UpdatePeer changes an existing peer as given by upd and returns the
+// fields that changed. Fails with ErrPeerNotFound if there is no peer
+// with the public key of peer.
+func (wg wgwrapper) UpdatePeer(intf WireguardInterface, peer WireguardPeer, upd PeerUpdate) ([]FieldChange, error) {
+	_, changes, _, err := wg.upsertPeer("update peer", intf, peer, upd, false)
+	return changes, err
+}
+
+// UpsertPeer adds a peer or updates an existing one as given by upd.
+// Returns whether the peer has been added and the fields that changed.
+func (wg wgwrapper) UpsertPeer(intf WireguardInterface, peer WireguardPeer, upd PeerUpdate) (bool, []FieldChange, error) {
+	added, changes, _, err := wg.upsertPeer("upsert peer", intf, peer, upd, true)
+	return added, changes, err
+}
+
+// upsertPeer implements UpdatePeer and UpsertPeer. Returns an undoFunc
+// if the peer has been modified.
+func (wg wgwrapper) upsertPeer(op string, intf WireguardInterface, peer WireguardPeer, upd PeerUpdate, create bool) (bool, []FieldChange, undoFunc, error) {
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return false, nil, nil, wrapError(op, intf.InterfaceName, err)
+	}
+	defer wgClient.Close()
+
+	pk, err := wgtypes.ParseKey(peer.Pubkey)
+	if err != nil {
+		return false, nil, nil, wrapError(op, intf.InterfaceName, invalidKey(err))
+	}
+
+	wgDevice, err := wgClient.Device(intf.InterfaceName)
+	if err != nil {
+		return false, nil, nil, wrapError(op, intf.InterfaceName, err)
+	}
+	var existing *wgtypes.Peer
+	for idx := range wgDevice.Peers {
+		if wgDevice.Peers[idx].PublicKey == pk {
+			existing = &wgDevice.Peers[idx]
+			break
+		}
+	}
+	if existing == nil && !create {
+		return false, nil, nil, wrapError(op, intf.InterfaceName, fmt.Errorf("%w: %s", ErrPeerNotFound, peer.Pubkey))
+	}
+
+	keepalive := peer.PersistentKeepaliveInterval
+	pc := wgtypes.PeerConfig{
+		PublicKey:                   pk,
+		PersistentKeepaliveInterval: &keepalive,
+		AllowedIPs:                  peer.AllowedIPs,
+	}
+	pc.Endpoint, err = peerEndpoint(wg.context(), peer)
+	if err != nil {
+		return false, nil, nil, wrapError(op, intf.InterfaceName, err)
+	}
+	if peer.Psk != nil {
+		psk, err := wgtypes.ParseKey(*peer.Psk)
+		if err != nil {
+			return false, nil, nil, wrapError(op, intf.InterfaceName, invalidKey(err))
+		}
+		pc.PresharedKey = &psk
+	} else if upd.ClearPsk {
+		pc.PresharedKey = &wgtypes.Key{}
+	}
+
+	if existing == nil {
+		cfg := wgtypes.Config{Peers: []wgtypes.PeerConfig{pc}}
+		if err := wgClient.ConfigureDevice(intf.InterfaceName, cfg); err != nil {
+			return false, nil, nil, wrapError(op, intf.InterfaceName, err)
+		}
+		undo, err := wg.syncPeerRoutes(intf, func(wg wgwrapper) error {
+			return wg.removePeer(intf, peer.Pubkey)
+		})
+		return true, peerFieldChanges(wgtypes.Peer{}, pc), undo, err
+	}
+
+	// the allowed IPs the peer ends up with
+	final := pc
+	if upd.AllowedIPs == AppendAllowedIPs {
+		final.AllowedIPs = append(append([]net.IPNet{}, existing.AllowedIPs...), peer.AllowedIPs...)
+	} else {
+		pc.ReplaceAllowedIPs = true
+	}
+	changes := peerFieldChanges(*existing, final)
+
+	cfg := wgtypes.Config{Peers: []wgtypes.PeerConfig{pc}}
+	if upd.ClearEndpoint && pc.Endpoint == nil && existing.Endpoint != nil {
+		changes = append(changes, FieldChange{Field: "endpoint", Before: existing.Endpoint.String()})
+
+		// re-create the peer without endpoint, keeping what is not changed
+		final.AllowedIPs = maskedNetworks(final.AllowedIPs)
+		if final.PresharedKey == nil {
+			psk := existing.PresharedKey
+			final.PresharedKey = &psk
+		}
+		cfg.Peers = []wgtypes.PeerConfig{{PublicKey: pk, Remove: true}, final}
+	}
+
+	if len(changes) == 0 {
+		return false, changes, nil, nil
+	}
+	if err := wgClient.ConfigureDevice(intf.InterfaceName, cfg); err != nil {
+		return false, nil, nil, wrapError(op, intf.InterfaceName, err)
+	}
+
+	// undo re-creates the peer as it was
+	before := copyPeer(*existing)
+	undo, err := wg.syncPeerRoutes(intf, func(wg wgwrapper) error {
+		if err := wg.removePeer(intf, peer.Pubkey); err != nil {
+			return err
+		}
+		return restorePeers(intf, []wgtypes.Peer{before}, false)(wg)
+	})
+	return false, changes, undo, err
+}
@@ -0,0 +1,634 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// FieldChange is the modification of a single property,
+// e.g. the endpoint of a peer. Before is empty for added
+// values, After is empty for removed ones.
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+func (f FieldChange) String() string {
+	switch {
+	case f.Before == "":
+		return fmt.Sprintf("%s: + %s", f.Field, f.After)
+	case f.After == "":
+		return fmt.Sprintf("%s: - %s", f.Field, f.Before)
+	}
+	return fmt.Sprintf("%s: %s -> %s", f.Field, f.Before, f.After)
+}
+
+// Change describes a single modification of an interface
+type Change struct {
+	Op     string        `json:"op"`               // operation, such as "add address"
+	Target string        `json:"target,omitempty"` // what is changed, e.g. an address or a public key
+	Fields []FieldChange `json:"fields,omitempty"` // details of updates
+}
+
+func (c Change) String() string {
+	if c.Target == "" {
+		return c.Op
+	}
+	return fmt.Sprintf("%s %s", c.Op, c.Target)
+}
+
+// symbol returns a terraform-like marker of the change
+func (c Change) symbol() string {
+	switch {
+	case strings.HasPrefix(c.Op, "add"), strings.HasPrefix(c.Op, "generate"):
+		return "+"
+	case strings.HasPrefix(c.Op, "remove"):
+		return "-"
+	}
+	return "~"
+}
+
+// planStep is a single modification of the system, covering one
+// or more changes of a plan. run returns the way to revert it,
+// also if it fails halfway.
+type planStep struct {
+	changes []Change
+	run     func(wg wgwrapper) (undoFunc, error)
+}
+
+// Plan is the difference between the desired state of an interface
+// and its live state, as computed by WireguardWrapper.Plan. It can be
+// rendered as text via String or as JSON via encoding/json, and
+// executed by WireguardWrapper.ApplyPlan.
+type Plan struct {
+	InterfaceName string   `json:"interface"`
+	Changes       []Change `json:"changes"`
+
+	steps []planStep
+}
+
+// Empty checks if the interface already matches the desired state
+func (p *Plan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+// String renders the plan as human-readable text
+func (p *Plan) String() string {
+	if p.Empty() {
+		return fmt.Sprintf("No changes for %s\n", p.InterfaceName)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Plan for %s: %d change(s)\n", p.InterfaceName, len(p.Changes))
+	for _, c := range p.Changes {
+		fmt.Fprintf(&sb, "  %s %s\n", c.symbol(), c)
+		for _, f := range c.Fields {
+			fmt.Fprintf(&sb, "      %s\n", f)
+		}
+	}
+	return sb.String()
+}
+
+// add appends a step to the plan
+func (p *Plan) add(run func(wg wgwrapper) (undoFunc, error), changes ...Change) {
+	p.Changes = append(p.Changes, changes...)
+	p.steps = append(p.steps, planStep{
+		changes: changes,
+		run:     run,
+	})
+}
+
+// Plan computes what Apply would change to converge the interface
+// to spec, without modifying anything.
+func (wg wgwrapper) Plan(spec InterfaceSpec) (*Plan, error) {
+	name := spec.InterfaceName
+	plan := &Plan{
+		InterfaceName: name,
+		Changes:       []Change{},
+	}
+
+	// interface
+	ex, err := wg.backend.LinkExists(wg.context(), name)
+	if err != nil {
+		return nil, wrapError("add interface", name, err)
+	}
+	if !ex {
+		plan.add(func(wg wgwrapper) (undoFunc, error) {
+			if err := wg.backend.LinkAdd(wg.context(), name); err != nil {
+				return nil, wrapError("add interface", name, err)
+			}
+			return func(wg wgwrapper) error {
+				return wrapError("delete interface", name, wg.backend.LinkDelete(wg.context(), name))
+			}, nil
+		}, Change{Op: "add interface", Target: name})
+	}
+
+	// link attributes, before addresses as IPv6 needs an MTU of 1280
+	desired := linkAttrs{MTU: spec.MTU, TxQueueLen: spec.TxQueueLen, Alias: spec.Alias}
+	if err := validLinkAttrs(desired, spec.FirewallMark); err != nil {
+		return nil, wrapError("set link attributes", name, err)
+	}
+	if desired.MTU == AutoMTU {
+		endpoints, err := peerEndpoints(wg.context(), spec.Peers)
+		if err != nil {
+			return nil, wrapError("derive mtu", name, err)
+		}
+		desired.MTU, err = wg.deriveMTU(name, endpoints)
+		if err != nil {
+			return nil, err
+		}
+	}
+	attrs := linkAttrs{}
+	if ex {
+		attrs, err = wg.backend.LinkAttrs(wg.context(), name)
+		if err != nil {
+			return nil, wrapError("set link attributes", name, err)
+		}
+	}
+	if attrChanges := diffLinkAttrs(attrs, desired); len(attrChanges) > 0 {
+		c := Change{Op: "set link attributes", Target: name}
+		for _, a := range attrChanges {
+			c.Fields = append(c.Fields, a.FieldChange)
+		}
+		plan.add(func(wg wgwrapper) (undoFunc, error) {
+			return wg.applyLinkAttrs(name, attrChanges)
+		}, c)
+	}
+
+	// addresses
+	current := []net.IPNet{}
+	if ex {
+		current, err = wg.backend.AddrList(wg.context(), name)
+		if err != nil {
+			return nil, wrapError("list addresses", name, err)
+		}
+	}
+	add, remove := diffAddresses(current, spec.Addresses)
+	for _, a := range remove {
+		a := a
+		plan.add(func(wg wgwrapper) (undoFunc, error) {
+			if err := wg.backend.AddrDel(wg.context(), name, a); err != nil {
+				return nil, wrapError("remove address", name, err)
+			}
+			return func(wg wgwrapper) error {
+				return wrapError("add address", name, wg.backend.AddrAdd(wg.context(), name, a))
+			}, nil
+		}, Change{Op: "remove address", Target: a.String()})
+	}
+	for _, a := range add {
+		a := a
+		plan.add(func(wg wgwrapper) (undoFunc, error) {
+			if err := wg.backend.AddrAdd(wg.context(), name, a); err != nil {
+				return nil, wrapError("add address", name, err)
+			}
+			return func(wg wgwrapper) error {
+				return wrapError("remove address", name, wg.backend.AddrDel(wg.context(), name, a))
+			}, nil
+		}, Change{Op: "add address", Target: a.String()})
+	}
+
+	// keys, port and peers, in a single device configuration
+	if err := wg.planDevice(plan, spec, ex); err != nil {
+		return nil, err
+	}
+
+	// link state
+	up := false
+	if ex {
+		up, err = wg.backend.LinkIsUp(wg.context(), name)
+		if err != nil {
+			return nil, wrapError("set interface up", name, err)
+		}
+	}
+	if spec.Up && !up {
+		plan.add(func(wg wgwrapper) (undoFunc, error) {
+			if err := wg.backend.LinkSetUp(wg.context(), name); err != nil {
+				return nil, wrapError("set interface up", name, err)
+			}
+			return func(wg wgwrapper) error {
+				return wrapError("set interface down", name, wg.backend.LinkSetDown(wg.context(), name))
+			}, nil
+		}, Change{Op: "set interface up", Target: name})
+	}
+	if !spec.Up && up {
+		plan.add(func(wg wgwrapper) (undoFunc, error) {
+			return wg.setLinkDown(name)
+		}, Change{Op: "set interface down", Target: name})
+	}
+
+	// routes
+	if !spec.Up {
+		return plan, nil
+	}
+	for _, cidr := range spec.Routes {
+		_, dst, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, wrapError("add route", name, err)
+		}
+		r := Route{Dst: *dst}
+		if ex {
+			existing, err := wg.findRoute(name, r)
+			if err != nil {
+				return nil, err
+			}
+			if existing != nil {
+				continue
+			}
+		}
+		plan.add(func(wg wgwrapper) (undoFunc, error) {
+			return wg.planRouteAdd(name, r)
+		}, Change{Op: "add route", Target: cidr})
+	}
+	if spec.RoutesFromPeers {
+		return plan, wg.planPeerRoutes(plan, spec, ex && up)
+	}
+
+	return plan, nil
+}
+
+// planPeerRoutes adds the changes to plan that make the routes of the
+// main table match the allowed IPs of spec.Peers, see SyncRoutes.
+// Networks of spec.Routes are left to them. up tells if the interface
+// exists and is up, links that are down have no routes.
+func (wg wgwrapper) planPeerRoutes(plan *Plan, spec InterfaceSpec, up bool) error {
+	name := spec.InterfaceName
+	given := []net.IPNet{}
+	for _, cidr := range spec.Routes {
+		_, dst, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return wrapError("add route", name, err)
+		}
+		given = append(given, *dst)
+	}
+	desired := []net.IPNet{}
+	for _, dst := range peerRoutes(specPeerAllowedIPs(spec.Peers), spec.Addresses) {
+		if indexOfIPNet(given, dst) == -1 {
+			desired = append(desired, dst)
+		}
+	}
+
+	current := []Route{}
+	if up {
+		var err error
+		current, err = wg.Routes(WireguardInterface{InterfaceName: name})
+		if err != nil {
+			return err
+		}
+	}
+	add, remove := diffRoutes(current, desired)
+	for _, r := range add {
+		r := r
+		plan.add(func(wg wgwrapper) (undoFunc, error) {
+			return wg.planRouteAdd(name, r)
+		}, Change{Op: "add route", Target: r.Dst.String()})
+	}
+	for _, r := range remove {
+		if indexOfIPNet(given, r.normalize().Dst) != -1 {
+			continue
+		}
+		r := r
+		plan.add(func(wg wgwrapper) (undoFunc, error) {
+			if err := wg.backend.RouteDel(wg.context(), name, r); err != nil {
+				return nil, wrapError("remove route", name, err)
+			}
+			return func(wg wgwrapper) error {
+				return wrapError("add route", name, wg.backend.RouteAdd(wg.context(), name, r))
+			}, nil
+		}, Change{Op: "remove route", Target: r.Dst.String()})
+	}
+	return nil
+}
+
+// planRouteAdd adds route r via link name, the undoFunc removes it
+func (wg wgwrapper) planRouteAdd(name string, r Route) (undoFunc, error) {
+	if err := wg.backend.RouteAdd(wg.context(), name, r); err != nil {
+		return nil, wrapError("add route", name, err)
+	}
+	return func(wg wgwrapper) error {
+		return wrapError("remove route", name, wg.backend.RouteDel(wg.context(), name, r))
+	}, nil
+}
+
+// setLinkDown sets link name down. As the kernel drops the routes of
+// links that are down, the undoFunc adds them again after setting
+// the link up, but those of addresses, which the kernel restores.
+func (wg wgwrapper) setLinkDown(name string) (undoFunc, error) {
+	routes, err := wg.Routes(WireguardInterface{InterfaceName: name})
+	if err != nil {
+		return nil, err
+	}
+	if err := wg.backend.LinkSetDown(wg.context(), name); err != nil {
+		return nil, wrapError("set interface down", name, err)
+	}
+	return func(wg wgwrapper) error {
+		if err := wg.backend.LinkSetUp(wg.context(), name); err != nil {
+			return wrapError("set interface up", name, err)
+		}
+		for _, r := range routes {
+			if r.Protocol == "kernel" {
+				continue
+			}
+			if err := wg.backend.RouteAdd(wg.context(), name, r); err != nil {
+				return wrapError("add route", name, err)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// planDevice adds the changes of key, listen port, firewall mark and
+// peers of the wireguard device to plan. ex tells if the interface exists.
+func (wg wgwrapper) planDevice(plan *Plan, spec InterfaceSpec, ex bool) error {
+	name := spec.InterfaceName
+
+	wgDevice := &wgtypes.Device{}
+	if ex {
+		wgClient, err := wg.newClient(wg.context())
+		if err != nil {
+			return wrapError("configure", name, err)
+		}
+		defer wgClient.Close()
+
+		wgDevice, err = wgClient.Device(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return wrapError("configure", name, err)
+		}
+		if err != nil {
+			// a link that is not (yet) known to wireguard
+			wgDevice = &wgtypes.Device{}
+		}
+	}
+
+	changes := []Change{}
+	cfg := wgtypes.Config{}
+
+	// a given or stored key, as for Configure. A stored key must
+	// match the one of the device, a given key replaces it.
+	key, stored, err := wg.interfaceKey(&WireguardInterface{InterfaceName: name, PrivateKey: spec.PrivateKey})
+	if err != nil {
+		return wrapError("configure", name, err)
+	}
+	hasKey := wgDevice.PrivateKey != (wgtypes.Key{})
+	switch {
+	case key != nil && *key != wgDevice.PrivateKey:
+		if spec.PrivateKey == "" && hasKey {
+			return wrapError("configure", name, fmt.Errorf("%w: has public key %s, expected %s", ErrKeyMismatch, wgDevice.PublicKey, key.PublicKey()))
+		}
+		cfg.PrivateKey = key
+		changes = append(changes, Change{
+			Op:     "set private key",
+			Target: key.PublicKey().String(),
+			Fields: []FieldChange{keyField("public key", wgDevice.PublicKey, key.PublicKey())},
+		})
+	case key == nil && !hasKey:
+		newKey, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return wrapError("configure", name, err)
+		}
+		cfg.PrivateKey = &newKey
+		changes = append(changes, Change{Op: "generate private key", Target: newKey.PublicKey().String()})
+	}
+
+	if spec.ListenPort != 0 && spec.ListenPort != wgDevice.ListenPort {
+		port := spec.ListenPort
+		cfg.ListenPort = &port
+		c := Change{Op: "set listen port", Target: fmt.Sprintf("%d", port)}
+		if wgDevice.ListenPort != 0 {
+			c.Fields = []FieldChange{{Field: "listen port", Before: fmt.Sprintf("%d", wgDevice.ListenPort), After: c.Target}}
+		}
+		changes = append(changes, c)
+	}
+
+	if spec.FirewallMark != 0 && spec.FirewallMark != wgDevice.FirewallMark {
+		mark := spec.FirewallMark
+		cfg.FirewallMark = &mark
+		c := Change{Op: "set firewall mark", Target: fmt.Sprintf("%d", mark)}
+		if wgDevice.FirewallMark != 0 {
+			c.Fields = []FieldChange{{Field: "firewall mark", Before: fmt.Sprintf("%d", wgDevice.FirewallMark), After: c.Target}}
+		}
+		changes = append(changes, c)
+	}
+
+	peers, peerChanges, err := diffPeers(wg.context(), wgDevice.Peers, spec.Peers)
+	if err != nil {
+		return wrapError("configure", name, err)
+	}
+	cfg.Peers = peers
+	changes = append(changes, peerChanges...)
+
+	// the key is stored once the device has it, see rotateKey
+	configure := len(changes) > 0
+	keyStore := wg.keyStore
+	var storeKey *wgtypes.Key
+	if keyStore != nil && !stored {
+		storeKey = cfg.PrivateKey
+		if storeKey == nil {
+			storeKey = &wgDevice.PrivateKey
+			changes = append(changes, Change{Op: "store private key", Target: wgDevice.PublicKey.String()})
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	// restore reverts cfg, key store aside
+	restore := wgtypes.Config{Peers: restorePeerConfigs(wgDevice.Peers, cfg.Peers)}
+	if cfg.PrivateKey != nil {
+		restore.PrivateKey = &wgDevice.PrivateKey
+	}
+	if cfg.ListenPort != nil {
+		restore.ListenPort = &wgDevice.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		restore.FirewallMark = &wgDevice.FirewallMark
+	}
+	previous := wgDevice.PrivateKey
+
+	plan.add(func(wg wgwrapper) (undoFunc, error) {
+		var undo undoFunc
+		if configure {
+			wgClient, err := wg.newClient(wg.context())
+			if err != nil {
+				return nil, wrapError("configure", name, err)
+			}
+			defer wgClient.Close()
+
+			if err := wgClient.ConfigureDevice(name, cfg); err != nil {
+				return nil, wrapError("configure", name, err)
+			}
+			undo = configureUndo(WireguardInterface{InterfaceName: name}, restore)
+		}
+		if storeKey == nil {
+			return undo, nil
+		}
+
+		// a failure to store reverts the device along with the plan
+		if err := keyStore.Store(name, storeKey.String()); err != nil {
+			return undo, wrapError("configure", name, fmt.Errorf("unable to store key: %w", err))
+		}
+		if undo == nil || previous == (wgtypes.Key{}) {
+			return undo, nil
+		}
+		return func(wg wgwrapper) error {
+			if err := undo(wg); err != nil {
+				return err
+			}
+			if err := keyStore.Store(name, previous.String()); err != nil {
+				return wrapError("restore key", name, fmt.Errorf("unable to store key: %w", err))
+			}
+			return nil
+		}, nil
+	}, changes...)
+	return nil
+}
+
+// diffPeers compares the peers of a device with the desired ones,
+// resolving host names until ctx is done. Returns the configuration
+// of all peers to be added, updated and removed, and the corresponding
+// changes. Unchanged peers are not part of the configuration, so their
+// sessions are not disturbed.
+func diffPeers(ctx context.Context, current []wgtypes.Peer, desired []WireguardPeer) ([]wgtypes.PeerConfig, []Change, error) {
+	configs := []wgtypes.PeerConfig{}
+	changes := []Change{}
+
+	byKey := make(map[wgtypes.Key]*wgtypes.Peer, len(current))
+	for idx := range current {
+		byKey[current[idx].PublicKey] = &current[idx]
+	}
+
+	wanted := map[wgtypes.Key]bool{}
+	for _, peer := range desired {
+		pc, err := peerConfig(ctx, peer)
+		if err != nil {
+			return nil, nil, err
+		}
+		if pc.PresharedKey == nil {
+			// the desired state of a peer without Psk is no preshared key
+			pc.PresharedKey = &wgtypes.Key{}
+		}
+		if wanted[pc.PublicKey] {
+			return nil, nil, fmt.Errorf("duplicate peer %s", peer.Pubkey)
+		}
+		wanted[pc.PublicKey] = true
+
+		existing, ok := byKey[pc.PublicKey]
+		if !ok {
+			configs = append(configs, pc)
+			changes = append(changes, Change{
+				Op:     "add peer",
+				Target: peer.Pubkey,
+				Fields: peerFieldChanges(wgtypes.Peer{}, pc),
+			})
+			continue
+		}
+		if fields := peerFieldChanges(*existing, pc); len(fields) > 0 {
+			pc.ReplaceAllowedIPs = true
+			configs = append(configs, pc)
+			changes = append(changes, Change{Op: "update peer", Target: peer.Pubkey, Fields: fields})
+		}
+	}
+	for _, p := range current {
+		if !wanted[p.PublicKey] {
+			configs = append(configs, wgtypes.PeerConfig{
+				PublicKey: p.PublicKey,
+				Remove:    true,
+			})
+			changes = append(changes, Change{Op: "remove peer", Target: p.PublicKey.String()})
+		}
+	}
+
+	return configs, changes, nil
+}
+
+// keyState describes a secret key without revealing it
+func keyState(k wgtypes.Key) string {
+	if k == (wgtypes.Key{}) {
+		return ""
+	}
+	return "(hidden)"
+}
+
+// keyField describes the change of a public key
+func keyField(field string, before, after wgtypes.Key) FieldChange {
+	res := FieldChange{Field: field, After: after.String()}
+	if before != (wgtypes.Key{}) {
+		res.Before = before.String()
+	}
+	return res
+}
+
+// peerFieldChanges compares a peer of a device with its desired
+// configuration pc. Returns nothing if they match.
+func peerFieldChanges(p wgtypes.Peer, pc wgtypes.PeerConfig) []FieldChange {
+	res := []FieldChange{}
+
+	if pc.Endpoint != nil {
+		if p.Endpoint == nil || !pc.Endpoint.IP.Equal(p.Endpoint.IP) || pc.Endpoint.Port != p.Endpoint.Port {
+			f := FieldChange{Field: "endpoint", After: pc.Endpoint.String()}
+			if p.Endpoint != nil {
+				f.Before = p.Endpoint.String()
+			}
+			res = append(res, f)
+		}
+	}
+	if pc.PresharedKey != nil && *pc.PresharedKey != p.PresharedKey {
+		f := FieldChange{Field: "preshared key", Before: keyState(p.PresharedKey), After: keyState(*pc.PresharedKey)}
+		if f.Before != "" && f.After != "" {
+			f.After = "(changed)"
+		}
+		if f.Before != "" || f.After != "" {
+			res = append(res, f)
+		}
+	}
+	if pc.PersistentKeepaliveInterval != nil {
+		ka := pc.PersistentKeepaliveInterval.Truncate(time.Second)
+		if ka != p.PersistentKeepaliveInterval {
+			f := FieldChange{Field: "persistent keepalive"}
+			if p.PersistentKeepaliveInterval != 0 {
+				f.Before = p.PersistentKeepaliveInterval.String()
+			}
+			if ka != 0 {
+				f.After = ka.String()
+			}
+			res = append(res, f)
+		}
+	}
+
+	before := maskedNetworks(p.AllowedIPs)
+	after := maskedNetworks(pc.AllowedIPs)
+	for _, n := range before {
+		if indexOfIPNet(after, n) == -1 {
+			res = append(res, FieldChange{Field: "allowed ip", Before: n.String()})
+		}
+	}
+	for _, n := range after {
+		if indexOfIPNet(before, n) == -1 {
+			res = append(res, FieldChange{Field: "allowed ip", After: n.String()})
+		}
+	}
+
+	return res
+}
+
+// maskedNetworks returns the networks of a, without host bits
+// and duplicates
+func maskedNetworks(a []net.IPNet) []net.IPNet {
+	res := []net.IPNet{}
+	for _, n := range a {
+		m := net.IPNet{IP: normalizeIP(n.IP).Mask(n.Mask), Mask: n.Mask}
+		if indexOfIPNet(res, m) == -1 {
+			res = append(res, m)
+		}
+	}
+	return res
+}
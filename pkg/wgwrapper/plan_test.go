@@ -0,0 +1,181 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSpec() InterfaceSpec {
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	return InterfaceSpec{
+		InterfaceName: "wg-plan0",
+		Addresses: []net.IPNet{{
+			IP:   net.IPv4(10, 99, 97, 1),
+			Mask: net.CIDRMask(24, 32),
+		}},
+		PrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		ListenPort: 46533,
+		Peers: []WireguardPeer{{
+			RemoteEndpointIP: "10.1.2.3",
+			ListenPort:       43210,
+			Pubkey:           "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+			AllowedIPs:       []net.IPNet{*n1},
+		}},
+		Routes: []string{"10.1.0.0/16"},
+		Up:     true,
+	}
+}
+
+func TestPlanDoesNotModify(t *testing.T) {
+	wg := NewInMemory()
+	spec := testSpec()
+
+	plan, err := wg.Plan(spec)
+	if err != nil {
+		t.Fatalf("Unable to execute Plan: %s", err)
+	}
+	if plan.Empty() || len(plan.Changes) != 7 {
+		t.Errorf("Unexpected plan: %s", plan)
+	}
+
+	ex, err := wg.HasInterface(NewWireguardInterfaceNoAddr(spec.InterfaceName))
+	if err != nil || ex {
+		t.Errorf("Plan should not create the interface: %t, %v", ex, err)
+	}
+
+	changes, err := wg.ApplyPlan(plan)
+	if err != nil {
+		t.Fatalf("Unable to execute ApplyPlan: %s", err)
+	}
+	if !reflect.DeepEqual(changes, plan.Changes) {
+		t.Errorf("ApplyPlan should make the planned changes, got %v", changes)
+	}
+
+	plan, err = wg.Plan(spec)
+	if err != nil || !plan.Empty() {
+		t.Errorf("Plan after Apply should be empty: %v, %v", plan, err)
+	}
+	if plan.String() != "No changes for wg-plan0\n" {
+		t.Errorf("Unexpected text of empty plan: %q", plan.String())
+	}
+}
+
+func TestPlanRendering(t *testing.T) {
+	wg := NewInMemory()
+	spec := testSpec()
+	if _, err := wg.Apply(spec); err != nil {
+		t.Fatalf("Unable to execute Apply: %s", err)
+	}
+
+	_, n2, _ := net.ParseCIDR("10.2.0.0/16")
+	psk := "xqr+unDSDc5Fq0W9Zp2SJlzr+wOaFAquNdIMwPLHarw="
+	spec.Addresses[0].IP = net.IPv4(10, 99, 97, 2)
+	spec.ListenPort = 46534
+	spec.Peers[0].RemoteEndpointIP = "10.1.2.4"
+	spec.Peers[0].AllowedIPs = []net.IPNet{*n2}
+	spec.Peers[0].Psk = &psk
+	spec.Peers[0].PersistentKeepaliveInterval = 25 * time.Second
+
+	plan, err := wg.Plan(spec)
+	if err != nil {
+		t.Fatalf("Unable to execute Plan: %s", err)
+	}
+
+	expected := `Plan for wg-plan0: 4 change(s)
+  - remove address 10.99.97.1/24
+  + add address 10.99.97.2/24
+  ~ set listen port 46534
+      listen port: 46533 -> 46534
+  ~ update peer 9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=
+      endpoint: 10.1.2.3:43210 -> 10.1.2.4:43210
+      preshared key: + (hidden)
+      persistent keepalive: + 25s
+      allowed ip: - 10.1.0.0/16
+      allowed ip: + 10.2.0.0/16
+`
+	if plan.String() != expected {
+		t.Errorf("Unexpected text of plan:\n%s\nexpected:\n%s", plan, expected)
+	}
+	if strings.Contains(plan.String(), psk) {
+		t.Error("Plan should not reveal preshared keys")
+	}
+
+	b, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatalf("Unable to marshal plan: %s", err)
+	}
+	var decoded Plan
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("Unable to unmarshal plan: %s", err)
+	}
+	if decoded.InterfaceName != "wg-plan0" || !reflect.DeepEqual(decoded.Changes, plan.Changes) {
+		t.Errorf("Unexpected JSON of plan: %s", b)
+	}
+	if !strings.Contains(string(b), `{"field":"allowed ip","after":"10.2.0.0/16"}`) {
+		t.Errorf("Unexpected JSON of plan: %s", b)
+	}
+}
+
+func TestApplyPlanRollback(t *testing.T) {
+	k := newMemoryKernel()
+	c := &failingClient{wgClient: k, skip: -1}
+	wg := newInMemory(k, c)
+	spec := testSpec()
+	spec.MTU = 1400
+	if _, err := wg.Apply(spec); err != nil {
+		t.Fatalf("Unable to execute Apply: %s", err)
+	}
+
+	changed := testSpec()
+	changed.MTU = 1380
+	changed.Addresses[0].IP = net.IPv4(10, 99, 96, 1)
+	changed.ListenPort = 46534
+	changed.Peers = append(changed.Peers, batchPeers(t, 1)...)
+	changed.Routes = []string{"10.2.0.0/16"}
+	plain := wg
+	unchanged := func() {
+		t.Helper()
+		plan, err := plain.Plan(spec)
+		if err != nil {
+			t.Fatalf("Unable to execute Plan: %s", err)
+		}
+		if !plan.Empty() {
+			t.Errorf("Failed Apply should leave the interface unchanged, got:\n%s", plan)
+		}
+	}
+
+	// the device refuses the configuration, after the link attributes
+	// and addresses changed
+	c.skip = 0
+	changes, err := wg.Apply(changed)
+	if err == nil || len(changes) != 0 {
+		t.Fatalf("Apply should fail without changes, got: %v, %v", changes, err)
+	}
+	unchanged()
+
+	// the key cannot be stored, the device is configured back
+	c.skip = -1
+	wg = newInMemory(k, c, WithKeyStore(readOnlyKeyStore{mapKeyStore{}}))
+	if _, err := wg.Apply(changed); !errors.Is(err, ErrKeyStoreReadOnly) {
+		t.Fatalf("Apply should fail with ErrKeyStoreReadOnly, got: %v", err)
+	}
+	unchanged()
+
+	// neither can the device be configured back
+	c.skip = 1
+	_, err = wg.Apply(changed)
+	var re *RollbackError
+	if !errors.As(err, &re) {
+		t.Fatalf("Expected a RollbackError, got: %v", err)
+	}
+	if !errors.Is(err, ErrKeyStoreReadOnly) {
+		t.Errorf("RollbackError should match the cause of the rollback, got: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// GeneratePresharedKey returns a new random preshared key, in base64
+func GeneratePresharedKey() (string, error) {
+	k, err := wgtypes.GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	return k.String(), nil
+}
+
+// PskRotation controls the scheduled rotation of preshared keys
+// by SchedulePskRotation
+type PskRotation struct {
+	// Interval is the time between two rotations
+	Interval time.Duration
+
+	// OnRotate receives the new preshared keys after each rotation,
+	// by public key of the peer. Peers need them to connect again.
+	OnRotate func(psks map[string]string)
+
+	// OnError receives errors of rotations, SchedulePskRotation
+	// keeps going and tries again at the next interval
+	OnError func(err error)
+}
+
+// SetPresharedKey sets the preshared key of an existing peer. Fails
+// with ErrPeerNotFound if the interface has no such peer.
+func (wg wgwrapper) SetPresharedKey(intf WireguardInterface, pubkey string, psk string) error {
+	_, err := wg.setPresharedKey("set preshared key", intf, pubkey, &psk)
+	return err
+}
+
+// ClearPresharedKey removes the preshared key of an existing peer.
+// Fails with ErrPeerNotFound if the interface has no such peer.
+func (wg wgwrapper) ClearPresharedKey(intf WireguardInterface, pubkey string) error {
+	_, err := wg.setPresharedKey("clear preshared key", intf, pubkey, nil)
+	return err
+}
+
+// setPresharedKey implements SetPresharedKey and, for a nil
+// psk, ClearPresharedKey
+func (wg wgwrapper) setPresharedKey(op string, intf WireguardInterface, pubkey string, psk *string) (undoFunc, error) {
+	pk, err := wgtypes.ParseKey(pubkey)
+	if err != nil {
+		return nil, wrapError(op, intf.InterfaceName, invalidKey(err))
+	}
+	k := wgtypes.Key{}
+	if psk != nil {
+		k, err = wgtypes.ParseKey(*psk)
+		if err != nil {
+			return nil, wrapError(op, intf.InterfaceName, invalidKey(err))
+		}
+	}
+	return wg.setPresharedKeys(op, intf, map[wgtypes.Key]wgtypes.Key{pk: k})
+}
+
+// RotatePresharedKeys sets new preshared keys for the given peers in a
+// single device configuration. Returns the new keys by public key of
+// the peer. All peers must exist, otherwise ErrPeerNotFound is returned
+// and nothing is changed. Peers cannot connect until they know the new key.
+func (wg wgwrapper) RotatePresharedKeys(intf WireguardInterface, pubkeys []string) (map[string]string, error) {
+	psks, _, err := wg.rotatePresharedKeys(intf, pubkeys)
+	return psks, err
+}
+
+func (wg wgwrapper) rotatePresharedKeys(intf WireguardInterface, pubkeys []string) (map[string]string, undoFunc, error) {
+	keys := make(map[wgtypes.Key]wgtypes.Key, len(pubkeys))
+	res := make(map[string]string, len(pubkeys))
+	for _, pubkey := range pubkeys {
+		pk, err := wgtypes.ParseKey(pubkey)
+		if err != nil {
+			return nil, nil, wrapError("rotate preshared keys", intf.InterfaceName, invalidKey(err))
+		}
+		psk, err := wgtypes.GenerateKey()
+		if err != nil {
+			return nil, nil, wrapError("rotate preshared keys", intf.InterfaceName, err)
+		}
+		keys[pk] = psk
+		res[pk.String()] = psk.String()
+	}
+
+	undo, err := wg.setPresharedKeys("rotate preshared keys", intf, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, undo, nil
+}
+
+// setPresharedKeys sets the preshared keys of existing peers, by their
+// public keys, in a single device configuration. The undoFunc restores
+// the previous keys.
+func (wg wgwrapper) setPresharedKeys(op string, intf WireguardInterface, keys map[wgtypes.Key]wgtypes.Key) (undoFunc, error) {
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return nil, wrapError(op, intf.InterfaceName, err)
+	}
+	defer wgClient.Close()
+
+	wgDevice, err := wgClient.Device(intf.InterfaceName)
+	if err != nil {
+		return nil, wrapError(op, intf.InterfaceName, err)
+	}
+	previous := make(map[wgtypes.Key]wgtypes.Key, len(keys))
+	for _, p := range wgDevice.Peers {
+		if _, ok := keys[p.PublicKey]; ok {
+			previous[p.PublicKey] = p.PresharedKey
+		}
+	}
+
+	cfg := wgtypes.Config{Peers: make([]wgtypes.PeerConfig, 0, len(keys))}
+	restore := wgtypes.Config{Peers: make([]wgtypes.PeerConfig, 0, len(keys))}
+	for pk, psk := range keys {
+		before, ok := previous[pk]
+		if !ok {
+			return nil, wrapError(op, intf.InterfaceName, fmt.Errorf("%w: %s", ErrPeerNotFound, pk))
+		}
+		psk := psk
+		cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{PublicKey: pk, UpdateOnly: true, PresharedKey: &psk})
+		restore.Peers = append(restore.Peers, wgtypes.PeerConfig{PublicKey: pk, UpdateOnly: true, PresharedKey: &before})
+	}
+
+	err = wgClient.ConfigureDevice(intf.InterfaceName, cfg)
+	if err != nil {
+		return nil, wrapError(op, intf.InterfaceName, err)
+	}
+	return configureUndo(intf, restore), nil
+}
+
+// SchedulePskRotation rotates the preshared keys of the given peers
+// every r.Interval, see RotatePresharedKeys, and reports the new keys
+// to r.OnRotate. It runs until ctx, or the context of the wrapper, is
+// done, see WithContext, and returns its error.
+func (wg wgwrapper) SchedulePskRotation(ctx context.Context, intf WireguardInterface, pubkeys []string, r PskRotation) error {
+	if r.Interval <= 0 {
+		return wrapError("rotate preshared keys", intf.InterfaceName, errors.New("rotation interval must be positive"))
+	}
+	wctx := wg.context()
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wctx.Done():
+			return wctx.Err()
+		case <-ticker.C:
+			psks, err := wg.RotatePresharedKeys(intf, pubkeys)
+			if err != nil {
+				if r.OnError != nil {
+					r.OnError(err)
+				}
+				continue
+			}
+			if r.OnRotate != nil {
+				r.OnRotate(psks)
+			}
+		}
+	}
+}
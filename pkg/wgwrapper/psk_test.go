@@ -0,0 +1,170 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestGeneratePresharedKey(t *testing.T) {
+	k1, err := GeneratePresharedKey()
+	if err != nil {
+		t.Fatalf("Unable to generate preshared key: %s", err)
+	}
+	k2, _ := GeneratePresharedKey()
+	if _, err := wgtypes.ParseKey(k1); err != nil || k1 == k2 {
+		t.Errorf("Unexpected preshared keys %s and %s: %v", k1, k2, err)
+	}
+}
+
+// peerPsks returns the preshared keys of all peers, by public key,
+// as read from the device via c. IteratePeers does not reveal them.
+func peerPsks(t *testing.T, c wgClient, wgi WireguardInterface) map[string]string {
+	d, err := c.Device(wgi.InterfaceName)
+	if err != nil {
+		t.Fatalf("Unable to read device: %s", err)
+	}
+	res := map[string]string{}
+	for _, p := range d.Peers {
+		if p.PresharedKey != (wgtypes.Key{}) {
+			res[p.PublicKey.String()] = p.PresharedKey.String()
+		}
+	}
+	return res
+}
+
+func TestPresharedKeys(t *testing.T) {
+	wg, c := newRecordingInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	peers := batchPeers(t, 3)
+	for _, p := range peers {
+		if _, err := wg.AddPeer(wgi, p); err != nil {
+			t.Fatalf("Unable to execute AddPeer: %s", err)
+		}
+	}
+	for _, cfg := range c.configs {
+		if cfg.Peers[0].PresharedKey != nil {
+			t.Errorf("Peer without Psk should be added without preshared key: %v", cfg.Peers[0].PresharedKey)
+		}
+	}
+
+	psk, _ := GeneratePresharedKey()
+	if err := wg.SetPresharedKey(wgi, peers[0].Pubkey, psk); err != nil {
+		t.Fatalf("Unable to execute SetPresharedKey: %s", err)
+	}
+	if psks := peerPsks(t, c, wgi); len(psks) != 1 || psks[peers[0].Pubkey] != psk {
+		t.Errorf("Unexpected preshared keys: %v", psks)
+	}
+	if err := wg.ClearPresharedKey(wgi, peers[0].Pubkey); err != nil {
+		t.Fatalf("Unable to execute ClearPresharedKey: %s", err)
+	}
+	if psks := peerPsks(t, c, wgi); len(psks) != 0 {
+		t.Errorf("Expected no preshared keys, got %v", psks)
+	}
+
+	unknown := batchPeers(t, 1)[0].Pubkey
+	if err := wg.SetPresharedKey(wgi, unknown, psk); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("SetPresharedKey of unknown peer should fail with ErrPeerNotFound, got: %v", err)
+	}
+	if err := wg.SetPresharedKey(wgi, peers[0].Pubkey, "invalid"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("SetPresharedKey with invalid key should fail with ErrInvalidKey, got: %v", err)
+	}
+
+	// rotation sets new keys in a single configuration
+	c.configs = nil
+	pubkeys := []string{peers[0].Pubkey, peers[1].Pubkey}
+	rotated, err := wg.RotatePresharedKeys(wgi, pubkeys)
+	if err != nil || len(rotated) != 2 || len(c.configs) != 1 {
+		t.Fatalf("Unexpected result of RotatePresharedKeys: %v, %v", rotated, err)
+	}
+	psks := peerPsks(t, c, wgi)
+	if len(psks) != 2 || psks[peers[0].Pubkey] != rotated[peers[0].Pubkey] || psks[peers[1].Pubkey] != rotated[peers[1].Pubkey] {
+		t.Errorf("Unexpected preshared keys: %v, expected %v", psks, rotated)
+	}
+
+	// nothing changes if a peer is missing
+	_, err = wg.RotatePresharedKeys(wgi, append(pubkeys, unknown))
+	if !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("RotatePresharedKeys of unknown peer should fail with ErrPeerNotFound, got: %v", err)
+	}
+	if after := peerPsks(t, c, wgi); after[peers[0].Pubkey] != psks[peers[0].Pubkey] {
+		t.Errorf("Expected preshared keys to be unchanged")
+	}
+
+	// rollback restores previous keys
+	tx := wg.Begin()
+	if _, err := tx.RotatePresharedKeys(wgi, []string{peers[0].Pubkey, peers[2].Pubkey}); err != nil {
+		t.Fatalf("Unable to execute RotatePresharedKeys: %s", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Unable to roll back: %s", err)
+	}
+	if after := peerPsks(t, c, wgi); len(after) != 2 || after[peers[0].Pubkey] != psks[peers[0].Pubkey] {
+		t.Errorf("Expected preshared keys to be restored, got %v", after)
+	}
+
+	// SyncPeers removes preshared keys of peers without Psk
+	c.configs = nil
+	changes, err := wg.SyncPeers(wgi, peers)
+	if err != nil || len(changes) != 2 {
+		t.Errorf("Unexpected result of SyncPeers: %v, %v", changeStrings(changes), err)
+	}
+	if after := peerPsks(t, c, wgi); len(after) != 0 {
+		t.Errorf("Expected no preshared keys, got %v", after)
+	}
+}
+
+func TestSchedulePskRotation(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	peers := batchPeers(t, 2)
+	if _, err := wg.AddPeers(wgi, peers); err != nil {
+		t.Fatalf("Unable to execute AddPeers: %s", err)
+	}
+
+	rotated := make(chan map[string]string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- wg.SchedulePskRotation(ctx, wgi, []string{peers[1].Pubkey}, PskRotation{
+			Interval: 10 * time.Millisecond,
+			OnRotate: func(psks map[string]string) {
+				rotated <- psks
+			},
+		})
+	}()
+
+	select {
+	case psks := <-rotated:
+		if len(psks) != 1 || psks[peers[1].Pubkey] == "" {
+			t.Errorf("Unexpected preshared keys: %v", psks)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected preshared keys to be rotated")
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected SchedulePskRotation to end with context.Canceled, got: %v", err)
+	}
+
+	// the context of the wrapper ends it as well
+	err := wg.WithContext(ctx).SchedulePskRotation(context.Background(), wgi, nil, PskRotation{Interval: time.Hour})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected SchedulePskRotation to end with context.Canceled, got: %v", err)
+	}
+	if err := wg.SchedulePskRotation(context.Background(), wgi, nil, PskRotation{}); err == nil {
+		t.Errorf("SchedulePskRotation without interval should fail")
+	}
+}
@@ -0,0 +1,136 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// KeyRotation controls the scheduled key rotation of ScheduleKeyRotation
+type KeyRotation struct {
+	// Interval is the time between two rotations
+	Interval time.Duration
+
+	// OnRotate receives the interface with its new public key after
+	// each rotation, along with the public key it had before. Peers
+	// need the new key to connect again.
+	OnRotate func(intf WireguardInterface, previousPublicKey string)
+
+	// OnError receives errors of rotations, ScheduleKeyRotation
+	// keeps going and tries again at the next interval
+	OnError func(err error)
+}
+
+// RotateKey replaces the private key of an interface with a newly
+// generated one, and updates intf.PublicKey, as well as intf.PrivateKey
+// if set. The new key is saved in the key store, if any, see
+// WithKeyStore. Sessions with peers end, they cannot connect again
+// until they know the new public key.
+func (wg wgwrapper) RotateKey(intf *WireguardInterface) error {
+	_, err := wg.rotateKey(intf)
+	return err
+}
+
+// rotateKey implements RotateKey. The undoFunc restores the
+// previous key of the device and intf.
+func (wg wgwrapper) rotateKey(intf *WireguardInterface) (undoFunc, error) {
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return nil, wrapError("rotate key", intf.InterfaceName, err)
+	}
+	defer wgClient.Close()
+
+	wgDevice, err := wgClient.Device(intf.InterfaceName)
+	if err != nil {
+		return nil, wrapError("rotate key", intf.InterfaceName, err)
+	}
+	previous := wgDevice.PrivateKey
+
+	newKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, wrapError("rotate key", intf.InterfaceName, err)
+	}
+	err = wgClient.ConfigureDevice(intf.InterfaceName, wgtypes.Config{PrivateKey: &newKey})
+	if err != nil {
+		return nil, wrapError("rotate key", intf.InterfaceName, err)
+	}
+
+	// the key is stored once the device has it, a key store
+	// holding a key the device never got breaks Configure
+	if wg.keyStore != nil {
+		if err := wg.keyStore.Store(intf.InterfaceName, newKey.String()); err != nil {
+			err = wrapError("rotate key", intf.InterfaceName, fmt.Errorf("unable to store key: %w", err))
+			if uerr := wgClient.ConfigureDevice(intf.InterfaceName, wgtypes.Config{PrivateKey: &previous}); uerr != nil {
+				return nil, &RollbackError{Err: err, Errors: []error{wrapError("restore key", intf.InterfaceName, uerr)}}
+			}
+			return nil, err
+		}
+	}
+
+	setKeys := func(k wgtypes.Key) {
+		intf.PublicKey = k.PublicKey().String()
+		if intf.PrivateKey != "" {
+			intf.PrivateKey = k.String()
+		}
+	}
+	setKeys(newKey)
+
+	name := intf.InterfaceName
+	return func(wg wgwrapper) error {
+		wgClient, err := wg.newClient(wg.context())
+		if err != nil {
+			return wrapError("restore key", name, err)
+		}
+		defer wgClient.Close()
+
+		err = wgClient.ConfigureDevice(name, wgtypes.Config{PrivateKey: &previous})
+		if err != nil {
+			return wrapError("restore key", name, err)
+		}
+		if wg.keyStore != nil && previous != (wgtypes.Key{}) {
+			if err := wg.keyStore.Store(name, previous.String()); err != nil {
+				return wrapError("restore key", name, fmt.Errorf("unable to store key: %w", err))
+			}
+		}
+		setKeys(previous)
+		return nil
+	}, nil
+}
+
+// ScheduleKeyRotation rotates the key of an interface every r.Interval,
+// see RotateKey, and reports each rotation to r.OnRotate. It runs until
+// ctx, or the context of the wrapper, is done, see WithContext, and
+// returns its error.
+func (wg wgwrapper) ScheduleKeyRotation(ctx context.Context, intf WireguardInterface, r KeyRotation) error {
+	if r.Interval <= 0 {
+		return wrapError("rotate key", intf.InterfaceName, errors.New("rotation interval must be positive"))
+	}
+	wctx := wg.context()
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wctx.Done():
+			return wctx.Err()
+		case <-ticker.C:
+			previous := intf.PublicKey
+			if err := wg.RotateKey(&intf); err != nil {
+				if r.OnError != nil {
+					r.OnError(err)
+				}
+				continue
+			}
+			if r.OnRotate != nil {
+				r.OnRotate(intf, previous)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestRotateKey(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	wgi.ListenPort = 46534
+	key, _ := wgtypes.GeneratePrivateKey()
+	wgi.PrivateKey = key.String()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := wg.Configure(&wgi); err != nil {
+		t.Fatalf("Unable to execute Configure: %s", err)
+	}
+
+	if err := wg.RotateKey(&wgi); err != nil {
+		t.Fatalf("Unable to execute RotateKey: %s", err)
+	}
+	if wgi.PublicKey == key.PublicKey().String() || wgi.PrivateKey == key.String() {
+		t.Errorf("Expected keys to change")
+	}
+	newKey, err := wgtypes.ParseKey(wgi.PrivateKey)
+	if err != nil || newKey.PublicKey().String() != wgi.PublicKey {
+		t.Errorf("Expected a matching key pair, got %s and %s", wgi.PrivateKey, wgi.PublicKey)
+	}
+
+	// the rotated key is the one of the interface now
+	if err := wg.Configure(&wgi); err != nil {
+		t.Errorf("Configure with the rotated key should succeed, got: %v", err)
+	}
+
+	// rollback restores interface and keys
+	rotated := wgi
+	tx := wg.Begin()
+	if err := tx.RotateKey(&wgi); err != nil {
+		t.Fatalf("Unable to execute RotateKey: %s", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Unable to roll back: %s", err)
+	}
+	if wgi.PublicKey != rotated.PublicKey || wgi.PrivateKey != rotated.PrivateKey {
+		t.Errorf("Expected keys to be restored, got %#v", wgi)
+	}
+	if err := wg.Configure(&wgi); err != nil {
+		t.Errorf("Expected key of interface to be restored, got: %v", err)
+	}
+
+	err = wg.RotateKey(&WireguardInterface{InterfaceName: "wgtst-none"})
+	if !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("RotateKey on nonexisting interface should fail with ErrInterfaceNotFound, got: %v", err)
+	}
+}
+
+// readOnlyKeyStore loads keys from a mapKeyStore, but refuses to store them
+type readOnlyKeyStore struct {
+	mapKeyStore
+}
+
+func (s readOnlyKeyStore) Store(interfaceName string, key string) error {
+	return ErrKeyStoreReadOnly
+}
+
+func TestRotateKeyFailure(t *testing.T) {
+	k := newMemoryKernel()
+	c := &failingClient{wgClient: k, skip: -1}
+	ks := mapKeyStore{}
+	wg := newInMemory(k, c, WithKeyStore(ks))
+	wgi := newWGIntf()
+	wgi.ListenPort = 46534
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := wg.Configure(&wgi); err != nil {
+		t.Fatalf("Unable to execute Configure: %s", err)
+	}
+	stored, publicKey := ks[wgi.InterfaceName], wgi.PublicKey
+
+	// the device refuses the new key, the stored one stays
+	c.skip = 0
+	if err := wg.RotateKey(&wgi); err == nil {
+		t.Fatal("RotateKey should fail but did not")
+	}
+	if ks[wgi.InterfaceName] != stored || wgi.PublicKey != publicKey {
+		t.Errorf("Failed RotateKey should keep the key, got %s", wgi.PublicKey)
+	}
+	if err := wg.Configure(&wgi); err != nil {
+		t.Errorf("Configure after failed RotateKey should succeed, got: %v", err)
+	}
+
+	// the key cannot be stored, the device gets its key back
+	wg = newInMemory(k, c, WithKeyStore(readOnlyKeyStore{ks}))
+	if err := wg.RotateKey(&wgi); !errors.Is(err, ErrKeyStoreReadOnly) {
+		t.Fatalf("RotateKey should fail with ErrKeyStoreReadOnly, got: %v", err)
+	}
+	if wgi.PublicKey != publicKey {
+		t.Errorf("Failed RotateKey should keep the key, got %s", wgi.PublicKey)
+	}
+	if err := wg.Configure(&wgi); err != nil {
+		t.Errorf("Configure after failed RotateKey should succeed, got: %v", err)
+	}
+}
+
+func TestScheduleKeyRotation(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	wgi.ListenPort = 46534
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := wg.Configure(&wgi); err != nil {
+		t.Fatalf("Unable to execute Configure: %s", err)
+	}
+
+	type rotation struct {
+		intf     WireguardInterface
+		previous string
+	}
+	rotated := make(chan rotation, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- wg.ScheduleKeyRotation(ctx, wgi, KeyRotation{
+			Interval: 10 * time.Millisecond,
+			OnRotate: func(intf WireguardInterface, previous string) {
+				rotated <- rotation{intf, previous}
+			},
+		})
+	}()
+
+	previous := wgi.PublicKey
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-rotated:
+			if r.previous != previous || r.intf.PublicKey == previous {
+				t.Errorf("Unexpected rotation from %s to %s, expected from %s", r.previous, r.intf.PublicKey, previous)
+			}
+			previous = r.intf.PublicKey
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected key to be rotated")
+		}
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected ScheduleKeyRotation to end with context.Canceled, got: %v", err)
+	}
+
+	// the context of the wrapper ends it as well
+	err := wg.WithContext(ctx).ScheduleKeyRotation(context.Background(), wgi, KeyRotation{Interval: time.Hour})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected ScheduleKeyRotation to end with context.Canceled, got: %v", err)
+	}
+
+	err = wg.ScheduleKeyRotation(context.Background(), wgi, KeyRotation{})
+	if err == nil {
+		t.Errorf("ScheduleKeyRotation without interval should fail")
+	}
+}
@@ -3,80 +3,296 @@
 package wgwrapper
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
-	"os/exec"
+	"net"
 	"strings"
+
+	"golang.org/x/sys/unix"
 )
 
-// SetRoute checks if there is a route on given interface to network. If not, adds it. all using /sbin/ip
-func (wg wgwrapper) SetRoute(intf WireguardInterface, networkCIDR string) error {
-	//
-	cmd := exec.Command("/sbin/ip", "route", "show", "dev", intf.InterfaceName)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
+// RouteScope is the scope of a route, named as by ip
+type RouteScope string
+
+const (
+	// ScopeLink is the scope of routes to hosts on the link, the default
+	ScopeLink RouteScope = "link"
+
+	// ScopeGlobal is the scope of routes via gateways
+	ScopeGlobal RouteScope = "global"
+
+	// ScopeSite is the scope of routes within a site (IPv6)
+	ScopeSite RouteScope = "site"
+
+	// ScopeHost is the scope of routes to the host itself
+	ScopeHost RouteScope = "host"
+)
+
+// PeerRouteProtocol is the protocol of the routes SyncRoutes adds for
+// the allowed IPs of peers. SyncRoutes only removes routes with it,
+// routes added otherwise are left alone.
+const PeerRouteProtocol = "77"
+
+// routeTableAll makes linkBackend.RouteList return the
+// routes of all tables but the local one
+const routeTableAll = -1
+
+// Route is a route via a wireguard interface
+type Route struct {
+	// Dst is the destination network
+	Dst net.IPNet
+
+	// Metric is the priority of the route, lower ones are preferred.
+	// The kernel turns 0 into 1024 for IPv6 routes.
+	Metric int
+
+	// Table is the routing table, 0 for the main table
+	Table int
+
+	// Src is the preferred source address of packets, if any.
+	// It must be an address of the host.
+	Src net.IP
+
+	// Scope of the route. Empty means ScopeLink when adding IPv4
+	// routes, and any scope when comparing them. The kernel lists
+	// all IPv6 routes with ScopeGlobal.
+	Scope RouteScope
+
+	// Protocol tells where a route comes from, e.g. "kernel" for the
+	// routes to the networks of addresses, "boot" for routes added by ip,
+	// PeerRouteProtocol for those of SyncRoutes. A name known to ip or a
+	// number up to 255. Empty means "boot" when adding routes.
+	Protocol string
+}
+
+// String renders the route like ip does
+func (r Route) String() string {
+	var sb strings.Builder
+	sb.WriteString(r.Dst.String())
+	if r.Table != 0 {
+		fmt.Fprintf(&sb, " table %d", r.Table)
+	}
+	if r.Protocol != "" && r.Protocol != "boot" {
+		fmt.Fprintf(&sb, " proto %s", r.Protocol)
+	}
+	if r.Scope != "" {
+		fmt.Fprintf(&sb, " scope %s", r.Scope)
+	}
+	if r.Src != nil {
+		fmt.Fprintf(&sb, " src %s", r.Src)
+	}
+	if r.Metric != 0 {
+		fmt.Fprintf(&sb, " metric %d", r.Metric)
+	}
+	return sb.String()
+}
+
+// normalize returns r with the network address of Dst, 4-byte
+// IPv4 addresses, the metric the kernel assigns and 0 for the main table
+func (r Route) normalize() Route {
+	ip := normalizeIP(r.Dst.IP)
+	r.Dst = net.IPNet{
+		IP:   ip.Mask(r.Dst.Mask),
+		Mask: r.Dst.Mask,
+	}
+	if r.Src != nil {
+		r.Src = normalizeIP(r.Src)
+	}
+	if r.Metric == 0 && ip.To4() == nil {
+		r.Metric = 1024
+	}
+	if r.Table == unix.RT_TABLE_MAIN {
+		r.Table = 0
+	}
+	return r
+}
+
+// sameKey checks if two routes have the same destination, table and
+// metric. The kernel keeps at most one route per key and interface.
+func (r Route) sameKey(o Route) bool {
+	r, o = r.normalize(), o.normalize()
+	return r.Dst.String() == o.Dst.String() && r.Table == o.Table && r.Metric == o.Metric
+}
+
+// matches checks if route o satisfies r. Unset scope
+// and source address of r match any.
+func (r Route) matches(o Route) bool {
+	if !r.sameKey(o) {
+		return false
+	}
+	if r.Scope != "" && r.Scope != o.Scope {
+		return false
+	}
+	return r.Src == nil || r.Src.Equal(o.Src)
+}
+
+// validRoute checks that r can be added via an interface
+func validRoute(r Route) error {
+	if r.Dst.IP == nil || r.Dst.Mask == nil {
+		return errors.New("route destination required")
+	}
+	ones, bits := r.Dst.Mask.Size()
+	if bits == 0 || ones > bits || (r.Dst.IP.To4() != nil) != (bits == 32) {
+		return fmt.Errorf("invalid route destination %s", r.Dst.String())
+	}
+	if r.Src != nil && (r.Src.To4() != nil) != (bits == 32) {
+		return fmt.Errorf("source address %s does not match destination %s", r.Src, r.Dst.String())
+	}
+	if r.Metric < 0 || int64(r.Metric) > 0xffffffff {
+		return fmt.Errorf("invalid metric %d", r.Metric)
+	}
+	if r.Table < 0 || int64(r.Table) > 0xffffffff || r.Table == unix.RT_TABLE_LOCAL {
+		return fmt.Errorf("invalid table %d", r.Table)
+	}
+	switch r.Scope {
+	case "", ScopeLink, ScopeGlobal, ScopeSite, ScopeHost:
+	default:
+		return fmt.Errorf("invalid scope %s", r.Scope)
+	}
+	if _, err := routeProtocol(r.Protocol); err != nil {
 		return err
 	}
-	outStr, errStr := string(stdout.Bytes()), string(stderr.Bytes())
-	if len(errStr) > 0 {
-		e := fmt.Sprintf("/sbin/ip reported: %s", errStr)
-		return errors.New(e)
+	return nil
+}
+
+// Routes returns the IPv4 and IPv6 routes via an interface,
+// of all routing tables but the local one
+func (wg wgwrapper) Routes(intf WireguardInterface) ([]Route, error) {
+	res := []Route{}
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		routes, err := wg.backend.RouteList(wg.context(), intf.InterfaceName, family, routeTableAll)
+		if err != nil {
+			return nil, wrapError("list routes", intf.InterfaceName, err)
+		}
+		res = append(res, routes...)
+	}
+	return res, nil
+}
+
+// findRoute returns the route via an interface with the same
+// destination, table and metric as r, or nil
+func (wg wgwrapper) findRoute(name string, r Route) (*Route, error) {
+	routes, err := wg.backend.RouteList(wg.context(), name, familyOf(r.Dst.IP), r.Table)
+	if err != nil {
+		return nil, wrapError("list routes", name, err)
 	}
-	a := strings.Split(outStr, " ")
-	if len(a) > 0 {
-		if a[0] == networkCIDR {
-			// route is already present
-			return nil
+	for _, e := range routes {
+		if r.sameKey(e) {
+			e := e
+			return &e, nil
 		}
 	}
+	return nil, nil
+}
+
+// AddRoute adds a route via an interface. Returns false if the interface
+// has the route already. Fails with ErrRouteExists if there is a route
+// with the same destination, table and metric, but other attributes,
+// see ReplaceRoute.
+func (wg wgwrapper) AddRoute(intf WireguardInterface, r Route) (bool, error) {
+	undo, err := wg.addRoute(intf, r)
+	return undo != nil, err
+}
 
-	//
-	cmd = exec.Command("/sbin/ip", "route", "add", networkCIDR, "dev", intf.InterfaceName)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
+func (wg wgwrapper) addRoute(intf WireguardInterface, r Route) (undoFunc, error) {
+	if err := validRoute(r); err != nil {
+		return nil, wrapError("add route", intf.InterfaceName, err)
+	}
+	existing, err := wg.findRoute(intf.InterfaceName, r)
 	if err != nil {
-		_, errStr = string(stdout.Bytes()), string(stderr.Bytes())
-		if len(errStr) > 0 {
-			e := fmt.Sprintf("/sbin/ip reported: %s", errStr)
-			return errors.New(e)
+		return nil, err
+	}
+	if existing != nil {
+		if r.matches(*existing) {
+			return nil, nil
 		}
+		return nil, wrapError("add route", intf.InterfaceName, fmt.Errorf("%w: %s", ErrRouteExists, existing))
+	}
 
-		return err
+	err = wg.backend.RouteAdd(wg.context(), intf.InterfaceName, r)
+	if err != nil {
+		return nil, wrapError("add route", intf.InterfaceName, err)
 	}
+	return func(wg wgwrapper) error {
+		return wrapError("delete route", intf.InterfaceName, wg.backend.RouteDel(wg.context(), intf.InterfaceName, r))
+	}, nil
+}
 
-	return nil
+// DeleteRoute removes the route via an interface with the destination,
+// table and metric of r. Returns false if there is none.
+func (wg wgwrapper) DeleteRoute(intf WireguardInterface, r Route) (bool, error) {
+	undo, err := wg.deleteRoute(intf, r)
+	return undo != nil, err
+}
+
+func (wg wgwrapper) deleteRoute(intf WireguardInterface, r Route) (undoFunc, error) {
+	if err := validRoute(r); err != nil {
+		return nil, wrapError("delete route", intf.InterfaceName, err)
+	}
+	existing, err := wg.findRoute(intf.InterfaceName, r)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+
+	err = wg.backend.RouteDel(wg.context(), intf.InterfaceName, *existing)
+	if err != nil {
+		return nil, wrapError("delete route", intf.InterfaceName, err)
+	}
+	return func(wg wgwrapper) error {
+		return wrapError("add route", intf.InterfaceName, wg.backend.RouteAdd(wg.context(), intf.InterfaceName, *existing))
+	}, nil
+}
+
+// ReplaceRoute adds a route via an interface, or changes the attributes
+// of the route with the same destination, table and metric.
+func (wg wgwrapper) ReplaceRoute(intf WireguardInterface, r Route) error {
+	_, err := wg.replaceRoute(intf, r)
+	return err
+}
+
+func (wg wgwrapper) replaceRoute(intf WireguardInterface, r Route) (undoFunc, error) {
+	if err := validRoute(r); err != nil {
+		return nil, wrapError("replace route", intf.InterfaceName, err)
+	}
+	existing, err := wg.findRoute(intf.InterfaceName, r)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && r.matches(*existing) {
+		return nil, nil
+	}
+
+	err = wg.backend.RouteReplace(wg.context(), intf.InterfaceName, r)
+	if err != nil {
+		return nil, wrapError("replace route", intf.InterfaceName, err)
+	}
+	return func(wg wgwrapper) error {
+		if existing == nil {
+			return wrapError("delete route", intf.InterfaceName, wg.backend.RouteDel(wg.context(), intf.InterfaceName, r))
+		}
+		return wrapError("replace route", intf.InterfaceName, wg.backend.RouteReplace(wg.context(), intf.InterfaceName, *existing))
+	}, nil
+}
+
+// SetRoute checks if there is a route on given interface to network. If not, adds it.
+func (wg wgwrapper) SetRoute(intf WireguardInterface, networkCIDR string) error {
+	_, err := wg.setRoute(intf, networkCIDR)
+	return err
+}
+
+func (wg wgwrapper) setRoute(intf WireguardInterface, networkCIDR string) (undoFunc, error) {
+	_, dst, err := net.ParseCIDR(networkCIDR)
+	if err != nil {
+		return nil, wrapError("add route", intf.InterfaceName, err)
+	}
+	return wg.addRoute(intf, Route{Dst: *dst})
 }
 
 // DefaultRouteInterface returns the interface name of the default route.
 func (wg wgwrapper) DefaultRouteInterface() (string, error) {
-	//
-	cmd := exec.Command("/sbin/ip", "route", "show", "default")
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+	res, err := wg.backend.DefaultRouteInterface(wg.context())
 	if err != nil {
-		return "", err
-	}
-	outStr, errStr := string(stdout.Bytes()), string(stderr.Bytes())
-	if len(errStr) > 0 {
-		e := fmt.Sprintf("/sbin/ip reported: %s", errStr)
-		return "", errors.New(e)
-	}
-	a := strings.Split(outStr, " ")
-	b := false
-	for _, p := range a {
-		if b {
-			return p, nil
-		}
-		if p == "dev" {
-			b = true
-		}
+		return "", wrapError("query default route", "", err)
 	}
-	return "", nil
+	return res, nil
 }
@@ -0,0 +1,167 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// routeStrings returns the sorted routes via an interface
+func routeStrings(t *testing.T, wg WireguardWrapper, wgi WireguardInterface) []string {
+	t.Helper()
+	routes, err := wg.Routes(wgi)
+	if err != nil {
+		t.Fatalf("Unable to execute Routes: %s", err)
+	}
+	res := []string{}
+	for _, r := range routes {
+		res = append(res, r.String())
+	}
+	sort.Strings(res)
+	return res
+}
+
+// mustRoute returns a route to the network of cidr
+func mustRoute(cidr string) Route {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return Route{Dst: *n}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := parseRoutes("default via 10.0.0.1 proto static metric 50 \n"+
+		"10.0.0.0/24 proto kernel scope link src 10.0.0.2 linkdown \n"+
+		"10.1.0.0/16 table 100 scope link metric 10 \n"+
+		"local 10.0.0.2 table local proto kernel scope host src 10.0.0.2 \n"+
+		"broadcast 10.0.0.255 table local proto kernel scope link src 10.0.0.2 \n"+
+		"unicast 10.2.3.4 table main scope link \n"+
+		"10.3.0.0/16 proto static \n\tnexthop via 10.0.0.3 weight 1 \n\tnexthop via 10.0.0.4 weight 1 \n", unix.AF_INET)
+	if err != nil {
+		t.Fatalf("Unable to parse routes: %s", err)
+	}
+	got := []string{}
+	for _, r := range routes {
+		got = append(got, r.String())
+	}
+	expected := []string{
+		"0.0.0.0/0 proto static scope global metric 50",
+		"10.0.0.0/24 proto kernel scope link src 10.0.0.2",
+		"10.1.0.0/16 table 100 scope link metric 10",
+		"10.2.3.4/32 scope link",
+		"10.3.0.0/16 proto static scope global",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected routes, expected %v, got %v", expected, got)
+	}
+
+	routes, err = parseRoutes("fd00:99::/64 proto kernel metric 256 pref medium\n"+
+		"fd01::1 dev wg0 metric 1024 pref medium\n"+
+		"default via fe80::1 proto ra metric 100 expires 1790sec hoplimit 64 pref high\n"+
+		"multicast ff00::/8 table local proto kernel metric 256 pref medium\n", unix.AF_INET6)
+	if err != nil {
+		t.Fatalf("Unable to parse routes: %s", err)
+	}
+	got = []string{}
+	for _, r := range routes {
+		got = append(got, r.String())
+	}
+	expected = []string{
+		"fd00:99::/64 proto kernel scope global metric 256",
+		"fd01::1/128 scope global metric 1024",
+		"::/0 proto ra scope global metric 100",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected routes, expected %v, got %v", expected, got)
+	}
+
+	if _, err := parseRoutes("10.1.0.0/16 table nope\n", unix.AF_INET); err == nil {
+		t.Error("parseRoutes with unknown table should fail but did not")
+	}
+}
+
+func TestRouteValidation(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := wg.SetInterfaceUp(wgi); err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp: %s", err)
+	}
+
+	withSrc := mustRoute("10.1.0.0/16")
+	withSrc.Src = net.ParseIP("fd00::1")
+	withTable := mustRoute("10.1.0.0/16")
+	withTable.Table = unix.RT_TABLE_LOCAL
+	withMetric := mustRoute("10.1.0.0/16")
+	withMetric.Metric = -1
+	withScope := mustRoute("10.1.0.0/16")
+	withScope.Scope = "nowhere"
+
+	for _, r := range []Route{
+		{},
+		{Dst: net.IPNet{IP: net.ParseIP("10.1.0.0"), Mask: net.CIDRMask(64, 128)}},
+		withSrc, withTable, withMetric, withScope,
+	} {
+		if _, err := wg.AddRoute(wgi, r); err == nil {
+			t.Errorf("AddRoute of %#v should fail but did not", r)
+		}
+		if err := wg.ReplaceRoute(wgi, r); err == nil {
+			t.Errorf("ReplaceRoute of %#v should fail but did not", r)
+		}
+	}
+	if r := routeStrings(t, wg, wgi); len(r) != 0 {
+		t.Errorf("Invalid routes should not change the interface, got: %v", r)
+	}
+}
+
+func TestTransactionRoutes(t *testing.T) {
+	wg := NewInMemory()
+	a4 := net.IPNet{IP: net.ParseIP("10.99.98.1"), Mask: net.CIDRMask(24, 32)}
+	wgi := NewWireguardInterfaceAddrs(newWGIntf().InterfaceName, []net.IPNet{a4})
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := wg.SetInterfaceUp(wgi); err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp: %s", err)
+	}
+	r1 := mustRoute("10.1.0.0/16")
+	if _, err := wg.AddRoute(wgi, r1); err != nil {
+		t.Fatalf("Unable to execute AddRoute: %s", err)
+	}
+	before := routeStrings(t, wg, wgi)
+
+	tx := wg.Begin()
+	if ok, err := tx.DeleteRoute(wgi, r1); err != nil || !ok {
+		t.Fatalf("Unexpected result of DeleteRoute: %t, %v", ok, err)
+	}
+	if ok, err := tx.DeleteRoute(wgi, mustRoute("10.1.0.0/16")); err != nil || ok {
+		t.Fatalf("DeleteRoute of a missing route should return false: %t, %v", ok, err)
+	}
+	r2 := mustRoute("10.2.0.0/16")
+	r2.Table = 100
+	if ok, err := tx.AddRoute(wgi, r2); err != nil || !ok {
+		t.Fatalf("Unexpected result of AddRoute: %t, %v", ok, err)
+	}
+	kernel := mustRoute("10.99.98.0/24")
+	kernel.Src = net.ParseIP("10.99.98.2")
+	if err := tx.ReplaceRoute(wgi, kernel); err == nil {
+		t.Fatal("ReplaceRoute with foreign source address should fail but did not")
+	}
+
+	// the failed step reverts the changes, in reverse order
+	if r := routeStrings(t, wg, wgi); !reflect.DeepEqual(r, before) {
+		t.Errorf("Failed transaction should restore routes %v, got: %v", before, r)
+	}
+	if _, err := tx.AddRoute(wgi, r1); !errors.Is(err, ErrTransactionDone) {
+		t.Errorf("Rolled back transaction should fail with ErrTransactionDone, got: %v", err)
+	}
+}
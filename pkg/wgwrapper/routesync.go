@@ -0,0 +1,193 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// SyncRoutes makes the routes via an interface in the main table match the
+// allowed IPs of its peers, like wg-quick does: missing routes are added
+// with PeerRouteProtocol, those with it that no peer needs any more are
+// removed. Other routes are left alone, a network routed already is not
+// added again. Allowed IPs within the network of an address of the
+// interface are left to the route the kernel has for it. Default routes
+// are not added, as they need policy routing. Returns the changes made.
+func (wg wgwrapper) SyncRoutes(intf WireguardInterface) ([]Change, error) {
+	changes, _, err := wg.syncRoutes(intf)
+	return changes, err
+}
+
+func (wg wgwrapper) syncRoutes(intf WireguardInterface) ([]Change, undoFunc, error) {
+	wgClient, err := wg.newClient(wg.context())
+	if err != nil {
+		return []Change{}, nil, wrapError("sync routes", intf.InterfaceName, err)
+	}
+	defer wgClient.Close()
+
+	wgDevice, err := wgClient.Device(intf.InterfaceName)
+	if err != nil {
+		return []Change{}, nil, wrapError("sync routes", intf.InterfaceName, err)
+	}
+	addrs, err := wg.Addresses(intf)
+	if err != nil {
+		return []Change{}, nil, err
+	}
+	current, err := wg.Routes(intf)
+	if err != nil {
+		return []Change{}, nil, err
+	}
+	add, remove := diffRoutes(current, peerRoutes(devicePeerAllowedIPs(wgDevice.Peers), addrs))
+
+	changes := []Change{}
+	added := []Route{}
+	removed := []Route{}
+	undo := func(wg wgwrapper) error {
+		for _, r := range removed {
+			if err := wg.backend.RouteAdd(wg.context(), intf.InterfaceName, r); err != nil {
+				return wrapError("add route", intf.InterfaceName, err)
+			}
+		}
+		for _, r := range added {
+			if err := wg.backend.RouteDel(wg.context(), intf.InterfaceName, r); err != nil {
+				return wrapError("remove route", intf.InterfaceName, err)
+			}
+		}
+		return nil
+	}
+
+	for _, r := range add {
+		if err := wg.backend.RouteAdd(wg.context(), intf.InterfaceName, r); err != nil {
+			return changes, undo, wrapError("add route", intf.InterfaceName, err)
+		}
+		added = append(added, r)
+		changes = append(changes, Change{Op: "add route", Target: r.Dst.String()})
+	}
+	for _, r := range remove {
+		if err := wg.backend.RouteDel(wg.context(), intf.InterfaceName, r); err != nil {
+			return changes, undo, wrapError("remove route", intf.InterfaceName, err)
+		}
+		removed = append(removed, r)
+		changes = append(changes, Change{Op: "remove route", Target: r.Dst.String()})
+	}
+	if len(changes) == 0 {
+		return changes, nil, nil
+	}
+	return changes, undo, nil
+}
+
+// syncPeerRoutes syncs the routes via an interface after its peers have
+// been changed, if enabled by WithRouteSync and the interface is up. The
+// kernel has no routes for links that are down. Returns undo, the
+// undoFunc of the peer change, extended to revert the routes as well.
+func (wg wgwrapper) syncPeerRoutes(intf WireguardInterface, undo undoFunc) (undoFunc, error) {
+	if !wg.routeSync {
+		return undo, nil
+	}
+	up, err := wg.backend.LinkIsUp(wg.context(), intf.InterfaceName)
+	if err != nil {
+		return undo, wrapError("sync routes", intf.InterfaceName, err)
+	}
+	if !up {
+		return undo, nil
+	}
+
+	_, routesUndo, err := wg.syncRoutes(intf)
+	if routesUndo == nil {
+		return undo, err
+	}
+	return func(wg wgwrapper) error {
+		if err := routesUndo(wg); err != nil {
+			return err
+		}
+		if undo == nil {
+			return nil
+		}
+		// the routes are restored already
+		wg.routeSync = false
+		return undo(wg)
+	}, err
+}
+
+// devicePeerAllowedIPs returns the allowed IPs of all peers of a device
+func devicePeerAllowedIPs(peers []wgtypes.Peer) []net.IPNet {
+	res := []net.IPNet{}
+	for _, p := range peers {
+		res = append(res, p.AllowedIPs...)
+	}
+	return res
+}
+
+// specPeerAllowedIPs returns the allowed IPs of all peers of a spec
+func specPeerAllowedIPs(peers []WireguardPeer) []net.IPNet {
+	res := []net.IPNet{}
+	for _, p := range peers {
+		res = append(res, p.AllowedIPs...)
+	}
+	return res
+}
+
+// peerRoutes returns the networks of allowed IPs that need a route via
+// an interface with addresses addrs, each once. Default routes are left
+// out, as are networks within the network of an address.
+func peerRoutes(allowedIPs []net.IPNet, addrs []net.IPNet) []net.IPNet {
+	res := []net.IPNet{}
+	for _, a := range allowedIPs {
+		dst := Route{Dst: a}.normalize().Dst
+		if isDefaultRoute(dst) || coveredByAddress(dst, addrs) || indexOfIPNet(res, dst) != -1 {
+			continue
+		}
+		res = append(res, dst)
+	}
+	return res
+}
+
+// isDefaultRoute checks if dst is 0.0.0.0/0 or ::/0
+func isDefaultRoute(dst net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// coveredByAddress checks if network dst is within the network of
+// one of addrs, which the kernel routes via the interface already
+func coveredByAddress(dst net.IPNet, addrs []net.IPNet) bool {
+	dstOnes, dstBits := dst.Mask.Size()
+	for _, a := range addrs {
+		ones, bits := a.Mask.Size()
+		if bits == dstBits && ones <= dstOnes && a.Contains(dst.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffRoutes compares the routes via an interface with the desired
+// networks. Returns the routes to be added, with PeerRouteProtocol, and
+// those to be removed, which are the ones of the main table with it.
+func diffRoutes(current []Route, desired []net.IPNet) ([]Route, []Route) {
+	routed := []net.IPNet{}
+	for _, r := range current {
+		if r.Table == 0 {
+			routed = append(routed, r.normalize().Dst)
+		}
+	}
+
+	add := []Route{}
+	for _, dst := range desired {
+		if indexOfIPNet(routed, dst) == -1 {
+			add = append(add, Route{Dst: dst, Protocol: PeerRouteProtocol})
+		}
+	}
+	remove := []Route{}
+	for _, r := range current {
+		if r.Table != 0 || r.Protocol != PeerRouteProtocol {
+			continue
+		}
+		if indexOfIPNet(desired, r.normalize().Dst) == -1 {
+			remove = append(remove, r)
+		}
+	}
+	return add, remove
+}
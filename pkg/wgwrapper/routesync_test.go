@@ -0,0 +1,195 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPeerRoutes(t *testing.T) {
+	parse := func(s ...string) []net.IPNet {
+		res := []net.IPNet{}
+		for _, c := range s {
+			ip, n, _ := net.ParseCIDR(c)
+			res = append(res, net.IPNet{IP: ip, Mask: n.Mask})
+		}
+		return res
+	}
+	routes := peerRoutes(
+		parse("10.1.2.3/16", "10.99.98.5/32", "0.0.0.0/0", "fd01::/64", "10.1.0.0/16", "::/0", "fd00:99::/56", "10.99.0.0/16"),
+		parse("10.99.98.1/24", "fd00:99::1/64"),
+	)
+	got := []string{}
+	for _, r := range routes {
+		got = append(got, r.String())
+	}
+	// networks larger than the one of an address need a route
+	expected := []string{"10.1.0.0/16", "fd01::/64", "fd00:99::/56", "10.99.0.0/16"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected routes, expected %v, got %v", expected, got)
+	}
+}
+
+func peerRoute(cidr string) Route {
+	r := mustRoute(cidr)
+	r.Protocol = PeerRouteProtocol
+	return r
+}
+
+func TestDiffRoutes(t *testing.T) {
+	kernel := mustRoute("10.99.98.0/24")
+	kernel.Protocol = "kernel"
+	other := peerRoute("10.5.0.0/16")
+	other.Table = 100
+	metric := mustRoute("10.1.0.0/16")
+	metric.Metric = 10
+	current := []Route{kernel, other, metric, peerRoute("10.2.0.0/16"), mustRoute("10.4.0.0/16"), mustRoute("0.0.0.0/0")}
+
+	add, remove := diffRoutes(current, []net.IPNet{mustRoute("10.1.0.0/16").Dst, mustRoute("10.3.0.0/16").Dst})
+	if !reflect.DeepEqual(add, []Route{peerRoute("10.3.0.0/16")}) {
+		t.Errorf("Unexpected routes to add: %v", add)
+	}
+	// only routes added for peers are removed
+	if !reflect.DeepEqual(remove, []Route{peerRoute("10.2.0.0/16")}) {
+		t.Errorf("Unexpected routes to remove: %v", remove)
+	}
+}
+
+func TestTransactionSyncRoutes(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := wg.SetInterfaceUp(wgi); err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp: %s", err)
+	}
+	if _, err := wg.AddPeer(wgi, batchPeers(t, 2)[1]); err != nil {
+		t.Fatalf("Unable to execute AddPeer: %s", err)
+	}
+	if _, err := wg.AddRoute(wgi, peerRoute("10.5.0.0/16")); err != nil {
+		t.Fatalf("Unable to execute AddRoute: %s", err)
+	}
+
+	tx := wg.Begin()
+	changes, err := tx.SyncRoutes(wgi)
+	if err != nil || !reflect.DeepEqual(changeStrings(changes), []string{"add route 10.0.0.1/32", "remove route 10.5.0.0/16"}) {
+		t.Fatalf("Unexpected result of SyncRoutes: %v, %v", changes, err)
+	}
+
+	// a failing step reverts the changes
+	if _, err := tx.AddRoute(wgi, Route{}); err == nil {
+		t.Fatal("AddRoute without destination should fail but did not")
+	}
+	if r := routeStrings(t, wg, wgi); !reflect.DeepEqual(r, []string{"10.5.0.0/16 proto 77 scope link"}) {
+		t.Errorf("Failed transaction should restore routes, got: %v", r)
+	}
+	if _, err := tx.SyncRoutes(wgi); !errors.Is(err, ErrTransactionDone) {
+		t.Errorf("Rolled back transaction should fail with ErrTransactionDone, got: %v", err)
+	}
+}
+
+func TestRouteSync(t *testing.T) {
+	wg := NewInMemory(WithRouteSync())
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	peers := batchPeers(t, 3)
+
+	// interfaces that are down have no routes
+	if _, err := wg.AddPeer(wgi, peers[0]); err != nil {
+		t.Fatalf("Unable to execute AddPeer: %s", err)
+	}
+	if r := routeStrings(t, wg, wgi); len(r) != 0 {
+		t.Errorf("Interface that is down should have no routes, got: %v", r)
+	}
+	if err := wg.SetInterfaceUp(wgi); err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp: %s", err)
+	}
+
+	if _, err := wg.AddPeer(wgi, peers[1]); err != nil {
+		t.Fatalf("Unable to execute AddPeer: %s", err)
+	}
+	expected := []string{"10.0.0.0/32 proto 77 scope link", "10.0.0.1/32 proto 77 scope link"}
+	if r := routeStrings(t, wg, wgi); !reflect.DeepEqual(r, expected) {
+		t.Errorf("AddPeer should add routes, expected %v, got: %v", expected, r)
+	}
+	if err := wg.RemovePeerByPubkey(wgi, peers[0].Pubkey); err != nil {
+		t.Fatalf("Unable to execute RemovePeerByPubkey: %s", err)
+	}
+	if _, err := wg.SyncPeers(wgi, peers[1:]); err != nil {
+		t.Fatalf("Unable to execute SyncPeers: %s", err)
+	}
+	expected = []string{"10.0.0.1/32 proto 77 scope link", "10.0.0.2/32 proto 77 scope link"}
+	if r := routeStrings(t, wg, wgi); !reflect.DeepEqual(r, expected) {
+		t.Errorf("RemovePeerByPubkey and SyncPeers should sync routes, expected %v, got: %v", expected, r)
+	}
+
+	// a failing transaction reverts peers and routes
+	tx := wg.Begin()
+	if _, err := tx.RemovePeers(wgi, []string{peers[1].Pubkey, peers[2].Pubkey}); err != nil {
+		t.Fatalf("Unable to execute RemovePeers: %s", err)
+	}
+	if r := routeStrings(t, wg, wgi); len(r) != 0 {
+		t.Errorf("RemovePeers should remove routes, got: %v", r)
+	}
+	if _, err := tx.AddRoute(wgi, Route{}); err == nil {
+		t.Fatal("AddRoute without destination should fail but did not")
+	}
+	if r := routeStrings(t, wg, wgi); !reflect.DeepEqual(r, expected) {
+		t.Errorf("Failed transaction should restore routes, expected %v, got: %v", expected, r)
+	}
+	if n := countPeers(t, wg, wgi); n != 2 {
+		t.Errorf("Failed transaction should restore peers, got %d", n)
+	}
+}
+
+func TestApplyRoutesFromPeers(t *testing.T) {
+	wg := NewInMemory()
+	a4 := net.IPNet{IP: net.ParseIP("10.99.98.1"), Mask: net.CIDRMask(24, 32)}
+	peers := batchPeers(t, 2)
+	spec := InterfaceSpec{
+		InterfaceName:   newWGIntf().InterfaceName,
+		Addresses:       []net.IPNet{a4},
+		ListenPort:      51820,
+		Peers:           peers,
+		Routes:          []string{"10.5.0.0/16"},
+		RoutesFromPeers: true,
+		Up:              true,
+	}
+	defer wg.DeleteInterface(WireguardInterface{InterfaceName: spec.InterfaceName})
+
+	changes, err := wg.Apply(spec)
+	if err != nil {
+		t.Fatalf("Unable to execute Apply: %s", err)
+	}
+	routes := []string{}
+	for _, c := range changes {
+		if c.Op == "add route" {
+			routes = append(routes, c.Target)
+		}
+	}
+	sort.Strings(routes)
+	if !reflect.DeepEqual(routes, []string{"10.0.0.0/32", "10.0.0.1/32", "10.5.0.0/16"}) {
+		t.Errorf("Apply should add routes to the allowed IPs of peers, got: %v", changes)
+	}
+
+	// removing a peer removes its route, the routes of the spec stay
+	spec.Peers = peers[:1]
+	changes, err = wg.Apply(spec)
+	if err != nil {
+		t.Fatalf("Unable to execute Apply: %s", err)
+	}
+	if !reflect.DeepEqual(changeStrings(changes), []string{"remove peer " + peers[1].Pubkey, "remove route 10.0.0.1/32"}) {
+		t.Errorf("Unexpected changes: %v", changes)
+	}
+	changes, err = wg.Apply(spec)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Apply of an unchanged spec should change nothing: %v, %v", changes, err)
+	}
+}
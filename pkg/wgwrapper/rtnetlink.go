@@ -0,0 +1,673 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// rtnetlink implements linkBackend by talking to the kernel
+// via rtnetlink directly, without the need for /sbin/ip
+type rtnetlink struct {
+	timeout time.Duration
+	logger  Logger
+}
+
+// execute opens a rtnetlink connection, sends a single request
+// and returns all replies.
+func (rt rtnetlink) execute(ctx context.Context, typ netlink.HeaderType, flags netlink.HeaderFlags, data []byte) ([]netlink.Message, error) {
+	ctx, cancel := withTimeout(ctx, rt.timeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	// unblock the request when ctx is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	rt.logger.Debug("rtnetlink request", "type", typ, "flags", flags)
+	msgs, err := c.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  typ,
+			Flags: netlink.Request | flags,
+		},
+		Data: data,
+	})
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		rt.logger.Debug("rtnetlink request failed", "type", typ, "err", err)
+	}
+	return msgs, err
+}
+
+// rtLink is the parsed content of a RTM_NEWLINK message
+type rtLink struct {
+	Index int32
+	Flags uint32
+	Name  string
+	Kind  string
+	Attrs linkAttrs
+}
+
+func marshalIfInfomsg(index int32, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	b[0] = unix.AF_UNSPEC
+	nlenc.PutInt32(b[4:8], index)
+	nlenc.PutUint32(b[8:12], flags)
+	nlenc.PutUint32(b[12:16], change)
+	return b
+}
+
+func unmarshalLink(b []byte) (rtLink, error) {
+	res := rtLink{}
+	if len(b) < unix.SizeofIfInfomsg {
+		return res, errors.New("rtnetlink: short link message")
+	}
+	res.Index = nlenc.Int32(b[4:8])
+	res.Flags = nlenc.Uint32(b[8:12])
+
+	ad, err := netlink.NewAttributeDecoder(b[unix.SizeofIfInfomsg:])
+	if err != nil {
+		return res, err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.IFLA_IFNAME:
+			res.Name = ad.String()
+		case unix.IFLA_MTU:
+			res.Attrs.MTU = int(ad.Uint32())
+		case unix.IFLA_TXQLEN:
+			res.Attrs.TxQueueLen = int(ad.Uint32())
+		case unix.IFLA_IFALIAS:
+			res.Attrs.Alias = ad.String()
+		case unix.IFLA_LINKINFO:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() == unix.IFLA_INFO_KIND {
+						res.Kind = nad.String()
+					}
+				}
+				return nil
+			})
+		}
+	}
+	return res, ad.Err()
+}
+
+// linkByName queries a single link. Returns an error wrapping
+// unix.ENODEV if the link does not exist.
+func (rt rtnetlink) linkByName(ctx context.Context, name string) (rtLink, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.String(unix.IFLA_IFNAME, name)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return rtLink{}, err
+	}
+
+	msgs, err := rt.execute(ctx, unix.RTM_GETLINK, 0, append(marshalIfInfomsg(0, 0, 0), attrs...))
+	if err != nil {
+		return rtLink{}, err
+	}
+	if len(msgs) == 0 {
+		return rtLink{}, fmt.Errorf("rtnetlink: no reply for link %s", name)
+	}
+	return unmarshalLink(msgs[0].Data)
+}
+
+// linkByIndex queries a single link by its index
+func (rt rtnetlink) linkByIndex(ctx context.Context, index int32) (rtLink, error) {
+	msgs, err := rt.execute(ctx, unix.RTM_GETLINK, 0, marshalIfInfomsg(index, 0, 0))
+	if err != nil {
+		return rtLink{}, err
+	}
+	if len(msgs) == 0 {
+		return rtLink{}, fmt.Errorf("rtnetlink: no reply for link #%d", index)
+	}
+	return unmarshalLink(msgs[0].Data)
+}
+
+func (rt rtnetlink) LinkExists(ctx context.Context, name string) (bool, error) {
+	_, err := rt.linkByName(ctx, name)
+	if err != nil {
+		if errors.Is(err, unix.ENODEV) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (rt rtnetlink) LinkAdd(ctx context.Context, name string) error {
+	ae := netlink.NewAttributeEncoder()
+	ae.String(unix.IFLA_IFNAME, name)
+	ae.Nested(unix.IFLA_LINKINFO, func(nae *netlink.AttributeEncoder) error {
+		nae.String(unix.IFLA_INFO_KIND, "wireguard")
+		return nil
+	})
+	attrs, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = rt.execute(ctx, unix.RTM_NEWLINK, netlink.Acknowledge|netlink.Create|netlink.Excl,
+		append(marshalIfInfomsg(0, 0, 0), attrs...))
+	return err
+}
+
+func (rt rtnetlink) LinkDelete(ctx context.Context, name string) error {
+	l, err := rt.linkByName(ctx, name)
+	if err != nil {
+		return err
+	}
+	if l.Kind != "wireguard" {
+		return ErrNotWireguard
+	}
+
+	_, err = rt.execute(ctx, unix.RTM_DELLINK, netlink.Acknowledge, marshalIfInfomsg(l.Index, 0, 0))
+	return err
+}
+
+func (rt rtnetlink) LinkIsUp(ctx context.Context, name string) (bool, error) {
+	l, err := rt.linkByName(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return (l.Flags & unix.IFF_UP) != 0, nil
+}
+
+// linkSetUpDown changes the IFF_UP flag of a link
+func (rt rtnetlink) linkSetUpDown(ctx context.Context, name string, up bool) error {
+	l, err := rt.linkByName(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	var flags uint32
+	if up {
+		flags = unix.IFF_UP
+	}
+	_, err = rt.execute(ctx, unix.RTM_NEWLINK, netlink.Acknowledge, marshalIfInfomsg(l.Index, flags, unix.IFF_UP))
+	return err
+}
+
+func (rt rtnetlink) LinkSetUp(ctx context.Context, name string) error {
+	return rt.linkSetUpDown(ctx, name, true)
+}
+
+func (rt rtnetlink) LinkSetDown(ctx context.Context, name string) error {
+	return rt.linkSetUpDown(ctx, name, false)
+}
+
+func (rt rtnetlink) LinkAttrs(ctx context.Context, name string) (linkAttrs, error) {
+	l, err := rt.linkByName(ctx, name)
+	if err != nil {
+		return linkAttrs{}, err
+	}
+	return l.Attrs, nil
+}
+
+// linkSet sends a RTM_NEWLINK request that changes the attributes
+// encoded by set
+func (rt rtnetlink) linkSet(ctx context.Context, name string, set func(ae *netlink.AttributeEncoder)) error {
+	l, err := rt.linkByName(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	set(ae)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = rt.execute(ctx, unix.RTM_NEWLINK, netlink.Acknowledge, append(marshalIfInfomsg(l.Index, 0, 0), attrs...))
+	return err
+}
+
+func (rt rtnetlink) LinkSetMTU(ctx context.Context, name string, mtu int) error {
+	return rt.linkSet(ctx, name, func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.IFLA_MTU, uint32(mtu))
+	})
+}
+
+func (rt rtnetlink) LinkSetTxQueueLen(ctx context.Context, name string, qlen int) error {
+	return rt.linkSet(ctx, name, func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(unix.IFLA_TXQLEN, uint32(qlen))
+	})
+}
+
+func (rt rtnetlink) LinkSetAlias(ctx context.Context, name string, alias string) error {
+	// like ip, without terminating NUL, so that an empty alias removes it
+	return rt.linkSet(ctx, name, func(ae *netlink.AttributeEncoder) {
+		ae.Bytes(unix.IFLA_IFALIAS, []byte(alias))
+	})
+}
+
+// familyOf returns the address family of an ip
+func familyOf(ip net.IP) uint8 {
+	if ip.To4() != nil {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// normalizeIP returns the 4-byte form of IPv4 addresses
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func marshalIfAddrmsg(family uint8, prefixLen int, index int32) []byte {
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	b[0] = family
+	b[1] = uint8(prefixLen)
+	nlenc.PutUint32(b[4:8], uint32(index))
+	return b
+}
+
+func (rt rtnetlink) AddrList(ctx context.Context, name string) ([]net.IPNet, error) {
+	l, err := rt.linkByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := rt.execute(ctx, unix.RTM_GETADDR, netlink.Dump, marshalIfAddrmsg(unix.AF_UNSPEC, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	res := []net.IPNet{}
+	for _, m := range msgs {
+		if len(m.Data) < unix.SizeofIfAddrmsg {
+			continue
+		}
+		family, prefixLen := m.Data[0], int(m.Data[1])
+		if int32(nlenc.Uint32(m.Data[4:8])) != l.Index {
+			continue
+		}
+
+		var local, address net.IP
+		ad, err := netlink.NewAttributeDecoder(m.Data[unix.SizeofIfAddrmsg:])
+		if err != nil {
+			return nil, err
+		}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.IFA_LOCAL:
+				local = net.IP(ad.Bytes())
+			case unix.IFA_ADDRESS:
+				address = net.IP(ad.Bytes())
+			}
+		}
+		if err := ad.Err(); err != nil {
+			return nil, err
+		}
+
+		// for point-to-point and IPv4 links, IFA_LOCAL carries the local address
+		ip := address
+		if local != nil {
+			ip = local
+		}
+		if ip == nil {
+			continue
+		}
+		bits := 128
+		if family == unix.AF_INET {
+			bits = 32
+		}
+		res = append(res, net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(prefixLen, bits),
+		})
+	}
+
+	return res, nil
+}
+
+// addrRequest sends a RTM_NEWADDR or RTM_DELADDR request for addr
+func (rt rtnetlink) addrRequest(ctx context.Context, name string, addr net.IPNet, typ netlink.HeaderType, flags netlink.HeaderFlags) error {
+	l, err := rt.linkByName(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	ip := normalizeIP(addr.IP)
+	prefixLen, _ := addr.Mask.Size()
+
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(unix.IFA_LOCAL, ip)
+	ae.Bytes(unix.IFA_ADDRESS, ip)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = rt.execute(ctx, typ, flags, append(marshalIfAddrmsg(familyOf(ip), prefixLen, l.Index), attrs...))
+	return err
+}
+
+func (rt rtnetlink) AddrAdd(ctx context.Context, name string, addr net.IPNet) error {
+	return rt.addrRequest(ctx, name, addr, unix.RTM_NEWADDR, netlink.Acknowledge|netlink.Create|netlink.Excl)
+}
+
+func (rt rtnetlink) AddrDel(ctx context.Context, name string, addr net.IPNet) error {
+	return rt.addrRequest(ctx, name, addr, unix.RTM_DELADDR, netlink.Acknowledge)
+}
+
+// rtRoute is the parsed content of a RTM_NEWROUTE message
+type rtRoute struct {
+	Family   uint8
+	Dst      net.IPNet
+	Table    uint32
+	Protocol uint8
+	Scope    uint8
+	Type     uint8
+	Oif      int32
+	Priority uint32
+	PrefSrc  net.IP
+}
+
+func marshalRtMsg(family uint8, dstLen int, table, protocol, scope, typ uint8) []byte {
+	b := make([]byte, unix.SizeofRtMsg)
+	b[0] = family
+	b[1] = uint8(dstLen)
+	b[4] = table
+	b[5] = protocol
+	b[6] = scope
+	b[7] = typ
+	return b
+}
+
+// routeList dumps the routes of all address families
+func (rt rtnetlink) routeList(ctx context.Context) ([]rtRoute, error) {
+	msgs, err := rt.execute(ctx, unix.RTM_GETROUTE, netlink.Dump, marshalRtMsg(unix.AF_UNSPEC, 0, 0, 0, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	res := []rtRoute{}
+	for _, m := range msgs {
+		if len(m.Data) < unix.SizeofRtMsg {
+			continue
+		}
+		r, err := unmarshalRoute(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func unmarshalRoute(b []byte) (rtRoute, error) {
+	if len(b) < unix.SizeofRtMsg {
+		return rtRoute{}, errors.New("rtnetlink: short route message")
+	}
+	r := rtRoute{
+		Family:   b[0],
+		Table:    uint32(b[4]),
+		Protocol: b[5],
+		Scope:    b[6],
+		Type:     b[7],
+	}
+	bits := 128
+	if r.Family == unix.AF_INET {
+		bits = 32
+	}
+	r.Dst = net.IPNet{
+		IP:   make(net.IP, bits/8),
+		Mask: net.CIDRMask(int(b[1]), bits),
+	}
+
+	ad, err := netlink.NewAttributeDecoder(b[unix.SizeofRtMsg:])
+	if err != nil {
+		return r, err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.RTA_DST:
+			r.Dst.IP = net.IP(ad.Bytes())
+		case unix.RTA_OIF:
+			r.Oif = int32(ad.Uint32())
+		case unix.RTA_TABLE:
+			r.Table = ad.Uint32()
+		case unix.RTA_PRIORITY:
+			r.Priority = ad.Uint32()
+		case unix.RTA_PREFSRC:
+			r.PrefSrc = net.IP(ad.Bytes())
+		}
+	}
+	return r, ad.Err()
+}
+
+// routeProtocols and routeScopes name the protocols
+// and scopes of routes like ip does
+var (
+	routeProtocols = map[uint8]string{
+		unix.RTPROT_REDIRECT: "redirect",
+		unix.RTPROT_KERNEL:   "kernel",
+		unix.RTPROT_BOOT:     "boot",
+		unix.RTPROT_STATIC:   "static",
+		unix.RTPROT_RA:       "ra",
+		unix.RTPROT_DHCP:     "dhcp",
+	}
+	routeScopes = map[uint8]RouteScope{
+		unix.RT_SCOPE_UNIVERSE: ScopeGlobal,
+		unix.RT_SCOPE_SITE:     ScopeSite,
+		unix.RT_SCOPE_LINK:     ScopeLink,
+		unix.RT_SCOPE_HOST:     ScopeHost,
+	}
+)
+
+// routeProtocol returns the number of a protocol named
+// as by ip, RTPROT_BOOT if it is empty
+func routeProtocol(name string) (uint8, error) {
+	if name == "" {
+		return unix.RTPROT_BOOT, nil
+	}
+	for p, n := range routeProtocols {
+		if n == name {
+			return p, nil
+		}
+	}
+	p, err := strconv.ParseUint(name, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol %s", name)
+	}
+	return uint8(p), nil
+}
+
+func (rt rtnetlink) RouteList(ctx context.Context, name string, family uint8, table int) ([]Route, error) {
+	l, err := rt.linkByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := rt.routeList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []Route{}
+	for _, r := range routes {
+		if r.Oif != l.Index || r.Family != family || r.Type != unix.RTN_UNICAST {
+			continue
+		}
+		if (table == routeTableAll && r.Table == unix.RT_TABLE_LOCAL) || (table != routeTableAll && r.Table != rtTable(table)) {
+			continue
+		}
+
+		route := Route{
+			Dst:      r.Dst,
+			Metric:   int(r.Priority),
+			Src:      r.PrefSrc,
+			Scope:    routeScopes[r.Scope],
+			Protocol: routeProtocols[r.Protocol],
+		}
+		if r.Table != unix.RT_TABLE_MAIN {
+			route.Table = int(r.Table)
+		}
+		if route.Scope == "" {
+			route.Scope = RouteScope(strconv.Itoa(int(r.Scope)))
+		}
+		if route.Protocol == "" {
+			route.Protocol = strconv.Itoa(int(r.Protocol))
+		}
+		res = append(res, route)
+	}
+	return res, nil
+}
+
+// rtTable returns the kernel's number of a table, 0 being the main table
+func rtTable(table int) uint32 {
+	if table == 0 {
+		return unix.RT_TABLE_MAIN
+	}
+	return uint32(table)
+}
+
+// routeRequest sends a RTM_NEWROUTE or RTM_DELROUTE request for
+// route r via the link
+func (rt rtnetlink) routeRequest(ctx context.Context, name string, r Route, typ netlink.HeaderType, flags netlink.HeaderFlags) error {
+	l, err := rt.linkByName(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	ip := normalizeIP(r.Dst.IP)
+	dstLen, _ := r.Dst.Mask.Size()
+	table := rtTable(r.Table)
+
+	// tables beyond 255 are only given as attribute
+	tableByte := uint8(unix.RT_TABLE_UNSPEC)
+	if table < 256 {
+		tableByte = uint8(table)
+	}
+
+	// like ip, deletions match routes of any scope and protocol
+	var scope uint8 = unix.RT_SCOPE_NOWHERE
+	var proto uint8 = unix.RTPROT_UNSPEC
+	if typ != unix.RTM_DELROUTE {
+		proto, err = routeProtocol(r.Protocol)
+		if err != nil {
+			return err
+		}
+		scope = unix.RT_SCOPE_LINK
+		for s, name := range routeScopes {
+			if name == r.Scope {
+				scope = s
+			}
+		}
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(unix.RTA_DST, ip.Mask(r.Dst.Mask))
+	ae.Uint32(unix.RTA_OIF, uint32(l.Index))
+	ae.Uint32(unix.RTA_TABLE, table)
+	if r.Metric != 0 {
+		ae.Uint32(unix.RTA_PRIORITY, uint32(r.Metric))
+	}
+	if r.Src != nil && typ != unix.RTM_DELROUTE {
+		ae.Bytes(unix.RTA_PREFSRC, normalizeIP(r.Src))
+	}
+	attrs, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = rt.execute(ctx, typ, flags,
+		append(marshalRtMsg(familyOf(ip), dstLen, tableByte, proto, scope, unix.RTN_UNICAST), attrs...))
+	return err
+}
+
+func (rt rtnetlink) RouteAdd(ctx context.Context, name string, r Route) error {
+	return rt.routeRequest(ctx, name, r, unix.RTM_NEWROUTE, netlink.Acknowledge|netlink.Create|netlink.Excl)
+}
+
+func (rt rtnetlink) RouteReplace(ctx context.Context, name string, r Route) error {
+	return rt.routeRequest(ctx, name, r, unix.RTM_NEWROUTE, netlink.Acknowledge|netlink.Create|netlink.Replace)
+}
+
+func (rt rtnetlink) RouteDel(ctx context.Context, name string, r Route) error {
+	return rt.routeRequest(ctx, name, r, unix.RTM_DELROUTE, netlink.Acknowledge)
+}
+
+func (rt rtnetlink) DefaultRouteInterface(ctx context.Context) (string, error) {
+	routes, err := rt.routeList(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range routes {
+		if r.Family != unix.AF_INET || r.Table != unix.RT_TABLE_MAIN || r.Type != unix.RTN_UNICAST {
+			continue
+		}
+		if ones, _ := r.Dst.Mask.Size(); ones != 0 || r.Oif == 0 {
+			continue
+		}
+		l, err := rt.linkByIndex(ctx, r.Oif)
+		if err != nil {
+			return "", err
+		}
+		return l.Name, nil
+	}
+	return "", nil
+}
+
+func (rt rtnetlink) RouteGet(ctx context.Context, dst net.IP) (string, error) {
+	ip := normalizeIP(dst)
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(unix.RTA_DST, ip)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return "", err
+	}
+
+	msgs, err := rt.execute(ctx, unix.RTM_GETROUTE, 0, append(marshalRtMsg(familyOf(ip), len(ip)*8, 0, 0, 0, 0), attrs...))
+	if err != nil {
+		return "", err
+	}
+	if len(msgs) == 0 {
+		return "", fmt.Errorf("rtnetlink: no route to %s", dst)
+	}
+	r, err := unmarshalRoute(msgs[0].Data)
+	if err != nil {
+		return "", err
+	}
+	l, err := rt.linkByIndex(ctx, r.Oif)
+	if err != nil {
+		return "", err
+	}
+	return l.Name, nil
+}
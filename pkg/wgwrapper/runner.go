@@ -0,0 +1,125 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// CommandRunner executes an external command such as /sbin/ip
+// and returns what it has written to stdout and stderr. When ctx
+// is done before the command completes, Run returns ctx.Err().
+type CommandRunner interface {
+	Run(ctx context.Context, name string, args ...string) (stdout []byte, stderr []byte, err error)
+}
+
+// execRunner is the default CommandRunner, based on os/exec.
+// Commands are killed when ctx is done.
+type execRunner struct {
+}
+
+func (r execRunner) Run(ctx context.Context, name string, args ...string) ([]byte, []byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return stdout.Bytes(), stderr.Bytes(), ctx.Err()
+	}
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// RunResult is a canned result of a RecordingRunner
+type RunResult struct {
+	Stdout string
+	Stderr string
+	Err    error
+}
+
+// RecordedCommand is a single command as seen by a RecordingRunner
+type RecordedCommand struct {
+	Name string
+	Args []string
+}
+
+// String returns the command line, separated by spaces
+func (c RecordedCommand) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// RecordingRunner is a CommandRunner that does not execute anything.
+// It records all commands and returns canned results, so it can
+// be used to test code that uses WireguardWrapper without privileges.
+type RecordingRunner struct {
+	mu       sync.Mutex
+	commands []RecordedCommand
+	results  map[string][]RunResult
+}
+
+// NewRecordingRunner creates an empty RecordingRunner. Commands without
+// a canned result succeed with empty output.
+func NewRecordingRunner() *RecordingRunner {
+	return &RecordingRunner{
+		commands: []RecordedCommand{},
+		results:  map[string][]RunResult{},
+	}
+}
+
+// On registers a result for a command with exactly the given arguments.
+// When registering multiple results for the same arguments, they are
+// returned in order and the last one is repeated.
+func (r *RecordingRunner) On(res RunResult, args ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := strings.Join(args, " ")
+	r.results[k] = append(r.results[k], res)
+}
+
+// Run records the command and returns the canned result, if any.
+// Returns ctx.Err() without recording if ctx is already done.
+func (r *RecordingRunner) Run(ctx context.Context, name string, args ...string) ([]byte, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands = append(r.commands, RecordedCommand{
+		Name: name,
+		Args: append([]string{}, args...),
+	})
+
+	k := strings.Join(args, " ")
+	a, ok := r.results[k]
+	if !ok || len(a) == 0 {
+		return []byte{}, []byte{}, nil
+	}
+	res := a[0]
+	if len(a) > 1 {
+		r.results[k] = a[1:]
+	}
+	return []byte(res.Stdout), []byte(res.Stderr), res.Err
+}
+
+// Commands returns all commands recorded so far
+func (r *RecordingRunner) Commands() []RecordedCommand {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]RecordedCommand{}, r.commands...)
+}
+
+// Reset clears all recorded commands, but keeps canned results
+func (r *RecordingRunner) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands = []RecordedCommand{}
+}
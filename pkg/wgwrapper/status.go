@@ -0,0 +1,93 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// handshakeTimeout is the age of the last handshake after which
+// wireguard no longer uses a session (REJECT_AFTER_TIME)
+const handshakeTimeout = 180 * time.Second
+
+// PeerStatus is the runtime state of a peer as reported by wireguard
+type PeerStatus struct {
+	Pubkey string
+
+	// Endpoint is the current address of the peer, nil if unknown
+	Endpoint   *net.UDPAddr
+	AllowedIPs []net.IPNet
+
+	// HasPsk tells if a preshared key is set. The key itself is not exposed
+	HasPsk bool
+
+	PersistentKeepaliveInterval time.Duration
+
+	// LastHandshakeTime is zero if there has been no handshake yet
+	LastHandshakeTime time.Time
+	ReceiveBytes      int64
+	TransmitBytes     int64
+	ProtocolVersion   int
+}
+
+// Connected tells if the peer had a handshake recently enough for
+// its session to be usable at time now
+func (s PeerStatus) Connected(now time.Time) bool {
+	if s.LastHandshakeTime.IsZero() {
+		return false
+	}
+	return now.Sub(s.LastHandshakeTime) < handshakeTimeout
+}
+
+// peerStatus converts a peer of a wireguard device
+func peerStatus(p wgtypes.Peer) PeerStatus {
+	return PeerStatus{
+		Pubkey:                      p.PublicKey.String(),
+		Endpoint:                    p.Endpoint,
+		AllowedIPs:                  p.AllowedIPs,
+		HasPsk:                      p.PresharedKey != wgtypes.Key{},
+		PersistentKeepaliveInterval: p.PersistentKeepaliveInterval,
+		LastHandshakeTime:           p.LastHandshakeTime,
+		ReceiveBytes:                p.ReceiveBytes,
+		TransmitBytes:               p.TransmitBytes,
+		ProtocolVersion:             p.ProtocolVersion,
+	}
+}
+
+// PeerStatuses returns the runtime state of all peers of an interface
+func (wg wgwrapper) PeerStatuses(intf WireguardInterface) ([]PeerStatus, error) {
+	peers, err := wg.devicePeers("query peer status", intf)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]PeerStatus, len(peers))
+	for idx, p := range peers {
+		res[idx] = peerStatus(p)
+	}
+	return res, nil
+}
+
+// PeerStatus returns the runtime state of a single peer. Fails
+// with ErrPeerNotFound if the interface has no such peer.
+func (wg wgwrapper) PeerStatus(intf WireguardInterface, pubkey string) (PeerStatus, error) {
+	pk, err := wgtypes.ParseKey(pubkey)
+	if err != nil {
+		return PeerStatus{}, wrapError("query peer status", intf.InterfaceName, invalidKey(err))
+	}
+
+	peers, err := wg.devicePeers("query peer status", intf)
+	if err != nil {
+		return PeerStatus{}, err
+	}
+	for _, p := range peers {
+		if p.PublicKey == pk {
+			return peerStatus(p), nil
+		}
+	}
+	return PeerStatus{}, wrapError("query peer status", intf.InterfaceName, fmt.Errorf("%w: %s", ErrPeerNotFound, pubkey))
+}
@@ -0,0 +1,76 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPeerStatus(t *testing.T) {
+	k := newMemoryKernel()
+	wg := newInMemory(k, k)
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+
+	psk := "GKhd9D/9uV8pdhKOhD3Ki3vqhO+ivHEebHrtKGtiblA="
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	wgp := WireguardPeer{
+		RemoteEndpointIP:            "10.1.2.3",
+		ListenPort:                  43210,
+		Pubkey:                      "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs:                  []net.IPNet{*n1},
+		Psk:                         &psk,
+		PersistentKeepaliveInterval: 25 * time.Second,
+	}
+	if _, err := wg.AddPeer(wgi, wgp); err != nil {
+		t.Fatalf("Unable to execute AddPeer: %s", err)
+	}
+
+	// simulate traffic
+	handshake := time.Now().Add(-time.Minute)
+	p := &k.links[wgi.InterfaceName].device.Peers[0]
+	p.LastHandshakeTime = handshake
+	p.ReceiveBytes = 1234
+	p.TransmitBytes = 5678
+
+	s, err := wg.PeerStatus(wgi, wgp.Pubkey)
+	if err != nil {
+		t.Fatalf("Unable to execute PeerStatus: %s", err)
+	}
+	if s.Pubkey != wgp.Pubkey || s.Endpoint.String() != "10.1.2.3:43210" || len(s.AllowedIPs) != 1 {
+		t.Errorf("Unexpected peer status: %#v", s)
+	}
+	if !s.HasPsk || s.PersistentKeepaliveInterval != 25*time.Second || s.ProtocolVersion != 1 {
+		t.Errorf("Unexpected peer status: %#v", s)
+	}
+	if !s.LastHandshakeTime.Equal(handshake) || s.ReceiveBytes != 1234 || s.TransmitBytes != 5678 {
+		t.Errorf("Unexpected peer statistics: %#v", s)
+	}
+	if !s.Connected(time.Now()) || s.Connected(handshake.Add(handshakeTimeout)) {
+		t.Errorf("Unexpected connection state of peer: %#v", s)
+	}
+	if (PeerStatus{}).Connected(time.Now()) {
+		t.Errorf("Peer without handshake should not be connected")
+	}
+
+	statuses, err := wg.PeerStatuses(wgi)
+	if err != nil || len(statuses) != 1 || statuses[0].ReceiveBytes != 1234 {
+		t.Errorf("Unexpected result of PeerStatuses: %#v, %v", statuses, err)
+	}
+
+	_, err = wg.PeerStatus(wgi, wgtypes.Key{}.String())
+	if !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("PeerStatus of unknown peer should fail with ErrPeerNotFound, got: %v", err)
+	}
+	_, err = wg.PeerStatus(wgi, "invalid")
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("PeerStatus with invalid key should fail with ErrInvalidKey, got: %v", err)
+	}
+}
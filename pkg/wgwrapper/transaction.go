@@ -0,0 +1,363 @@
+// +build linux
+
+package wgwrapper
+
+import "net"
+
+// undoFunc reverts a single step of a transaction
+type undoFunc func(wg wgwrapper) error
+
+// Transaction groups several changes of the system. Each step is
+// applied immediately, and the way to revert it is recorded. If a
+// step fails, all steps before are reverted in reverse order, so the
+// system is left as it was found. A Transaction is not safe for
+// concurrent use.
+type Transaction struct {
+	wg   wgwrapper
+	undo []undoFunc
+	done bool
+}
+
+// Begin starts a new transaction
+func (wg wgwrapper) Begin() *Transaction {
+	return &Transaction{
+		wg:   wg,
+		undo: []undoFunc{},
+	}
+}
+
+// do runs a step, and rolls back the transaction if it fails.
+// Steps return an undoFunc for what they changed, even on error.
+func (tx *Transaction) do(step func(wg wgwrapper) (undoFunc, error)) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+
+	undo, err := step(tx.wg)
+	if undo != nil {
+		tx.undo = append(tx.undo, undo)
+	}
+	if err != nil {
+		if rerr := tx.rollback(); len(rerr) > 0 {
+			return &RollbackError{Err: err, Errors: rerr}
+		}
+		return err
+	}
+	return nil
+}
+
+// rollback reverts all recorded steps, in reverse order. It keeps
+// going if one fails and returns all errors. Steps are reverted
+// without the context of the wrapper, as it may have been cancelled.
+func (tx *Transaction) rollback() []error {
+	tx.done = true
+
+	wg := tx.wg
+	wg.ctx = nil
+
+	errs := []error{}
+	for idx := len(tx.undo) - 1; idx >= 0; idx-- {
+		if err := tx.undo[idx](wg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	tx.undo = nil
+	return errs
+}
+
+// Commit ends the transaction, keeping all changes
+func (tx *Transaction) Commit() error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	tx.done = true
+	tx.undo = nil
+	return nil
+}
+
+// Rollback ends the transaction, reverting all changes made so far
+func (tx *Transaction) Rollback() error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	if errs := tx.rollback(); len(errs) > 0 {
+		return &RollbackError{Errors: errs}
+	}
+	return nil
+}
+
+// AddInterface creates a wireguard interface and assigns its address,
+// see WireguardWrapper.AddInterface
+func (tx *Transaction) AddInterface(intf WireguardInterface) error {
+	err := tx.AddInterfaceNoAddr(intf)
+	if err != nil {
+		return err
+	}
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.addAddress(intf)
+	})
+}
+
+// AddInterfaceNoAddr creates a wireguard interface and sets its
+// link attributes, see WireguardWrapper.AddInterfaceNoAddr
+func (tx *Transaction) AddInterfaceNoAddr(intf WireguardInterface) error {
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.addInterfaceNoAddr(intf)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.setLinkAttrs(intf)
+	})
+}
+
+// SetInterfaceUp brings interface in UP state
+func (tx *Transaction) SetInterfaceUp(intf WireguardInterface) error {
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.setInterfaceUp(intf)
+	})
+}
+
+// Configure makes sure that the interface has a keypair and a listen
+// port, see WireguardWrapper.Configure
+func (tx *Transaction) Configure(intf *WireguardInterface) error {
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.configure(intf)
+	})
+}
+
+// RotateKey replaces the private key of an interface, see
+// WireguardWrapper.RotateKey. Rollback restores the previous key.
+func (tx *Transaction) RotateKey(intf *WireguardInterface) error {
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.rotateKey(intf)
+	})
+}
+
+// AddPeer adds a new peer to an existing interface
+func (tx *Transaction) AddPeer(intf WireguardInterface, peer WireguardPeer) (bool, error) {
+	added := false
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		undo, err := wg.addPeer(intf, peer)
+		added = undo != nil
+		return undo, err
+	})
+	return added, err
+}
+
+// UpdatePeer changes an existing peer, see WireguardWrapper.UpdatePeer
+func (tx *Transaction) UpdatePeer(intf WireguardInterface, peer WireguardPeer, upd PeerUpdate) ([]FieldChange, error) {
+	var changes []FieldChange
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		var undo undoFunc
+		var err error
+		_, changes, undo, err = wg.upsertPeer("update peer", intf, peer, upd, false)
+		return undo, err
+	})
+	return changes, err
+}
+
+// UpsertPeer adds or updates a peer, see WireguardWrapper.UpsertPeer
+func (tx *Transaction) UpsertPeer(intf WireguardInterface, peer WireguardPeer, upd PeerUpdate) (bool, []FieldChange, error) {
+	var added bool
+	var changes []FieldChange
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		var undo undoFunc
+		var err error
+		added, changes, undo, err = wg.upsertPeer("upsert peer", intf, peer, upd, true)
+		return undo, err
+	})
+	return added, changes, err
+}
+
+// AddPeers adds many peers to an interface, see WireguardWrapper.AddPeers.
+// Rollback removes the peers added.
+func (tx *Transaction) AddPeers(intf WireguardInterface, peers []WireguardPeer) (int, error) {
+	var n int
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		var undo undoFunc
+		var err error
+		n, undo, err = wg.addPeers(intf, peers)
+		return undo, err
+	})
+	return n, err
+}
+
+// RemovePeers removes many peers from an interface, see
+// WireguardWrapper.RemovePeers. Rollback restores the peers removed.
+func (tx *Transaction) RemovePeers(intf WireguardInterface, pubkeys []string) (int, error) {
+	var n int
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		var undo undoFunc
+		var err error
+		n, undo, err = wg.removePeers(intf, pubkeys)
+		return undo, err
+	})
+	return n, err
+}
+
+// SetPresharedKey sets the preshared key of an existing peer,
+// see WireguardWrapper.SetPresharedKey
+func (tx *Transaction) SetPresharedKey(intf WireguardInterface, pubkey string, psk string) error {
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.setPresharedKey("set preshared key", intf, pubkey, &psk)
+	})
+}
+
+// ClearPresharedKey removes the preshared key of an existing peer,
+// see WireguardWrapper.ClearPresharedKey
+func (tx *Transaction) ClearPresharedKey(intf WireguardInterface, pubkey string) error {
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.setPresharedKey("clear preshared key", intf, pubkey, nil)
+	})
+}
+
+// RotatePresharedKeys sets new preshared keys for the given peers,
+// see WireguardWrapper.RotatePresharedKeys
+func (tx *Transaction) RotatePresharedKeys(intf WireguardInterface, pubkeys []string) (map[string]string, error) {
+	var psks map[string]string
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		var undo undoFunc
+		var err error
+		psks, undo, err = wg.rotatePresharedKeys(intf, pubkeys)
+		return undo, err
+	})
+	return psks, err
+}
+
+// RemovePeerByPubkey removes a single peer from an interface
+func (tx *Transaction) RemovePeerByPubkey(intf WireguardInterface, pubkey string) error {
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.removePeerByPubkey(intf, pubkey)
+	})
+}
+
+// RemoveAllPeers removes all peers on an existing interface
+func (tx *Transaction) RemoveAllPeers(intf WireguardInterface) error {
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.removeAllPeers(intf)
+	})
+}
+
+// SyncPeers makes the peers of an interface match the given ones,
+// see WireguardWrapper.SyncPeers
+func (tx *Transaction) SyncPeers(intf WireguardInterface, peers []WireguardPeer) ([]Change, error) {
+	var changes []Change
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		var undo undoFunc
+		var err error
+		changes, undo, err = wg.syncPeers(intf, peers)
+		return undo, err
+	})
+	return changes, err
+}
+
+// AddAddress assigns an address to an interface,
+// see WireguardWrapper.AddAddress
+func (tx *Transaction) AddAddress(intf WireguardInterface, addr net.IPNet) (bool, error) {
+	added := false
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		undo, err := wg.addSingleAddress(intf, addr)
+		added = undo != nil
+		return undo, err
+	})
+	return added, err
+}
+
+// RemoveAddress removes an address from an interface,
+// see WireguardWrapper.RemoveAddress
+func (tx *Transaction) RemoveAddress(intf WireguardInterface, addr net.IPNet) (bool, error) {
+	removed := false
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		undo, err := wg.removeSingleAddress(intf, addr)
+		removed = undo != nil
+		return undo, err
+	})
+	return removed, err
+}
+
+// ReplaceAddress replaces an address of an interface,
+// see WireguardWrapper.ReplaceAddress
+func (tx *Transaction) ReplaceAddress(intf WireguardInterface, old, new net.IPNet) error {
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.replaceAddress(intf, old, new)
+	})
+}
+
+// SyncAddresses makes the addresses of an interface match addrs,
+// see WireguardWrapper.SyncAddresses
+func (tx *Transaction) SyncAddresses(intf WireguardInterface, addrs []net.IPNet) ([]Change, error) {
+	var changes []Change
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		var undo undoFunc
+		var err error
+		changes, undo, err = wg.syncAddresses(intf, addrs)
+		return undo, err
+	})
+	return changes, err
+}
+
+// UpdateMTU applies the MTU derived from the underlay,
+// see WireguardWrapper.UpdateMTU
+func (tx *Transaction) UpdateMTU(intf WireguardInterface) ([]Change, error) {
+	var changes []Change
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		var undo undoFunc
+		var err error
+		changes, undo, err = wg.updateMTU(intf)
+		return undo, err
+	})
+	return changes, err
+}
+
+// AddRoute adds a route via an interface, see WireguardWrapper.AddRoute
+func (tx *Transaction) AddRoute(intf WireguardInterface, r Route) (bool, error) {
+	var added bool
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		undo, err := wg.addRoute(intf, r)
+		added = undo != nil
+		return undo, err
+	})
+	return added, err
+}
+
+// DeleteRoute removes a route via an interface,
+// see WireguardWrapper.DeleteRoute
+func (tx *Transaction) DeleteRoute(intf WireguardInterface, r Route) (bool, error) {
+	var deleted bool
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		undo, err := wg.deleteRoute(intf, r)
+		deleted = undo != nil
+		return undo, err
+	})
+	return deleted, err
+}
+
+// ReplaceRoute adds or changes a route via an interface,
+// see WireguardWrapper.ReplaceRoute
+func (tx *Transaction) ReplaceRoute(intf WireguardInterface, r Route) error {
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.replaceRoute(intf, r)
+	})
+}
+
+// SyncRoutes makes the routes of an interface match the allowed IPs
+// of its peers, see WireguardWrapper.SyncRoutes
+func (tx *Transaction) SyncRoutes(intf WireguardInterface) ([]Change, error) {
+	var changes []Change
+	err := tx.do(func(wg wgwrapper) (undoFunc, error) {
+		var undo undoFunc
+		var err error
+		changes, undo, err = wg.syncRoutes(intf)
+		return undo, err
+	})
+	return changes, err
+}
+
+// SetRoute adds a route to network via the interface, if not present
+func (tx *Transaction) SetRoute(intf WireguardInterface, networkCIDR string) error {
+	return tx.do(func(wg wgwrapper) (undoFunc, error) {
+		return wg.setRoute(intf, networkCIDR)
+	})
+}
@@ -0,0 +1,209 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestAddInterfaceRollback(t *testing.T) {
+	wg := NewInMemory()
+
+	// an interface without address cannot get one assigned
+	wgi := NewWireguardInterfaceNoAddr("wg-tx0")
+	err := wg.AddInterface(wgi)
+	if err == nil {
+		t.Fatal("AddInterface without address should fail but did not")
+	}
+
+	ex, err := wg.HasInterface(wgi)
+	if err != nil || ex {
+		t.Errorf("AddInterface should remove a half-built interface: %t, %v", ex, err)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	wgi.ListenPort = 46534
+
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	wgp1 := WireguardPeer{
+		RemoteEndpointIP: "10.1.2.3",
+		ListenPort:       43210,
+		Pubkey:           "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs:       []net.IPNet{*n1},
+	}
+
+	tx := wg.Begin()
+	if err := tx.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := tx.Configure(&wgi); err != nil {
+		t.Fatalf("Unable to execute Configure: %s", err)
+	}
+	if ok, err := tx.AddPeer(wgi, wgp1); err != nil || !ok {
+		t.Fatalf("Unable to execute AddPeer: %t, %v", ok, err)
+	}
+	_, err := tx.AddPeer(wgi, WireguardPeer{Pubkey: "invalid"})
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("AddPeer with invalid key should fail with ErrInvalidKey, got: %v", err)
+	}
+
+	ex, err := wg.HasInterface(wgi)
+	if err != nil || ex {
+		t.Errorf("Failed transaction should remove the interface: %t, %v", ex, err)
+	}
+
+	if err := tx.SetInterfaceUp(wgi); !errors.Is(err, ErrTransactionDone) {
+		t.Errorf("Rolled back transaction should fail with ErrTransactionDone, got: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTransactionDone) {
+		t.Errorf("Commit of rolled back transaction should fail with ErrTransactionDone, got: %v", err)
+	}
+}
+
+func TestTransactionRestoresExisting(t *testing.T) {
+	k := newMemoryKernel()
+	wg := newInMemory(k, k)
+	wgi := newWGIntf()
+	wgi.ListenPort = 46534
+
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	_, n2, _ := net.ParseCIDR("10.2.0.0/16")
+	wgp1 := WireguardPeer{
+		RemoteEndpointIP: "10.1.2.3",
+		ListenPort:       43210,
+		Pubkey:           "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs:       []net.IPNet{*n1},
+	}
+	wgp2 := WireguardPeer{
+		RemoteEndpointIP: "10.4.5.6",
+		ListenPort:       32345,
+		Pubkey:           "xqr+unDSDc5Fq0W9Zp2SJlzr+wOaFAquNdIMwPLHarw=",
+		AllowedIPs:       []net.IPNet{*n2},
+	}
+
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+	if err := wg.Configure(&wgi); err != nil {
+		t.Fatalf("Unable to execute Configure: %s", err)
+	}
+	if _, err := wg.AddPeer(wgi, wgp1); err != nil {
+		t.Fatalf("Unable to execute AddPeer: %s", err)
+	}
+
+	tx := wg.Begin()
+	if err := tx.RemoveAllPeers(wgi); err != nil {
+		t.Fatalf("Unable to execute RemoveAllPeers: %s", err)
+	}
+	if _, err := tx.AddPeer(wgi, wgp2); err != nil {
+		t.Fatalf("Unable to execute AddPeer: %s", err)
+	}
+	// routes cannot be added while the interface is down
+	if err := tx.SetRoute(wgi, "10.2.0.0/16"); err == nil {
+		t.Fatal("SetRoute on interface in DOWN state should fail but did not")
+	}
+
+	peers := map[string]WireguardPeer{}
+	err := wg.IteratePeers(wgi, func(p WireguardPeer) {
+		peers[p.Pubkey] = p
+	})
+	if err != nil {
+		t.Fatalf("Unable to execute IteratePeers: %s", err)
+	}
+	p, ok := peers[wgp1.Pubkey]
+	if len(peers) != 1 || !ok {
+		t.Fatalf("Rollback should restore the original peers, got %v", peers)
+	}
+	if p.RemoteEndpointIP != "10.1.2.3" || p.ListenPort != 43210 || len(p.AllowedIPs) != 1 || p.AllowedIPs[0].String() != "10.1.0.0/16" {
+		t.Errorf("Rollback should restore the peer's configuration, got %#v", p)
+	}
+
+	// explicit rollback
+	tx = wg.Begin()
+	if err := tx.SetInterfaceUp(wgi); err != nil {
+		t.Fatalf("Unable to execute SetInterfaceUp: %s", err)
+	}
+	if err := tx.SetRoute(wgi, "10.2.0.0/16"); err != nil {
+		t.Fatalf("Unable to execute SetRoute: %s", err)
+	}
+	if err := tx.RemovePeerByPubkey(wgi, wgp1.Pubkey); err != nil {
+		t.Fatalf("Unable to execute RemovePeerByPubkey: %s", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Unable to execute Rollback: %s", err)
+	}
+	if ok, err := wg.HasPeer(wgi, wgp1); err != nil || !ok {
+		t.Errorf("Rollback should restore removed peer: %t, %v", ok, err)
+	}
+	if up, err := k.LinkIsUp(context.Background(), wgi.InterfaceName); err != nil || up {
+		t.Errorf("Rollback should take down the interface: %t, %v", up, err)
+	}
+}
+
+func TestTransactionRollbackError(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+
+	tx := wg.Begin()
+	if err := tx.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+
+	// interface vanishes behind the back of the transaction
+	if err := wg.DeleteInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute DeleteInterface: %s", err)
+	}
+
+	err := tx.SetInterfaceUp(wgi)
+	var re *RollbackError
+	if !errors.As(err, &re) {
+		t.Fatalf("Expected a RollbackError, got: %v", err)
+	}
+	if !errors.Is(err, ErrInterfaceNotFound) {
+		t.Errorf("RollbackError should match the cause of the rollback, got: %v", err)
+	}
+	if len(re.Errors) != 2 || !errors.Is(re.Errors[0], ErrInterfaceNotFound) {
+		t.Errorf("Unexpected errors of rollback: %v", re.Errors)
+	}
+}
+
+func TestTransactionUpsertPeer(t *testing.T) {
+	wg := NewInMemory()
+	wgi := newWGIntf()
+	if err := wg.AddInterface(wgi); err != nil {
+		t.Fatalf("Unable to execute AddInterface: %s", err)
+	}
+
+	_, n1, _ := net.ParseCIDR("10.1.0.0/16")
+	wgp := WireguardPeer{
+		RemoteEndpointIP: "10.1.2.3",
+		ListenPort:       43210,
+		Pubkey:           "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=",
+		AllowedIPs:       []net.IPNet{*n1},
+	}
+	if _, err := wg.AddPeer(wgi, wgp); err != nil {
+		t.Fatalf("Unable to execute AddPeer: %s", err)
+	}
+
+	tx := wg.Begin()
+	changed := wgp
+	changed.RemoteEndpointIP = "10.1.2.4"
+	changed.AllowedIPs = []net.IPNet{}
+	if _, err := tx.UpdatePeer(wgi, changed, PeerUpdate{}); err != nil {
+		t.Fatalf("Unable to execute UpdatePeer: %s", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Unable to execute Rollback: %s", err)
+	}
+
+	fields, err := wg.UpdatePeer(wgi, wgp, PeerUpdate{})
+	if err != nil || len(fields) != 0 {
+		t.Errorf("Rollback should restore the peer, but it differs in: %v, %v", fields, err)
+	}
+}
@@ -12,6 +12,30 @@ type WireguardInterface struct {
 	IP            net.IPNet // local ip of wg interface
 	ListenPort    int       // UDP listening port
 	PublicKey     string    // public key of interface
+
+	// PrivateKey is the private key Configure sets, in base64. If
+	// empty, an existing key is kept or a new one is generated.
+	PrivateKey string
+
+	// Addresses are all addresses of the interface, IPv4 and IPv6.
+	// If empty, IP is the only one.
+	Addresses []net.IPNet
+
+	// MTU of the link. If 0, it is left as it is, which is 1420
+	// for a new interface. AutoMTU derives it from the underlay.
+	MTU int
+
+	// FirewallMark marks the packets wireguard sends, e.g. for
+	// policy routing. Configure sets it. If 0, it is left as it is.
+	FirewallMark int
+
+	// TxQueueLen is the transmit queue length of the link.
+	// If 0, it is left as it is.
+	TxQueueLen int
+
+	// Alias is a description of the link, as shown by ip link.
+	// If empty, it is left as it is.
+	Alias string
 }
 
 // NewWireguardInterface creates a new WireguardInterface with a given name and ip
@@ -29,3 +53,28 @@ func NewWireguardInterfaceNoAddr(interfaceName string) WireguardInterface {
 		InterfaceName: interfaceName,
 	}
 }
+
+// NewWireguardInterfaceAddrs creates a new WireguardInterface with a given
+// name and several addresses, e.g. an IPv4 and an IPv6 one. The first
+// address is the IP of the interface.
+func NewWireguardInterfaceAddrs(interfaceName string, addrs []net.IPNet) WireguardInterface {
+	res := WireguardInterface{
+		InterfaceName: interfaceName,
+		Addresses:     addrs,
+	}
+	if len(addrs) > 0 {
+		res.IP = addrs[0]
+	}
+	return res
+}
+
+// addresses returns all addresses of the interface
+func (intf WireguardInterface) addresses() []net.IPNet {
+	if len(intf.Addresses) > 0 {
+		return intf.Addresses
+	}
+	if intf.IP.IP == nil {
+		return []net.IPNet{}
+	}
+	return []net.IPNet{intf.IP}
+}
@@ -0,0 +1,418 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// WireguardQuickConfig is the content of a wg-quick style
+// configuration file, e.g. /etc/wireguard/wg0.conf
+type WireguardQuickConfig struct {
+	Interface WireguardQuickInterface
+	Peers     []WireguardPeer
+}
+
+// WireguardQuickInterface is the [Interface] section of a
+// wg-quick style configuration file. Hooks are kept as they are,
+// they are not executed by this library.
+type WireguardQuickInterface struct {
+	PrivateKey string
+	Addresses  []net.IPNet // local addresses, with their prefix length
+	ListenPort int
+	MTU        int
+	DNS        []string // name server addresses and search domains
+	Table      string   // routing table, "off", "auto" or a table name or number
+	FwMark     int      // firewall mark, 0 is off
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+	SaveConfig bool
+}
+
+// ConfigError describes an invalid line of a configuration file
+type ConfigError struct {
+	Line int    // line number, starting at 1
+	Msg  string // what is wrong
+	Err  error  // underlying error, if any
+}
+
+func (e *ConfigError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Msg, e.Err)
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Unwrap returns the underlying error
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// LoadQuickConfig reads and parses a wg-quick style configuration file
+func LoadQuickConfig(path string) (*WireguardQuickConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseQuickConfig(f)
+}
+
+// ParseQuickConfig parses a wg-quick style configuration. Section
+// and key names are case-insensitive, comments start with #.
+// Returns a *ConfigError pointing to the offending line.
+func ParseQuickConfig(r io.Reader) (*WireguardQuickConfig, error) {
+	res := &WireguardQuickConfig{
+		Peers: []WireguardPeer{},
+	}
+
+	const (
+		none = iota
+		inInterface
+		inPeer
+	)
+	section := none
+	hasInterface := false
+	peerLine := 0
+
+	// keys seen in the current section, to reject repeated single-valued ones
+	seen := map[string]bool{}
+
+	// checkPeer validates the peer section that ends here
+	checkPeer := func() error {
+		if section == inPeer && res.Peers[len(res.Peers)-1].Pubkey == "" {
+			return &ConfigError{Line: peerLine, Msg: "peer without PublicKey"}
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if err := checkPeer(); err != nil {
+				return nil, err
+			}
+			seen = map[string]bool{}
+			switch strings.ToLower(line) {
+			case "[interface]":
+				if hasInterface {
+					return nil, &ConfigError{Line: lineNo, Msg: "duplicate [Interface] section"}
+				}
+				hasInterface = true
+				section = inInterface
+			case "[peer]":
+				res.Peers = append(res.Peers, WireguardPeer{
+					AllowedIPs: []net.IPNet{},
+				})
+				peerLine = lineNo
+				section = inPeer
+			default:
+				return nil, &ConfigError{Line: lineNo, Msg: fmt.Sprintf("unknown section %s", line)}
+			}
+			continue
+		}
+
+		idx := strings.Index(line, "=")
+		if idx == -1 {
+			return nil, &ConfigError{Line: lineNo, Msg: "expected key = value"}
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:idx]))
+		value := strings.TrimSpace(line[idx+1:])
+		if seen[key] && !quickListKeys[key] {
+			return nil, &ConfigError{Line: lineNo, Msg: fmt.Sprintf("duplicate key %s", strings.TrimSpace(line[:idx]))}
+		}
+		seen[key] = true
+
+		var err error
+		switch section {
+		case inInterface:
+			err = res.Interface.parse(key, value)
+		case inPeer:
+			err = parseQuickPeer(&res.Peers[len(res.Peers)-1], key, value)
+		default:
+			return nil, &ConfigError{Line: lineNo, Msg: fmt.Sprintf("key %s outside of a section", key)}
+		}
+		if err != nil {
+			var ce *ConfigError
+			if errors.As(err, &ce) {
+				ce.Line = lineNo
+				return nil, ce
+			}
+			return nil, &ConfigError{Line: lineNo, Msg: fmt.Sprintf("invalid value for %s", key), Err: err}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkPeer(); err != nil {
+		return nil, err
+	}
+	if !hasInterface {
+		return nil, &ConfigError{Line: lineNo, Msg: "missing [Interface] section"}
+	}
+
+	return res, nil
+}
+
+// quickListKeys are the keys that may be given more than once,
+// their values add up
+var quickListKeys = map[string]bool{
+	"address": true, "dns": true, "allowedips": true,
+	"preup": true, "postup": true, "predown": true, "postdown": true,
+}
+
+// splitList splits a comma separated list of values
+func splitList(value string) []string {
+	res := []string{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func (i *WireguardQuickInterface) parse(key, value string) error {
+	switch key {
+	case "privatekey":
+		if _, err := wgtypes.ParseKey(value); err != nil {
+			return invalidKey(err)
+		}
+		i.PrivateKey = value
+	case "address":
+		for _, a := range splitList(value) {
+			ip, ipnet, err := net.ParseCIDR(a)
+			if err != nil {
+				return err
+			}
+			i.Addresses = append(i.Addresses, net.IPNet{IP: ip, Mask: ipnet.Mask})
+		}
+	case "listenport":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return err
+		}
+		i.ListenPort = int(port)
+	case "mtu":
+		mtu, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return err
+		}
+		i.MTU = int(mtu)
+	case "dns":
+		i.DNS = append(i.DNS, splitList(value)...)
+	case "table":
+		i.Table = value
+	case "fwmark":
+		if value == "off" {
+			i.FwMark = 0
+			return nil
+		}
+		mark, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return err
+		}
+		i.FwMark = int(mark)
+	case "preup":
+		i.PreUp = append(i.PreUp, value)
+	case "postup":
+		i.PostUp = append(i.PostUp, value)
+	case "predown":
+		i.PreDown = append(i.PreDown, value)
+	case "postdown":
+		i.PostDown = append(i.PostDown, value)
+	case "saveconfig":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		i.SaveConfig = b
+	default:
+		return &ConfigError{Msg: fmt.Sprintf("unknown key %s in [Interface]", key)}
+	}
+	return nil
+}
+
+func parseQuickPeer(p *WireguardPeer, key, value string) error {
+	switch key {
+	case "publickey":
+		if _, err := wgtypes.ParseKey(value); err != nil {
+			return invalidKey(err)
+		}
+		p.Pubkey = value
+	case "presharedkey":
+		if _, err := wgtypes.ParseKey(value); err != nil {
+			return invalidKey(err)
+		}
+		psk := value
+		p.Psk = &psk
+	case "endpoint":
+		host, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return err
+		}
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return err
+		}
+		if net.ParseIP(host) != nil {
+			p.RemoteEndpointIP = host
+		} else {
+			p.RemoteEndpointHost = host
+		}
+		p.ListenPort = int(portNum)
+	case "allowedips":
+		// host bits are kept, wireguard masks them
+		for _, a := range splitList(value) {
+			ip, ipnet, err := net.ParseCIDR(a)
+			if err != nil {
+				return err
+			}
+			p.AllowedIPs = append(p.AllowedIPs, net.IPNet{IP: normalizeIP(ip), Mask: ipnet.Mask})
+		}
+	case "persistentkeepalive":
+		if value == "off" {
+			p.PersistentKeepaliveInterval = 0
+			return nil
+		}
+		secs, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return err
+		}
+		p.PersistentKeepaliveInterval = time.Duration(secs) * time.Second
+	default:
+		return &ConfigError{Msg: fmt.Sprintf("unknown key %s in [Peer]", key)}
+	}
+	return nil
+}
+
+// joinIPNets formats a list of networks, separated by comma
+func joinIPNets(a []net.IPNet) string {
+	s := make([]string, len(a))
+	for idx, n := range a {
+		s[idx] = n.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// WriteTo writes the configuration in wg-quick format. Parsing
+// the output yields the same configuration.
+func (c *WireguardQuickConfig) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+
+	kv := func(key, value string) {
+		fmt.Fprintf(&b, "%s = %s\n", key, value)
+	}
+
+	i := c.Interface
+	b.WriteString("[Interface]\n")
+	if i.PrivateKey != "" {
+		kv("PrivateKey", i.PrivateKey)
+	}
+	if len(i.Addresses) > 0 {
+		kv("Address", joinIPNets(i.Addresses))
+	}
+	if i.ListenPort != 0 {
+		kv("ListenPort", strconv.Itoa(i.ListenPort))
+	}
+	if i.MTU != 0 {
+		kv("MTU", strconv.Itoa(i.MTU))
+	}
+	if len(i.DNS) > 0 {
+		kv("DNS", strings.Join(i.DNS, ", "))
+	}
+	if i.Table != "" {
+		kv("Table", i.Table)
+	}
+	if i.FwMark != 0 {
+		kv("FwMark", strconv.Itoa(i.FwMark))
+	}
+	for _, hook := range []struct {
+		key   string
+		lines []string
+	}{
+		{"PreUp", i.PreUp}, {"PostUp", i.PostUp}, {"PreDown", i.PreDown}, {"PostDown", i.PostDown},
+	} {
+		for _, l := range hook.lines {
+			kv(hook.key, l)
+		}
+	}
+	if i.SaveConfig {
+		kv("SaveConfig", "true")
+	}
+
+	for _, p := range c.Peers {
+		b.WriteString("\n[Peer]\n")
+		kv("PublicKey", p.Pubkey)
+		if p.Psk != nil {
+			kv("PresharedKey", *p.Psk)
+		}
+		if p.RemoteEndpointHost != "" {
+			kv("Endpoint", net.JoinHostPort(p.RemoteEndpointHost, strconv.Itoa(p.ListenPort)))
+		} else if p.RemoteEndpointIP != "" {
+			kv("Endpoint", net.JoinHostPort(p.RemoteEndpointIP, strconv.Itoa(p.ListenPort)))
+		}
+		if len(p.AllowedIPs) > 0 {
+			kv("AllowedIPs", joinIPNets(p.AllowedIPs))
+		}
+		if p.PersistentKeepaliveInterval != 0 {
+			kv("PersistentKeepalive", strconv.Itoa(int(p.PersistentKeepaliveInterval/time.Second)))
+		}
+	}
+
+	return b.WriteTo(w)
+}
+
+// String returns the configuration in wg-quick format
+func (c *WireguardQuickConfig) String() string {
+	var b bytes.Buffer
+	c.WriteTo(&b)
+	return b.String()
+}
+
+// WireguardInterface returns the basic properties of the configuration
+// as a WireguardInterface with given name. It carries the addresses, MTU,
+// firewall mark and the public key derived from the private key, if any.
+func (c *WireguardQuickConfig) WireguardInterface(interfaceName string) WireguardInterface {
+	res := WireguardInterface{
+		InterfaceName: interfaceName,
+		ListenPort:    c.Interface.ListenPort,
+		PrivateKey:    c.Interface.PrivateKey,
+		MTU:           c.Interface.MTU,
+		FirewallMark:  c.Interface.FwMark,
+	}
+	if len(c.Interface.Addresses) > 0 {
+		res.IP = c.Interface.Addresses[0]
+		res.Addresses = c.Interface.Addresses
+	}
+	if k, err := wgtypes.ParseKey(c.Interface.PrivateKey); err == nil {
+		res.PublicKey = k.PublicKey().String()
+	}
+	return res
+}
@@ -0,0 +1,173 @@
+// +build linux
+
+package wgwrapper
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const quickConfig = `# site to site tunnel
+[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.192.122.1/24, fd00::1/64
+ListenPort = 51820
+MTU = 1420
+DNS = 10.192.122.53, example.com
+Table = off
+FwMark = 0x10
+PreUp = ip rule add fwmark 16 table 100
+PostUp = echo up   # announce
+PostDown = echo down
+SaveConfig = false
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = 9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=
+Endpoint = 192.95.5.67:1234
+AllowedIPs = 10.192.122.3/32, 10.192.124.0/24
+AllowedIPs = 10.192.125.1/24
+PersistentKeepalive = 25
+
+[peer]
+publickey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=
+Endpoint = [2607:5300:60:6b0::c05f:543]:2468
+AllowedIPs = ::/0
+`
+
+func TestParseQuickConfig(t *testing.T) {
+	c, err := ParseQuickConfig(strings.NewReader(quickConfig))
+	if err != nil {
+		t.Fatalf("Unable to parse config: %s", err)
+	}
+
+	i := c.Interface
+	if len(i.Addresses) != 2 || i.Addresses[0].String() != "10.192.122.1/24" || i.Addresses[1].String() != "fd00::1/64" {
+		t.Errorf("Unexpected addresses: %v", i.Addresses)
+	}
+	if i.ListenPort != 51820 || i.MTU != 1420 || i.Table != "off" || i.FwMark != 16 || i.SaveConfig {
+		t.Errorf("Unexpected interface settings: %#v", i)
+	}
+	if !reflect.DeepEqual(i.DNS, []string{"10.192.122.53", "example.com"}) {
+		t.Errorf("Unexpected DNS: %v", i.DNS)
+	}
+	if !reflect.DeepEqual(i.PostUp, []string{"echo up"}) || len(i.PreUp) != 1 || len(i.PostDown) != 1 || len(i.PreDown) != 0 {
+		t.Errorf("Unexpected hooks: %#v", i)
+	}
+
+	if len(c.Peers) != 2 {
+		t.Fatalf("Expected two peers, got %d", len(c.Peers))
+	}
+	p := c.Peers[0]
+	if p.RemoteEndpointIP != "192.95.5.67" || p.ListenPort != 1234 {
+		t.Errorf("Unexpected endpoint: %s %d", p.RemoteEndpointIP, p.ListenPort)
+	}
+	if p.Psk == nil || *p.Psk != "9g4Eec+u+wBuMF06+qnsYl3G81l2PNCnG7nvtss9O2I=" {
+		t.Errorf("Unexpected preshared key: %v", p.Psk)
+	}
+	if len(p.AllowedIPs) != 3 || p.AllowedIPs[1].String() != "10.192.124.0/24" || p.AllowedIPs[2].String() != "10.192.125.1/24" {
+		t.Errorf("Unexpected allowed ips: %v", p.AllowedIPs)
+	}
+	if p.PersistentKeepaliveInterval != 25*time.Second {
+		t.Errorf("Unexpected keepalive: %s", p.PersistentKeepaliveInterval)
+	}
+	p = c.Peers[1]
+	if p.RemoteEndpointIP != "2607:5300:60:6b0::c05f:543" || p.ListenPort != 2468 || p.Psk != nil {
+		t.Errorf("Unexpected second peer: %#v", p)
+	}
+
+	wgi := c.WireguardInterface("wg0")
+	if wgi.InterfaceName != "wg0" || wgi.IP.String() != "10.192.122.1/24" || len(wgi.Addresses) != 2 || wgi.ListenPort != 51820 {
+		t.Errorf("Unexpected interface: %#v", wgi)
+	}
+	if wgi.MTU != 1420 || wgi.FirewallMark != 16 {
+		t.Errorf("Unexpected link attributes: %#v", wgi)
+	}
+	if wgi.PublicKey != "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=" || wgi.PrivateKey != c.Interface.PrivateKey {
+		t.Errorf("Unexpected keys: %s %s", wgi.PublicKey, wgi.PrivateKey)
+	}
+
+	// Table = off leaves routes alone, like wg-quick
+	if c.InterfaceSpec("wg0").RoutesFromPeers {
+		t.Error("Table = off should not route allowed IPs")
+	}
+	c.Interface.Table = ""
+	if !c.InterfaceSpec("wg0").RoutesFromPeers {
+		t.Error("Allowed IPs should be routed by default")
+	}
+}
+
+func TestQuickConfigRoundTrip(t *testing.T) {
+	c, err := ParseQuickConfig(strings.NewReader(quickConfig))
+	if err != nil {
+		t.Fatalf("Unable to parse config: %s", err)
+	}
+
+	out := c.String()
+	c2, err := ParseQuickConfig(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("Unable to parse written config: %s\n%s", err, out)
+	}
+	if !reflect.DeepEqual(c, c2) {
+		t.Errorf("Config changed in round trip:\n%#v\n%#v", c, c2)
+	}
+	if out2 := c2.String(); out != out2 {
+		t.Errorf("Output changed in round trip:\n%s\n%s", out, out2)
+	}
+}
+
+func TestQuickConfigEndpointHost(t *testing.T) {
+	config := "[Interface]\n[Peer]\nPublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\nEndpoint = demo.wireguard.com:51820\n"
+	c, err := ParseQuickConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("Unable to parse config: %s", err)
+	}
+	p := c.Peers[0]
+	if p.RemoteEndpointHost != "demo.wireguard.com" || p.RemoteEndpointIP != "" || p.ListenPort != 51820 {
+		t.Errorf("Unexpected endpoint: %#v", p)
+	}
+	if !strings.Contains(c.String(), "Endpoint = demo.wireguard.com:51820") {
+		t.Errorf("Host name endpoint not written:\n%s", c.String())
+	}
+}
+
+func TestParseQuickConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		line   int
+		kind   error
+	}{
+		{"outside section", "ListenPort = 1\n[Interface]", 1, nil},
+		{"unknown section", "[Interface]\n\n[Foo]", 3, nil},
+		{"no equals sign", "[Interface]\nListenPort 1", 2, nil},
+		{"unknown key", "[Interface]\nFoo = bar", 2, nil},
+		{"invalid port", "[Interface]\nListenPort = 70000", 2, nil},
+		{"invalid address", "[Interface]\nAddress = 10.0.0.1", 2, nil},
+		{"invalid private key", "[Interface]\nPrivateKey = abc", 2, ErrInvalidKey},
+		{"duplicate interface", "[Interface]\n[Interface]", 2, nil},
+		{"invalid endpoint", "[Interface]\n[Peer]\nPublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\nEndpoint = 1.2.3.4", 4, nil},
+		{"peer without key", "[Interface]\n[Peer]\nAllowedIPs = ::/0\n[Peer]", 2, nil},
+		{"missing interface", "# empty\n", 1, nil},
+		{"duplicate private key", "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nprivatekey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=", 3, nil},
+		{"duplicate listen port", "[Interface]\nListenPort = 1\nAddress = 10.0.0.1/24\nListenPort = 2", 4, nil},
+		{"duplicate endpoint", "[Interface]\n[Peer]\nPublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\nEndpoint = 1.2.3.4:1\nEndpoint = 1.2.3.5:1", 5, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseQuickConfig(strings.NewReader(tc.config))
+			var ce *ConfigError
+			if !errors.As(err, &ce) {
+				t.Fatalf("Expected a ConfigError, got %v", err)
+			}
+			if ce.Line != tc.line {
+				t.Errorf("Expected error in line %d, got %s", tc.line, ce)
+			}
+			if tc.kind != nil && !errors.Is(err, tc.kind) {
+				t.Errorf("Expected %v, got %v", tc.kind, err)
+			}
+		})
+	}
+}
@@ -2,6 +2,11 @@
 
 package wgwrapper
 
+import (
+	"context"
+	"net"
+)
+
 type WireguardPeerIterator func(p WireguardPeer)
 
 // WireguardWrapper is the main interface to work
@@ -9,7 +14,7 @@ type WireguardPeerIterator func(p WireguardPeer)
 type WireguardWrapper interface {
 
 	// AddInterface creates a wireguard interface from basic properties
-	// (name, ip)
+	// (name, ip, link attributes)
 	AddInterface(intf WireguardInterface) error
 
 	// AddInterfaceNoAddr is similar to AddInterface with the exception that no
@@ -25,35 +30,242 @@ type WireguardWrapper interface {
 	// HasInterface checks if given interface exists (by name)
 	HasInterface(intf WireguardInterface) (bool, error)
 
+	// GetInterface reads back an existing interface, including its
+	// addresses, listen port, public key and link attributes
+	GetInterface(interfaceName string) (WireguardInterface, error)
+
 	// Configure makes sure that the wireguard interface
-	// has a listen port configured and a keypair (by creatig one).
+	// has a listen port configured and a keypair (by creatig one),
+	// as well as the firewall mark of intf, if given.
 	// Needs endpoint ip and listen port from intf.
 	// Extracts public key part and stores it in intf.
+	// Uses intf.PrivateKey if set, and fails with ErrKeyMismatch
+	// if the interface already has a different key.
 	Configure(intf *WireguardInterface) error
 
-	// AddPeer adds a new peer to an existing interface
+	// RotateKey replaces the private key of an interface with a new
+	// one and updates the keys in intf
+	RotateKey(intf *WireguardInterface) error
+
+	// ScheduleKeyRotation rotates the key of an interface as scheduled
+	// by r, until ctx or the context given by WithContext is done.
+	ScheduleKeyRotation(ctx context.Context, intf WireguardInterface, r KeyRotation) error
+
+	// AddPeer adds a new peer to an existing interface. Returns false
+	// and leaves the peer untouched if it already exists, see UpsertPeer.
 	AddPeer(intf WireguardInterface, peer WireguardPeer) (bool, error)
 
+	// UpdatePeer changes an existing peer as given by upd and returns
+	// the fields that changed. Fails with ErrPeerNotFound for unknown peers.
+	UpdatePeer(intf WireguardInterface, peer WireguardPeer, upd PeerUpdate) ([]FieldChange, error)
+
+	// UpsertPeer adds a peer or updates an existing one as given by upd.
+	// Returns whether the peer has been added and the fields that changed.
+	UpsertPeer(intf WireguardInterface, peer WireguardPeer, upd PeerUpdate) (bool, []FieldChange, error)
+
 	// HasPeer check if a peer is present on an interface. Compares by public key only
 	HasPeer(intf WireguardInterface, peer WireguardPeer) (bool, error)
 
 	// RemoveAllPeers removes all peers on an existing interface
 	RemoveAllPeers(intf WireguardInterface) error
 
+	// SyncPeers makes the peers of an interface match the given ones in a
+	// single device configuration, without disturbing unchanged peers.
+	// Returns the peers added, updated and removed.
+	SyncPeers(intf WireguardInterface, peers []WireguardPeer) ([]Change, error)
+
+	// AddPeers adds many peers to an existing interface in chunked device
+	// configurations, after validating all of them. Existing peers are left
+	// untouched. Returns the number of peers added.
+	AddPeers(intf WireguardInterface, peers []WireguardPeer) (int, error)
+
+	// RemovePeers removes many peers from an interface in chunked device
+	// configurations. Returns the number of peers removed.
+	RemovePeers(intf WireguardInterface, pubkeys []string) (int, error)
+
+	// SetPresharedKey sets the preshared key of an existing peer
+	SetPresharedKey(intf WireguardInterface, pubkey string, psk string) error
+
+	// ClearPresharedKey removes the preshared key of an existing peer
+	ClearPresharedKey(intf WireguardInterface, pubkey string) error
+
+	// RotatePresharedKeys sets new preshared keys for the given peers.
+	// Returns the new keys by public key of the peer.
+	RotatePresharedKeys(intf WireguardInterface, pubkeys []string) (map[string]string, error)
+
+	// SchedulePskRotation rotates the preshared keys of the given peers as
+	// scheduled by r, until ctx or the context given by WithContext is done.
+	SchedulePskRotation(ctx context.Context, intf WireguardInterface, pubkeys []string, r PskRotation) error
+
 	// RemovePeerByPubkey remove a single peer from an interface
 	RemovePeerByPubkey(intf WireguardInterface, pubkey string) error
 
-	// IteratePeers walks over the current list of peers of an interface
+	// IteratePeers walks over the current list of peers of an interface.
+	// Preshared keys are not revealed, Psk is always nil.
 	IteratePeers(intf WireguardInterface, it WireguardPeerIterator) error
 
-	// SetRoute checks if there is a route on given interface to network. If not, adds it. all using /sbin/ip
+	// PeerStatuses returns the runtime state of all peers of an interface,
+	// including handshakes and transfer counters
+	PeerStatuses(intf WireguardInterface) ([]PeerStatus, error)
+
+	// PeerStatus returns the runtime state of a single peer. Fails with
+	// ErrPeerNotFound if the interface has no such peer.
+	PeerStatus(intf WireguardInterface, pubkey string) (PeerStatus, error)
+
+	// ResolveEndpoints resolves the host name endpoints of peers again and
+	// updates those whose address changed. Returns the changes made.
+	ResolveEndpoints(intf WireguardInterface, peers []WireguardPeer, r EndpointResolver) ([]Change, error)
+
+	// WatchEndpoints keeps resolving the host name endpoints of peers as
+	// scheduled by r, until ctx or the context given by WithContext is done.
+	WatchEndpoints(ctx context.Context, intf WireguardInterface, peers []WireguardPeer, r EndpointResolver) error
+
+	// Addresses returns all addresses assigned to an interface
+	Addresses(intf WireguardInterface) ([]net.IPNet, error)
+
+	// AddAddress assigns an address to an interface, keeping others.
+	// Returns false if the interface has it already.
+	AddAddress(intf WireguardInterface, addr net.IPNet) (bool, error)
+
+	// RemoveAddress removes an address from an interface. Returns
+	// false if the interface does not have it.
+	RemoveAddress(intf WireguardInterface, addr net.IPNet) (bool, error)
+
+	// ReplaceAddress assigns address new to an interface, then
+	// removes address old
+	ReplaceAddress(intf WireguardInterface, old, new net.IPNet) error
+
+	// SyncAddresses makes the addresses of an interface match addrs
+	// exactly. Returns the addresses added and removed.
+	SyncAddresses(intf WireguardInterface, addrs []net.IPNet) ([]Change, error)
+
+	// DeriveMTU computes a safe MTU for an interface from the links behind
+	// the default route and the routes to the endpoints of its peers
+	DeriveMTU(intf WireguardInterface) (int, error)
+
+	// UpdateMTU applies the MTU derived from the underlay if it differs
+	// from the current one. Returns the change made, if any.
+	UpdateMTU(intf WireguardInterface) ([]Change, error)
+
+	// WatchMTU keeps the MTU of an interface in line with its underlay,
+	// as scheduled by w, until ctx or the context given by WithContext is
+	// done.
+	WatchMTU(ctx context.Context, intf WireguardInterface, w MTUWatcher) error
+
+	// Routes returns the IPv4 and IPv6 routes via an interface, of all
+	// routing tables but the local one
+	Routes(intf WireguardInterface) ([]Route, error)
+
+	// AddRoute adds a route via an interface. Returns false if the
+	// route is present already, fails with ErrRouteExists if a route
+	// with the same destination, table and metric differs.
+	AddRoute(intf WireguardInterface, r Route) (bool, error)
+
+	// DeleteRoute removes the route via an interface with the destination,
+	// table and metric of r. Returns false if there is none.
+	DeleteRoute(intf WireguardInterface, r Route) (bool, error)
+
+	// ReplaceRoute adds a route via an interface, or changes the one
+	// with the same destination, table and metric
+	ReplaceRoute(intf WireguardInterface, r Route) error
+
+	// SyncRoutes makes the routes via an interface in the main table match
+	// the allowed IPs of its peers, like wg-quick does. Allowed IPs within
+	// the network of an address, default routes and routes added by the
+	// kernel are left alone. Returns the changes made.
+	SyncRoutes(intf WireguardInterface) ([]Change, error)
+
+	// SetRoute checks if there is a route on given interface to network. If not, adds it.
 	SetRoute(intf WireguardInterface, networkCIDR string) error
 
 	// DefaultRouteInterface returns the interface name behind the default route.
 	DefaultRouteInterface() (string, error)
+
+	// Apply converges an interface to the desired state given by spec,
+	// creating it if necessary. It is idempotent and returns the changes
+	// that were necessary.
+	Apply(spec InterfaceSpec) ([]Change, error)
+
+	// Plan computes the changes Apply would make for spec,
+	// without touching the system
+	Plan(spec InterfaceSpec) (*Plan, error)
+
+	// ApplyPlan executes the changes of a plan
+	ApplyPlan(plan *Plan) ([]Change, error)
+
+	// Begin starts a transaction. Changes made through it are
+	// reverted if a later one fails, or on Rollback.
+	Begin() *Transaction
+
+	// Close releases the wgctrl client given by WithWireguardClient, if any.
+	Close() error
+
+	// WithContext returns a WireguardWrapper that shares everything with
+	// this one, but whose operations give up as soon as ctx is done. Calls
+	// to the ip binary are killed, netlink requests are interrupted.
+	// Wireguard device operations are not started once ctx is done, but
+	// one that has started is completed, so a call made while ctx is
+	// cancelled may still have been applied.
+	// Errors caused by ctx match context.Canceled or
+	// context.DeadlineExceeded via errors.Is.
+	WithContext(ctx context.Context) WireguardWrapper
+}
+
+// New sets up a new WireguardWrapper. By default, links, addresses and
+// routes are managed via rtnetlink and each operation opens its own
+// wgctrl client. Both can be changed by options, WithIPCommand falls
+// back to calling /sbin/ip.
+func New(opts ...Option) WireguardWrapper {
+	o := newOptions(opts)
+
+	var backend linkBackend
+	if o.ipCommand {
+		runner := o.runner
+		if runner == nil {
+			runner = execRunner{}
+		}
+		backend = ipCommand{
+			path:    o.ipPath,
+			runner:  runner,
+			logger:  o.logger,
+			timeout: o.timeout,
+		}
+	} else {
+		backend = rtnetlink{
+			timeout: o.timeout,
+			logger:  o.logger,
+		}
+	}
+
+	if o.client != nil {
+		wg := o.wrapper(backend, o.client)
+		wg.client = o.client
+		return wg
+	}
+	wg := o.wrapper(backend, nil)
+	wg.newClient = func(ctx context.Context) (wgClient, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		c, err := newWgctrlClient()
+		if err != nil {
+			return nil, err
+		}
+		return managedClient{c: c, ctx: ctx, logger: o.logger}, nil
+	}
+	return wg
+}
+
+// NewWithRunner sets up a new WireguardWrapper which calls /sbin/ip
+// through given CommandRunner, e.g. a RecordingRunner in tests.
+// Same as New(WithCommandRunner(runner)).
+func NewWithRunner(runner CommandRunner) WireguardWrapper {
+	return New(WithCommandRunner(runner))
 }
 
-// New sets up a new WireguardWrapper
-func New() WireguardWrapper {
-	return wgwrapper{}
+// NewNetlink sets up a new WireguardWrapper which manages links,
+// addresses and routes via rtnetlink directly, so it does not
+// depend on /sbin/ip being present. Same as New().
+func NewNetlink() WireguardWrapper {
+	return New(WithNetlink())
 }